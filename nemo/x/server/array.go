@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrNotArray is returned when array position is requested
+// by a job which is not an element of a job array.
+var ErrNotArray = errors.New("not an element of a job array")
+
+// JobArray describes the job array the job is an element of.
+// Values not provided by the scheduler are null.
+type JobArray struct {
+	// ID of the array job
+	ParentID *int `json:"parentId" yaml:"parentId" hcl:"parentId"`
+	// Index of this element
+	Index *int `json:"index" yaml:"index" hcl:"index"`
+	// Number of elements in the array
+	Size *int `json:"size" yaml:"size" hcl:"size"`
+	// Range of indices, like 1-100:2
+	Range    string `json:"range" yaml:"range" hcl:"range"`
+	MinIndex *int   `json:"minIndex" yaml:"minIndex" hcl:"minIndex"`
+	MaxIndex *int   `json:"maxIndex" yaml:"maxIndex" hcl:"maxIndex"`
+	Step     *int   `json:"step" yaml:"step" hcl:"step"`
+}
+
+// ArrayPosition is position of this element within its job array.
+type ArrayPosition struct {
+	Array JobArray `json:"array" yaml:"array" hcl:"array"`
+	// Zero based position of this element among elements of the array,
+	// null if indices do not form a regular range
+	Position *int `json:"position" yaml:"position" hcl:"position"`
+	// Number of elements after this one, null if unknown
+	Remaining *int `json:"remaining" yaml:"remaining" hcl:"remaining"`
+	First     bool `json:"first" yaml:"first" hcl:"first"`
+	Last      bool `json:"last" yaml:"last" hcl:"last"`
+}
+
+// newJobArray returns job array of element index. It returns nil if
+// index is unknown, which means job is not an element of an array.
+// Range, and size if it is not known, are derived from minimum and
+// maximum index and step, as long as indices form a regular range.
+func newJobArray(parent, index, size, minIndex, maxIndex, step *int) *JobArray {
+	if index == nil {
+		return nil
+	}
+	a := &JobArray{ParentID: parent, Index: index, Size: size, MinIndex: minIndex, MaxIndex: maxIndex, Step: step}
+	if minIndex != nil && maxIndex != nil && *maxIndex >= *minIndex {
+		stride := 1
+		if step != nil && *step > 0 {
+			stride = *step
+		}
+		count := (*maxIndex-*minIndex)/stride + 1
+		// Indices like 1,3,7-9 cannot be described by a range.
+		if a.Size == nil || *a.Size == count {
+			a.Size = intPtr(count)
+			a.Range = fmt.Sprintf("%d-%d", *minIndex, *maxIndex)
+			if stride > 1 {
+				a.Range += fmt.Sprintf(":%d", stride)
+			}
+		}
+	}
+	return a
+}
+
+// Position returns position of element within the array. Position is
+// only known if indices form a regular range, which is not the case
+// for arrays like 1,3,7-9.
+func (a JobArray) Position() ArrayPosition {
+	p := ArrayPosition{Array: a}
+	if a.MinIndex == nil || a.MaxIndex == nil || *a.Index < *a.MinIndex || *a.Index > *a.MaxIndex {
+		return p
+	}
+	stride := 1
+	if a.Step != nil && *a.Step > 0 {
+		stride = *a.Step
+	}
+	offset := *a.Index - *a.MinIndex
+	regular := offset%stride == 0
+	if a.Size != nil {
+		regular = regular && *a.Size == (*a.MaxIndex-*a.MinIndex)/stride+1
+	}
+	if !regular {
+		return p
+	}
+	p.Position = intPtr(offset / stride)
+	p.Remaining = intPtr((*a.MaxIndex - *a.Index) / stride)
+	p.First = *p.Position == 0
+	p.Last = *p.Remaining == 0
+	return p
+}
+
+// arrayParentID returns numeric ID of array job from job ID of one of its
+// elements, like 1234[5].server or 1234[].server. It returns nil if jobID
+// is not of an array element.
+func arrayParentID(jobID string) *int {
+	i := strings.IndexByte(jobID, '[')
+	if i <= 0 || !strings.Contains(jobID[i:], "]") {
+		return nil
+	}
+	id, err := strconv.Atoi(jobID[:i])
+	if err != nil {
+		return nil
+	}
+	return &id
+}
+
+// handleJobArray returns position of this job within its job array.
+func (s *Server) handleJobArray(w http.ResponseWriter, r *http.Request) {
+	array := s.opts.Scheduler.JobInfo(s.opts.Env).Array
+	if array == nil {
+		http.Error(w, ErrNotArray.Error(), http.StatusNotFound)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, array.Position())
+}
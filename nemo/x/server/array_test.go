@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobArrayPosition(t *testing.T) {
+	tests := []struct {
+		name     string
+		array    *JobArray
+		expect   *JobArray
+		position *int
+		remain   *int
+		first    bool
+		last     bool
+	}{
+		{
+			name:     "regular",
+			array:    newJobArray(intPtr(10), intPtr(5), nil, intPtr(1), intPtr(9), intPtr(2)),
+			expect:   &JobArray{ParentID: intPtr(10), Index: intPtr(5), Size: intPtr(5), Range: "1-9:2", MinIndex: intPtr(1), MaxIndex: intPtr(9), Step: intPtr(2)},
+			position: intPtr(2), remain: intPtr(2),
+		},
+		{
+			name:     "first",
+			array:    newJobArray(intPtr(10), intPtr(0), intPtr(4), intPtr(0), intPtr(3), intPtr(1)),
+			expect:   &JobArray{ParentID: intPtr(10), Index: intPtr(0), Size: intPtr(4), Range: "0-3", MinIndex: intPtr(0), MaxIndex: intPtr(3), Step: intPtr(1)},
+			position: intPtr(0), remain: intPtr(3), first: true,
+		},
+		{
+			name:     "last-without-step",
+			array:    newJobArray(nil, intPtr(3), nil, intPtr(1), intPtr(3), nil),
+			expect:   &JobArray{Index: intPtr(3), Size: intPtr(3), Range: "1-3", MinIndex: intPtr(1), MaxIndex: intPtr(3)},
+			position: intPtr(2), remain: intPtr(0), last: true,
+		},
+		{
+			name:   "irregular",
+			array:  newJobArray(intPtr(10), intPtr(7), intPtr(5), intPtr(1), intPtr(9), intPtr(1)),
+			expect: &JobArray{ParentID: intPtr(10), Index: intPtr(7), Size: intPtr(5), MinIndex: intPtr(1), MaxIndex: intPtr(9), Step: intPtr(1)},
+		},
+		{
+			name:   "bounds-unknown",
+			array:  newJobArray(intPtr(10), intPtr(7), intPtr(20), nil, nil, nil),
+			expect: &JobArray{ParentID: intPtr(10), Index: intPtr(7), Size: intPtr(20)},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, tc.array)
+			p := tc.array.Position()
+			assert.Equal(t, tc.position, p.Position)
+			assert.Equal(t, tc.remain, p.Remaining)
+			assert.Equal(t, tc.first, p.First)
+			assert.Equal(t, tc.last, p.Last)
+		})
+	}
+
+	assert.Nil(t, newJobArray(intPtr(10), nil, nil, nil, nil, nil))
+}
+
+func TestArrayParentID(t *testing.T) {
+	tests := []struct {
+		jobID  string
+		expect *int
+	}{
+		{jobID: "1234[5].server", expect: intPtr(1234)},
+		{jobID: "1234[].server", expect: intPtr(1234)},
+		{jobID: "1234[5]", expect: intPtr(1234)},
+		{jobID: "1234.server"},
+		{jobID: "[5].server"},
+		{jobID: "x[5].server"},
+		{jobID: "1234[5.server"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.jobID, func(t *testing.T) {
+			assert.Equal(t, tc.expect, arrayParentID(tc.jobID))
+		})
+	}
+}
+
+func TestSchedulerArray(t *testing.T) {
+	tests := []struct {
+		name   string
+		sched  Scheduler
+		env    map[string]string
+		expect *JobArray
+	}{
+		{name: "pbs-none", sched: pbsScheduler{}, env: map[string]string{"PBS_JOBID": "1234.server"}},
+		{
+			name:   "torque",
+			sched:  pbsScheduler{},
+			env:    map[string]string{"PBS_JOBID": "1234[5].server", "PBS_ARRAYID": "5"},
+			expect: &JobArray{ParentID: intPtr(1234), Index: intPtr(5)},
+		},
+		{
+			name:   "moab",
+			sched:  pbsScheduler{},
+			env:    map[string]string{"PBS_JOBID": "1234[5].server", "PBS_ARRAYID": "5", "MOAB_JOBARRAYRANGE": "10"},
+			expect: &JobArray{ParentID: intPtr(1234), Index: intPtr(5), Size: intPtr(10)},
+		},
+		{
+			name:  "pbs-pro",
+			sched: pbsScheduler{},
+			env: map[string]string{
+				"PBS_JOBID": "1234[5].server", "PBS_ARRAY_ID": "1234[].server", "PBS_ARRAY_INDEX": "5",
+			},
+			expect: &JobArray{ParentID: intPtr(1234), Index: intPtr(5)},
+		},
+		{name: "slurm-none", sched: slurmScheduler{}, env: map[string]string{"SLURM_JOB_ID": "9"}},
+		{
+			name:  "slurm",
+			sched: slurmScheduler{},
+			env: map[string]string{
+				"SLURM_JOB_ID":           "12",
+				"SLURM_ARRAY_JOB_ID":     "9",
+				"SLURM_ARRAY_TASK_ID":    "3",
+				"SLURM_ARRAY_TASK_COUNT": "4",
+				"SLURM_ARRAY_TASK_MIN":   "1",
+				"SLURM_ARRAY_TASK_MAX":   "7",
+				"SLURM_ARRAY_TASK_STEP":  "2",
+			},
+			expect: &JobArray{
+				ParentID: intPtr(9), Index: intPtr(3), Size: intPtr(4), Range: "1-7:2",
+				MinIndex: intPtr(1), MaxIndex: intPtr(7), Step: intPtr(2),
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, tc.sched.JobInfo(MapEnv(tc.env)).Array)
+		})
+	}
+}
+
+func TestHandleJobArray(t *testing.T) {
+	ts := newEnvServer(t, slurmScheduler{}, map[string]string{
+		"SLURM_JOB_ID":          "12",
+		"SLURM_ARRAY_JOB_ID":    "9",
+		"SLURM_ARRAY_TASK_ID":   "7",
+		"SLURM_ARRAY_TASK_MIN":  "1",
+		"SLURM_ARRAY_TASK_MAX":  "7",
+		"SLURM_ARRAY_TASK_STEP": "3",
+	})
+	var p ArrayPosition
+	assert.Equal(t, http.StatusOK, getInto(t, ts, "/job/array", &p))
+	assert.Equal(t, "1-7:3", p.Array.Range)
+	assert.Equal(t, intPtr(3), p.Array.Size)
+	assert.Equal(t, intPtr(2), p.Position)
+	assert.Equal(t, intPtr(0), p.Remaining)
+	assert.True(t, p.Last)
+
+	var info Info
+	assert.Equal(t, http.StatusOK, getInto(t, ts, "/info", &info))
+	assert.Equal(t, &p.Array, info.Job.Array)
+
+	ts = newEnvServer(t, slurmScheduler{}, map[string]string{"SLURM_JOB_ID": "12"})
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/job/array", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestEncodeJobArray(t *testing.T) {
+	info := testInfo()
+	info.Job.Array = newJobArray(intPtr(40), intPtr(2), nil, intPtr(1), intPtr(4), nil)
+
+	tests := []struct {
+		name   string
+		encode func(*bytes.Buffer, interface{}) error
+		expect []string
+	}{
+		{
+			name:   "env",
+			encode: func(b *bytes.Buffer, v interface{}) error { return encodeEnv(b, v) },
+			expect: []string{"NEMO_JOB_ARRAY_PARENT_ID='40'\n", "NEMO_JOB_ARRAY_INDEX='2'\n", "NEMO_JOB_ARRAY_RANGE='1-4'\n"},
+		},
+		{
+			name:   "hcl",
+			encode: func(b *bytes.Buffer, v interface{}) error { return encodeHCL(b, v) },
+			expect: []string{"  array {\n", "    parentId = 40\n", "    size = 4\n"},
+		},
+		{
+			name:   "toml",
+			encode: func(b *bytes.Buffer, v interface{}) error { return encodeTOML(b, v) },
+			expect: []string{"[job.array]\n", "parentId = 40\n", "range = \"1-4\"\n"},
+		},
+		{
+			name:   "yaml",
+			encode: func(b *bytes.Buffer, v interface{}) error { return encodeYAML(b, v) },
+			expect: []string{"  array:\n", "    parentId: 40\n"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.Nil(t, tc.encode(&buf, info))
+			for _, s := range tc.expect {
+				assert.Contains(t, buf.String(), s)
+			}
+
+			// Jobs which are not arrays have no array fields.
+			buf.Reset()
+			assert.Nil(t, tc.encode(&buf, testInfo()))
+			assert.NotContains(t, buf.String(), "parentId")
+			assert.NotContains(t, buf.String(), "PARENT_ID")
+		})
+	}
+}
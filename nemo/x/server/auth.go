@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// access is level of access required by an endpoint.
+type access int
+
+const (
+	// accessPublic endpoints never require authentication.
+	accessPublic access = iota
+	// accessRead endpoints only return data. They require
+	// authentication only if Options.AuthRead is set, and accept
+	// the cluster token as well, as head node reads them.
+	accessRead
+	// accessWrite endpoints change state of the server or the job.
+	// They always require authentication.
+	accessWrite
+	// accessCluster endpoints are used by servers on other nodes of the
+	// job. They accept the cluster token as well as the instance token.
+	accessCluster
+)
+
+// Auth authenticates requests with a per instance bearer token.
+// Requests over Unix domain socket are authenticated by credentials
+// of the peer process instead.
+type Auth struct {
+	token    string
+	authRead bool
+	// cluster is token shared by servers on all nodes of the job.
+	cluster string
+	// owner is UID of the job owner, i.e the user server runs as.
+	owner int
+}
+
+// NewAuth returns Auth which accepts given token. If authRead is true,
+// read only endpoints require authentication as well.
+func NewAuth(token string, authRead bool) *Auth {
+	return &Auth{token: token, authRead: authRead, owner: os.Getuid()}
+}
+
+// AllowCluster makes cluster and read only endpoints accept token, which
+// is shared by servers on all nodes of the job. Empty token is ignored.
+func (a *Auth) AllowCluster(token string) {
+	a.cluster = token
+}
+
+// newToken returns a random token.
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// bearerToken returns token from Authorization header.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// PeerAuthorized returns nil if request did not come over a Unix domain
+// socket, or if it came from a process owned by the job owner.
+func (a *Auth) PeerAuthorized(r *http.Request) error {
+	info := connInfoFrom(r.Context())
+	if info == nil || !info.unix {
+		return nil
+	}
+	if info.err != nil {
+		return fmt.Errorf("unable to get peer credentials: %w", info.err)
+	}
+	if info.cred.UID != a.owner {
+		return fmt.Errorf("peer uid %d (pid %d) is not the job owner", info.cred.UID, info.cred.PID)
+	}
+	return nil
+}
+
+// Authenticated returns true if request carries a valid token,
+// or if it came over Unix domain socket from the job owner.
+func (a *Auth) Authenticated(r *http.Request) bool {
+	if info := connInfoFrom(r.Context()); info != nil && info.unix {
+		return a.PeerAuthorized(r) == nil
+	}
+	token := bearerToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// clusterAuthenticated returns true if request carries the cluster token.
+func (a *Auth) clusterAuthenticated(r *http.Request) bool {
+	token := bearerToken(r)
+	return a.cluster != "" && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.cluster)) == 1
+}
+
+// Require wraps next so that it is only called if request is
+// authenticated as required by level.
+func (a *Auth) Require(level access, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		required := level == accessWrite || level == accessCluster || (level == accessRead && a.authRead)
+		peer := level == accessRead || level == accessCluster
+		if required && !a.Authenticated(r) && !(peer && a.clusterAuthenticated(r)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nemo"`)
+			http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeTokenFile writes token to path, readable only by current user.
+// Parent directory is created if it does not exist.
+func writeTokenFile(path, token string) error {
+	return writeFileAtomic(path, []byte(token+"\n"), 0o600)
+}
+
+// readTokenFile reads token from path.
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
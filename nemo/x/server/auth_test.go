@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testToken = "secret-token"
+	// testClusterToken is shared by servers on all nodes in tests.
+	testClusterToken = "cluster-secret"
+)
+
+func TestAuthEndpoints(t *testing.T) {
+	tests := []struct {
+		name     string
+		authRead bool
+		method   string
+		path     string
+		header   string
+		status   int
+		shutdown bool
+	}{
+		{name: "shutdown-no-token", method: http.MethodPost, path: "/shutdown", status: http.StatusUnauthorized},
+		{name: "shutdown-wrong-token", method: http.MethodPost, path: "/shutdown", header: "Bearer wrong", status: http.StatusUnauthorized},
+		{name: "shutdown-wrong-scheme", method: http.MethodPost, path: "/shutdown", header: "Basic " + testToken, status: http.StatusUnauthorized},
+		{name: "shutdown-get", method: http.MethodGet, path: "/shutdown", header: "Bearer " + testToken, status: http.StatusMethodNotAllowed},
+		{name: "shutdown", method: http.MethodPost, path: "/shutdown", header: "Bearer " + testToken, status: http.StatusNoContent, shutdown: true},
+		{name: "shutdown-lowercase-scheme", method: http.MethodPost, path: "/shutdown", header: "bearer " + testToken, status: http.StatusNoContent, shutdown: true},
+		{name: "info-open", method: http.MethodGet, path: "/info", status: http.StatusOK},
+		{name: "info-auth-read-no-token", authRead: true, method: http.MethodGet, path: "/info", status: http.StatusUnauthorized},
+		{name: "info-auth-read-wrong-token", authRead: true, method: http.MethodGet, path: "/info", header: "Bearer wrong", status: http.StatusUnauthorized},
+		{name: "info-auth-read", authRead: true, method: http.MethodGet, path: "/info", header: "Bearer " + testToken, status: http.StatusOK},
+		{name: "info-auth-read-cluster-token", authRead: true, method: http.MethodGet, path: "/info", header: "Bearer " + testClusterToken, status: http.StatusOK},
+		{name: "shutdown-cluster-token", method: http.MethodPost, path: "/shutdown", header: "Bearer " + testClusterToken, status: http.StatusUnauthorized},
+		{name: "walltime-auth-read-no-token", authRead: true, method: http.MethodGet, path: "/walltime", status: http.StatusUnauthorized},
+		{name: "events-auth-read-no-token", authRead: true, method: http.MethodGet, path: "/events", status: http.StatusUnauthorized},
+		{name: "index-auth-read", authRead: true, method: http.MethodGet, path: "/", status: http.StatusOK},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			shutdown := false
+			s := NewServer(Options{
+				Scheduler:    pbsScheduler{},
+				Env:          MapEnv(map[string]string{"PBS_JOBID": "1"}),
+				Token:        testToken,
+				ClusterToken: testClusterToken,
+				AuthRead:     tc.authRead,
+			}, func() { shutdown = true })
+
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, tc.shutdown, shutdown)
+			if tc.status == http.StatusUnauthorized {
+				assert.Equal(t, `Bearer realm="nemo"`, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestGeneratedToken(t *testing.T) {
+	a := NewServer(Options{Scheduler: pbsScheduler{}, Env: MapEnv(nil)}, func() {})
+	b := NewServer(Options{Scheduler: pbsScheduler{}, Env: MapEnv(nil)}, func() {})
+	assert.Len(t, a.opts.Token, 64)
+	assert.NotEqual(t, a.opts.Token, b.opts.Token)
+
+	r := httptest.NewRequest(http.MethodPost, "/shutdown", nil)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nemo", "1.token")
+	assert.Nil(t, writeTokenFile(path, testToken))
+
+	fi, err := os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	}
+	token, err := readTokenFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, testToken, token)
+
+	// Existing file with wider permissions is replaced.
+	assert.Nil(t, os.Chmod(path, 0o644))
+	assert.Nil(t, writeTokenFile(path, "other"))
+	fi, err = os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	}
+}
+
+func TestRuntimeDir(t *testing.T) {
+	base := t.TempDir()
+	dir, err := runtimeDir(MapEnv(map[string]string{"XDG_RUNTIME_DIR": base}))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(base, "nemo"), dir)
+
+	assert.Nil(t, os.Chmod(dir, 0o755))
+	_, err = runtimeDir(MapEnv(map[string]string{"XDG_RUNTIME_DIR": base}))
+	assert.NotNil(t, err, "runtime dir accessible by others must be rejected")
+}
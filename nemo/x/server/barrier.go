@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBarrierNotFound is returned when no participant has
+	// arrived at a barrier yet.
+	ErrBarrierNotFound = errors.New("barrier not found")
+	// ErrAlreadyArrived is returned when participant arrives at
+	// a barrier it is already waiting at.
+	ErrAlreadyArrived = errors.New("participant is already waiting at barrier")
+	// ErrPartiesMismatch is returned when participant arrives with a
+	// number of parties other than that of participants waiting.
+	ErrPartiesMismatch = errors.New("number of parties does not match that of waiting participants")
+	// ErrBarrierTimeout is returned when barrier is not released in time.
+	ErrBarrierTimeout = errors.New("barrier timed out")
+	// ErrNotHeadBarrier is returned when barrier is used on a node
+	// other than the head node, and head node is unknown.
+	ErrNotHeadBarrier = errors.New("barriers are only served by node with index 0")
+)
+
+// EventBarrierReleased is published when all parties arrive at a barrier.
+const EventBarrierReleased EventType = "barrier.released"
+
+// BarrierStatus is state of a generation of a barrier.
+type BarrierStatus struct {
+	Name    string `json:"name" yaml:"name" hcl:"name"`
+	Parties int    `json:"parties" yaml:"parties" hcl:"parties"`
+	// Generation starts from 0 and increases every time barrier is released
+	Generation uint64 `json:"generation" yaml:"generation" hcl:"generation"`
+	Released   bool   `json:"released" yaml:"released" hcl:"released"`
+	// Participants which arrived, ordered by ID
+	Arrived []string `json:"arrived" yaml:"arrived" hcl:"arrived"`
+	// Number of participants yet to arrive
+	Missing int `json:"missing" yaml:"missing" hcl:"missing"`
+	// Nodes of the job from which no participant arrived. It is only
+	// reported if barrier has one party per node.
+	MissingNodes []string   `json:"missingNodes" yaml:"missingNodes" hcl:"missingNodes"`
+	ReleasedAt   *time.Time `json:"releasedAt" yaml:"releasedAt" hcl:"releasedAt"`
+}
+
+// barrierGeneration is a single use of a barrier. status is
+// only written before done is closed.
+type barrierGeneration struct {
+	number  uint64
+	parties int
+	arrived map[string]time.Time
+	done    chan struct{}
+	status  BarrierStatus
+}
+
+// Barriers are named barriers which are released once given number of
+// parties arrive. Once released, barrier can be used again, with
+// participants arriving at its next generation.
+type Barriers struct {
+	events *EventBus
+	now    func() time.Time
+
+	mu       sync.Mutex
+	barriers map[string]*barrierGeneration
+}
+
+// NewBarriers returns Barriers publishing releases to events.
+func NewBarriers(events *EventBus) *Barriers {
+	return &Barriers{events: events, now: time.Now, barriers: make(map[string]*barrierGeneration)}
+}
+
+// Arrive waits at barrier name of parties until all of them arrive,
+// or until ctx is done. Participants which give up waiting are no
+// longer counted as arrived. id identifies the participant.
+func (b *Barriers) Arrive(ctx context.Context, name, id string, parties int) (BarrierStatus, error) {
+	b.mu.Lock()
+	gen, ok := b.barriers[name]
+	if !ok {
+		gen = &barrierGeneration{arrived: make(map[string]time.Time), done: make(chan struct{})}
+		b.barriers[name] = gen
+	}
+	if len(gen.arrived) > 0 && gen.parties != parties {
+		status := gen.statusLocked(name)
+		b.mu.Unlock()
+		return status, ErrPartiesMismatch
+	}
+	if _, ok := gen.arrived[id]; ok {
+		status := gen.statusLocked(name)
+		b.mu.Unlock()
+		return status, ErrAlreadyArrived
+	}
+	gen.parties = parties
+	gen.arrived[id] = b.now()
+
+	if len(gen.arrived) == parties {
+		status := gen.statusLocked(name)
+		releasedAt := b.now()
+		status.Released, status.ReleasedAt = true, &releasedAt
+		gen.status = status
+		close(gen.done)
+		b.barriers[name] = &barrierGeneration{
+			number:  gen.number + 1,
+			arrived: make(map[string]time.Time),
+			done:    make(chan struct{}),
+		}
+		b.mu.Unlock()
+		log.Printf("[INFO] Barrier %s released with %d parties (generation %d)", name, parties, status.Generation)
+		b.events.Publish(EventBarrierReleased, status)
+		return status, nil
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-gen.done:
+		return gen.status, nil
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-gen.done:
+		// Released while giving up.
+		return gen.status, nil
+	default:
+	}
+	// Status is that of the barrier when participant gave up, so that
+	// it reports who else is missing, not the participant itself.
+	status := gen.statusLocked(name)
+	delete(gen.arrived, id)
+	return status, ctx.Err()
+}
+
+// Status returns state of current generation of barrier name.
+func (b *Barriers) Status(name string) (BarrierStatus, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	gen, ok := b.barriers[name]
+	if !ok {
+		return BarrierStatus{}, ErrBarrierNotFound
+	}
+	return gen.statusLocked(name), nil
+}
+
+// statusLocked returns status of generation. Caller must hold the lock.
+func (g *barrierGeneration) statusLocked(name string) BarrierStatus {
+	status := BarrierStatus{
+		Name:         name,
+		Parties:      g.parties,
+		Generation:   g.number,
+		Arrived:      make([]string, 0, len(g.arrived)),
+		Missing:      g.parties - len(g.arrived),
+		MissingNodes: []string{},
+	}
+	for id := range g.arrived {
+		status.Arrived = append(status.Arrived, id)
+	}
+	sort.Strings(status.Arrived)
+	return status
+}
+
+// missingNodes returns nodes from which no participant arrived, if
+// barrier has one party per node. Participants are matched to nodes
+// by ID, which is either the node name or prefixed by it, like n1/0.
+func missingNodes(status BarrierStatus, nodes []string) []string {
+	missing := []string{}
+	if status.Parties != len(nodes) {
+		return missing
+	}
+	for _, node := range nodes {
+		found := false
+		for _, id := range status.Arrived {
+			if id == node || strings.HasPrefix(id, node+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, node)
+		}
+	}
+	return missing
+}
+
+// handleBarrier serves barriers at /barrier/{name}.
+//
+//	POST waits until parties=N participants arrive, each identified
+//	     by id. timeout=1m gives up waiting after that long, reporting
+//	     participants which did not arrive with 408.
+//	GET  returns state of the current generation of the barrier.
+//
+// Other nodes forward requests to the head node.
+func (s *Server) handleBarrier(w http.ResponseWriter, r *http.Request) {
+	info := getJobInfo(s.opts.Scheduler, s.opts.Env)
+	if !isHead(info) {
+		if !s.forwardToHead(w, r, info) {
+			http.Error(w, ErrNotHeadBarrier.Error(), http.StatusNotFound)
+		}
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/barrier/")
+	if err := validKey(name); err != nil {
+		http.Error(w, "invalid barrier name: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		status, err := s.barriers.Status(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		status.MissingNodes = missingNodes(status, info.Job.Nodes)
+		writeResponse(w, r, http.StatusOK, status)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	parties, err := strconv.Atoi(query.Get("parties"))
+	if err != nil || parties <= 0 {
+		http.Error(w, "parties must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	id := query.Get("id")
+	if id == "" {
+		http.Error(w, "id of the participant is required", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	if value := query.Get("timeout"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			http.Error(w, "timeout must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	go func() {
+		select {
+		case <-s.draining:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	status, err := s.barriers.Arrive(ctx, name, id, parties)
+	status.MissingNodes = missingNodes(status, info.Job.Nodes)
+	select {
+	case <-s.draining:
+		if err != nil {
+			http.Error(w, errDraining.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	default:
+	}
+	switch {
+	case err == nil:
+		writeResponse(w, r, http.StatusOK, status)
+	case errors.Is(err, ErrAlreadyArrived), errors.Is(err, ErrPartiesMismatch):
+		writeResponse(w, r, http.StatusConflict, status)
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Printf("[WARN] Barrier %s timed out waiting for %d of %d parties for %s",
+			name, status.Missing, status.Parties, id)
+		writeResponse(w, r, http.StatusRequestTimeout, status)
+	}
+	// Otherwise client went away while waiting.
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBarriers(t *testing.T) {
+	events := NewEventBus(10)
+	b := NewBarriers(events)
+
+	_, err := b.Status("stage")
+	assert.Equal(t, ErrBarrierNotFound, err)
+
+	for gen := uint64(0); gen < 3; gen++ {
+		var wg sync.WaitGroup
+		statuses := make([]BarrierStatus, 4)
+		for i := range statuses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				statuses[i], _ = b.Arrive(context.Background(), "stage", string(rune('a'+i)), 4)
+			}(i)
+		}
+		wg.Wait()
+		for _, status := range statuses {
+			assert.True(t, status.Released)
+			assert.Equal(t, gen, status.Generation)
+			assert.Equal(t, []string{"a", "b", "c", "d"}, status.Arrived)
+			assert.Equal(t, 0, status.Missing)
+		}
+	}
+	assert.Equal(t, []EventType{EventBarrierReleased, EventBarrierReleased, EventBarrierReleased}, eventTypes(events))
+
+	// Participants which time out are no longer counted as arrived.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	status, err := b.Arrive(ctx, "stage", "a", 2)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, []string{"a"}, status.Arrived)
+	assert.Equal(t, 1, status.Missing)
+	status, _ = b.Status("stage")
+	assert.Equal(t, uint64(3), status.Generation)
+	assert.Empty(t, status.Arrived)
+
+	done := make(chan struct{})
+	go func() {
+		b.Arrive(context.Background(), "stage", "a", 2)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		status, _ := b.Status("stage")
+		return len(status.Arrived) == 1
+	}, time.Second, time.Millisecond)
+
+	_, err = b.Arrive(context.Background(), "stage", "a", 2)
+	assert.Equal(t, ErrAlreadyArrived, err)
+	_, err = b.Arrive(context.Background(), "stage", "b", 3)
+	assert.Equal(t, ErrPartiesMismatch, err)
+
+	status, err = b.Arrive(context.Background(), "stage", "b", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), status.Generation)
+	<-done
+}
+
+func TestMissingNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		parties int
+		arrived []string
+		expect  []string
+	}{
+		{name: "node-names", parties: 3, arrived: []string{"n2"}, expect: []string{"n1", "n3"}},
+		{name: "prefixed", parties: 3, arrived: []string{"n1/0", "n3/stage"}, expect: []string{"n2"}},
+		{name: "not-one-per-node", parties: 6, arrived: []string{"n1"}, expect: []string{}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			status := BarrierStatus{Parties: tc.parties, Arrived: tc.arrived}
+			assert.Equal(t, tc.expect, missingNodes(status, []string{"n1", "n2", "n3"}))
+		})
+	}
+}
+
+// postBarrier arrives at barrier on ts and returns status code and status.
+func postBarrier(t *testing.T, ts *httptest.Server, path string) (int, BarrierStatus) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return 0, BarrierStatus{}
+	}
+	defer resp.Body.Close()
+	var status BarrierStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	return resp.StatusCode, status
+}
+
+func TestHandleBarrier(t *testing.T) {
+	_, head := newOptionsServer(t, Options{
+		Scheduler:    pbsScheduler{},
+		Env:          MapEnv(map[string]string{"PBS_NODENUM": "0", "PBS_NODEFILE": "/var/spool/pbs/aux/1.server"}),
+		ClusterToken: testClusterToken,
+	})
+	_, node := newOptionsServer(t, Options{
+		Scheduler:    pbsScheduler{},
+		Env:          MapEnv(map[string]string{"PBS_NODENUM": "1", "PBS_NODEFILE": "/var/spool/pbs/aux/1.server"}),
+		ClusterToken: testClusterToken,
+		Head:         strings.TrimPrefix(head.URL, "http://"),
+	})
+
+	tests := []struct {
+		name string
+		path string
+		code int
+	}{
+		{name: "missing-parties", path: "/barrier/stage?id=n1", code: http.StatusBadRequest},
+		{name: "invalid-parties", path: "/barrier/stage?id=n1&parties=0", code: http.StatusBadRequest},
+		{name: "missing-id", path: "/barrier/stage?parties=2", code: http.StatusBadRequest},
+		{name: "invalid-timeout", path: "/barrier/stage?id=n1&parties=2&timeout=x", code: http.StatusBadRequest},
+		{name: "single-party", path: "/barrier/single?id=n1&parties=1", code: http.StatusOK},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			code, _ := postBarrier(t, head, tc.path)
+			assert.Equal(t, tc.code, code)
+		})
+	}
+
+	// Timed out barrier reports missing nodes.
+	code, status := postBarrier(t, head, "/barrier/stage?id=n1&parties=2&timeout=50ms")
+	assert.Equal(t, http.StatusRequestTimeout, code)
+	assert.Equal(t, []string{"n1"}, status.Arrived)
+	assert.Equal(t, 1, status.Missing)
+	assert.Equal(t, []string{"n2"}, status.MissingNodes)
+
+	// Participant on other node arrives through its own server.
+	results := make(chan BarrierStatus, 2)
+	go func() {
+		_, status := postBarrier(t, head, "/barrier/stage?id=n1&parties=2&timeout=10s")
+		results <- status
+	}()
+	assert.Eventually(t, func() bool {
+		var status BarrierStatus
+		return getInto(t, head, "/barrier/stage", &status) == http.StatusOK && len(status.Arrived) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	code, status = postBarrier(t, node, "/barrier/stage?id=n2&parties=2&timeout=10s")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Released)
+	select {
+	case status := <-results:
+		assert.True(t, status.Released)
+		assert.Equal(t, []string{"n1", "n2"}, status.Arrived)
+	case <-time.After(5 * time.Second):
+		t.Fatal("barrier was not released")
+	}
+
+	var next BarrierStatus
+	assert.Equal(t, http.StatusOK, getInto(t, node, "/barrier/stage", &next))
+	assert.Equal(t, uint64(1), next.Generation)
+	assert.Empty(t, next.Arrived)
+
+	req, _ := http.NewRequest(http.MethodDelete, head.URL+"/barrier/stage", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
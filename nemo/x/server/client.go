@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoInstance is returned when no running server could be found.
+var ErrNoInstance = errors.New("no running server found")
+
+// Client is a client of the metadata server.
+type Client struct {
+	// Base URL of the server, like http://127.0.0.1:8000
+	BaseURL string
+	// Bearer token, sent with every request if not empty
+	Token string
+	HTTP  *http.Client
+}
+
+// NewClient returns Client for server at address host:port.
+func NewClient(address, token string) *Client {
+	return &Client{BaseURL: "http://" + address, Token: token, HTTP: &http.Client{}}
+}
+
+// NewSocketClient returns Client for server listening on Unix socket.
+func NewSocketClient(socket, token string) *Client {
+	var d net.Dialer
+	return &Client{
+		BaseURL: "http://unix",
+		Token:   token,
+		HTTP: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+// Do sends request and returns response if it has a 2xx status.
+// Otherwise response body is returned as an error.
+func (c *Client) Do(ctx context.Context, method, path string, header http.Header) (*http.Response, error) {
+	return c.send(ctx, method, path, header, nil)
+}
+
+// send sends request with body and returns response if it has a 2xx status.
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	resp, err := c.roundTrip(ctx, method, path, header, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// roundTrip sends request with body and returns response, whatever its status.
+func (c *Client) roundTrip(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return c.HTTP.Do(req)
+}
+
+// PostJSON posts in encoded as JSON to path and decodes
+// JSON response into out, unless it is nil.
+func (c *Client) PostJSON(ctx context.Context, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Accept": {"application/json"}, "Content-Type": {"application/json"}}
+	resp, err := c.send(ctx, http.MethodPost, path, header, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// GetJSON gets path and decodes JSON response into v.
+func (c *Client) GetJSON(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.Do(ctx, http.MethodGet, path, http.Header{"Accept": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Barrier waits at barrier name until parties participants arrive,
+// or until timeout if it is positive. If barrier times out,
+// ErrBarrierTimeout is returned along with participants which arrived.
+func (c *Client) Barrier(ctx context.Context, name, id string, parties int, timeout time.Duration) (BarrierStatus, error) {
+	query := url.Values{"parties": {strconv.Itoa(parties)}, "id": {id}}
+	if timeout > 0 {
+		query.Set("timeout", timeout.String())
+	}
+	path := "/barrier/" + url.PathEscape(name) + "?" + query.Encode()
+	resp, err := c.roundTrip(ctx, http.MethodPost, path, http.Header{"Accept": {"application/json"}}, nil)
+	if err != nil {
+		return BarrierStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	var status BarrierStatus
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return status, json.NewDecoder(resp.Body).Decode(&status)
+	case http.StatusRequestTimeout:
+		json.NewDecoder(resp.Body).Decode(&status)
+		return status, ErrBarrierTimeout
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return status, fmt.Errorf("POST %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// clientFlags are flags common to all client commands.
+type clientFlags struct {
+	addr       string
+	socket     string
+	job        string
+	tokenFile  string
+	runtimeDir string
+	json       bool
+	timeout    time.Duration
+}
+
+func (f *clientFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.addr, "addr", "", "Address of the server, like 127.0.0.1:8000 (default: from discovery file)")
+	fs.StringVar(&f.socket, "socket", "", "Unix socket of the server (default: from discovery file)")
+	fs.StringVar(&f.job, "job", "", "Job ID of the server to connect to, like 1234 or 1234[5] for array elements (default: job of the environment)")
+	fs.StringVar(&f.tokenFile, "token-file", "", "File to read bearer token from (default: from discovery file)")
+	fs.StringVar(&f.runtimeDir, "runtime-dir", "", "Directory holding discovery files (default: $XDG_RUNTIME_DIR/nemo)")
+	fs.BoolVar(&f.json, "json", false, "Print JSON instead of human readable output")
+	fs.DurationVar(&f.timeout, "timeout", 10*time.Second, "Timeout of requests to the server")
+}
+
+// locate returns discovery information of the server. Explicit address
+// or socket takes precedence. Otherwise, discovery file of the job is
+// used, which is the one given by -job flag, or the job of env. Outside
+// of a job, the only running instance is used.
+func (f *clientFlags) locate(env Env) (Discovery, error) {
+	if f.addr != "" || f.socket != "" {
+		return Discovery{Address: f.addr, Socket: f.socket, TokenFile: f.tokenFile}, nil
+	}
+
+	dir := f.runtimeDir
+	if dir == "" {
+		var err error
+		if dir, err = runtimeDir(env); err != nil {
+			return Discovery{}, err
+		}
+	}
+	job := f.job
+	if job == "" {
+		sched, _ := getScheduler("auto", env)
+		job = sched.JobInfo(env).SchedulerID
+	}
+
+	var d Discovery
+	var err error
+	if job == "" {
+		d, err = runningInstance(dir)
+	} else {
+		d, err = jobInstance(dir, job)
+	}
+	if err != nil {
+		return Discovery{}, err
+	}
+	if f.tokenFile != "" {
+		d.TokenFile = f.tokenFile
+	}
+	return d, nil
+}
+
+// jobInstance returns discovery information of the server of job in dir.
+func jobInstance(dir, job string) (Discovery, error) {
+	d, err := readDiscovery(discoveryPath(dir, job))
+	if err != nil {
+		return Discovery{}, fmt.Errorf("%w for job %s in %s", ErrNoInstance, job, dir)
+	}
+	if !processAlive(d.PID) {
+		return Discovery{}, fmt.Errorf("%w for job %s, PID %d has exited", ErrNoInstance, job, d.PID)
+	}
+	return d, nil
+}
+
+// runningInstance returns discovery information of the only
+// running server in dir.
+func runningInstance(dir string) (Discovery, error) {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var running []Discovery
+	for _, path := range paths {
+		if d, err := readDiscovery(path); err == nil && processAlive(d.PID) {
+			running = append(running, d)
+		}
+	}
+	switch len(running) {
+	case 0:
+		return Discovery{}, fmt.Errorf("%w in %s", ErrNoInstance, dir)
+	case 1:
+		return running[0], nil
+	default:
+		return Discovery{}, fmt.Errorf("%d servers are running, select one with -job", len(running))
+	}
+}
+
+// client returns Client for the located server. Unix socket is
+// preferred over TCP, as it does not need a token.
+func (f *clientFlags) client(env Env) (*Client, error) {
+	d, err := f.locate(env)
+	if err != nil {
+		return nil, err
+	}
+	token := ""
+	if d.TokenFile != "" {
+		if token, err = readTokenFile(d.TokenFile); err != nil {
+			return nil, fmt.Errorf("failed to read token: %w", err)
+		}
+	}
+	if d.Socket != "" {
+		return NewSocketClient(d.Socket, token), nil
+	}
+	return NewClient(d.Address, token), nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPeerTimeout is time allowed for each peer to respond
+// when aggregating the cluster view.
+const defaultPeerTimeout = 5 * time.Second
+
+// ErrNotHead is returned when cluster view is requested
+// from a node other than the head node of the job.
+var ErrNotHead = errors.New("cluster view is only served by the first node of the job")
+
+// ClusterNode is info and resource usage reported by server on a node.
+type ClusterNode struct {
+	Name string `json:"name" yaml:"name" hcl:"name"`
+	// Address of the server on the node, empty for the head node
+	Address string `json:"address" yaml:"address" hcl:"address"`
+	// Whether server on the node responded
+	Reachable bool `json:"reachable" yaml:"reachable" hcl:"reachable"`
+	// Why server on the node did not respond or responded with an error
+	Error string `json:"error,omitempty" yaml:"error,omitempty" hcl:"error,omitempty"`
+	// Time taken to respond to /info in seconds
+	Latency   float64        `json:"latency" yaml:"latency" hcl:"latency"`
+	Info      *Info          `json:"info" yaml:"info" hcl:"info"`
+	Resources *NodeResources `json:"resources" yaml:"resources" hcl:"resources"`
+}
+
+// ClusterSummary is resource usage summed over reachable nodes.
+type ClusterSummary struct {
+	Nodes     int `json:"nodes" yaml:"nodes" hcl:"nodes"`
+	Reachable int `json:"reachable" yaml:"reachable" hcl:"reachable"`
+	// Nodes whose server did not respond
+	Unreachable []string `json:"unreachable" yaml:"unreachable" hcl:"unreachable"`
+	CPUCount    int      `json:"cpuCount" yaml:"cpuCount" hcl:"cpuCount"`
+	// CPU utilization of all CPUs, from 0 to 1
+	CPUUtilization float64 `json:"cpuUtilization" yaml:"cpuUtilization" hcl:"cpuUtilization"`
+	// Memory in bytes
+	MemoryTotal int64 `json:"memoryTotal" yaml:"memoryTotal" hcl:"memoryTotal"`
+	MemoryUsed  int64 `json:"memoryUsed" yaml:"memoryUsed" hcl:"memoryUsed"`
+}
+
+// Cluster is the view of all nodes of the job, as seen by the head node.
+type Cluster struct {
+	Head    string         `json:"head" yaml:"head" hcl:"head"`
+	Job     JobInfo        `json:"job" yaml:"job" hcl:"job"`
+	Summary ClusterSummary `json:"summary" yaml:"summary" hcl:"summary"`
+	Nodes   []ClusterNode  `json:"nodes" yaml:"nodes" hcl:"nodes"`
+}
+
+// summarize returns summary of nodes.
+func summarize(nodes []ClusterNode) ClusterSummary {
+	summary := ClusterSummary{Nodes: len(nodes), Unreachable: []string{}}
+	var busy float64
+	for _, node := range nodes {
+		if !node.Reachable {
+			summary.Unreachable = append(summary.Unreachable, node.Name)
+			continue
+		}
+		summary.Reachable++
+		if res := node.Resources; res != nil {
+			summary.CPUCount += res.CPU.Count
+			busy += res.CPU.Utilization * float64(res.CPU.Count)
+			summary.MemoryTotal += res.Memory.Total
+			summary.MemoryUsed += res.Memory.Used
+		}
+	}
+	if summary.CPUCount > 0 {
+		summary.CPUUtilization = busy / float64(summary.CPUCount)
+	}
+	return summary
+}
+
+// peerAddress returns address of server on node. Addresses given in
+// NodeAddrs take precedence, followed by address the node registered
+// with. Otherwise server is expected to listen on the same port as
+// this one. It returns empty string if port is unknown.
+func (s *Server) peerAddress(node string) string {
+	if addr, ok := s.opts.NodeAddrs[node]; ok {
+		return addr
+	}
+	if addr, ok := s.members.Address(node); ok {
+		return addr
+	}
+	if s.opts.Port <= 0 {
+		return ""
+	}
+	return net.JoinHostPort(node, strconv.Itoa(s.opts.Port))
+}
+
+// fetchPeer gets info and resources from server on node.
+// Query is passed on to /node/resources.
+func (s *Server) fetchPeer(ctx context.Context, node, query string) ClusterNode {
+	cn := ClusterNode{Name: node, Address: s.peerAddress(node)}
+	if cn.Address == "" {
+		cn.Error = "address of the server is unknown, as it did not register and port is picked by the kernel"
+		return cn
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opts.PeerTimeout)
+	defer cancel()
+	start := time.Now()
+	c := NewClient(cn.Address, s.peerToken())
+	var info Info
+	err := c.GetJSON(ctx, "/info", &info)
+	cn.Latency = time.Since(start).Seconds()
+	if err != nil {
+		cn.Error = err.Error()
+		return cn
+	}
+	cn.Reachable, cn.Info = true, &info
+
+	path := "/node/resources"
+	if query != "" {
+		path += "?" + query
+	}
+	var res NodeResources
+	if err := c.GetJSON(ctx, path, &res); err != nil {
+		cn.Error = err.Error()
+	} else {
+		cn.Resources = &res
+	}
+	return cn
+}
+
+// localIndex returns position of this node in nodes of the job,
+// found by its name. It is 0 if this node is not listed.
+func localIndex(local Info, nodes []string) int {
+	if i := indexOf(nodes, local.Node.Name); i != nil {
+		return *i
+	}
+	return 0
+}
+
+// handleCluster returns info and resources of all nodes of the job.
+// Servers on other nodes are queried concurrently, each of them
+// given PeerTimeout to respond. Nodes whose server does not respond
+// are listed as unreachable. Only the head node serves it.
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	query := url.Values{}
+	if window := r.URL.Query().Get("window"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 || d > maxResourceWindow {
+			http.Error(w, fmt.Sprintf("window must be a positive duration up to %s", maxResourceWindow), http.StatusBadRequest)
+			return
+		}
+		query.Set("window", window)
+	}
+
+	local := getJobInfo(s.opts.Scheduler, s.opts.Env)
+	if !isHead(local) {
+		http.Error(w, ErrNotHead.Error(), http.StatusNotFound)
+		return
+	}
+
+	names := local.Job.Nodes
+	if len(names) == 0 {
+		names = []string{local.Node.Name}
+	}
+	self := localIndex(local, names)
+	nodes := make([]ClusterNode, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		if i == self {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			nodes[i] = s.fetchPeer(r.Context(), name, query.Encode())
+		}(i, name)
+	}
+
+	// Info of this node is read directly.
+	nodes[self] = ClusterNode{Name: names[self], Reachable: true, Info: &local}
+	window, _ := time.ParseDuration(query.Get("window"))
+	if res, err := s.resources.Read(r.Context(), window); err != nil {
+		nodes[self].Error = err.Error()
+	} else {
+		nodes[self].Resources = &res
+	}
+	wg.Wait()
+
+	for _, node := range nodes {
+		if !node.Reachable {
+			log.Printf("[WARN] Node %s is unreachable: %s", node.Name, node.Error)
+		}
+	}
+	writeResponse(w, r, http.StatusOK, Cluster{
+		Head:    names[self],
+		Job:     local.Job,
+		Summary: summarize(nodes),
+		Nodes:   nodes,
+	})
+}
+
+// addrsFlag is a flag of comma separated host=address pairs,
+// which may be repeated.
+type addrsFlag map[string]string
+
+func (a addrsFlag) String() string {
+	items := make([]string, 0, len(a))
+	for host, addr := range a {
+		items = append(items, host+"="+addr)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (a addrsFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		host, addr, ok := cut(item, "=")
+		if !ok || host == "" || addr == "" {
+			return fmt.Errorf("%q must be of the form host=address", item)
+		}
+		a[host] = addr
+	}
+	return nil
+}
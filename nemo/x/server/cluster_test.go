@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clusterFS returns testdata/node along with nodefile
+// of PBS job 7.server running on nodes.
+func clusterFS(nodes ...string) fs.FS {
+	return overlayFS{
+		base: os.DirFS("testdata/node"),
+		files: fstest.MapFS{
+			"var/spool/pbs/aux/7.server": {Data: []byte(strings.Join(nodes, "\n") + "\n")},
+		},
+	}
+}
+
+// newClusterServer returns test server for node index of a PBS job,
+// reading resources and processes from testdata/node, where server is
+// PID 101. Job runs on n1 to n4, unless opts.Root is set by clusterFS.
+// Index is unknown if empty. opts may set addresses of nodes and
+// tokens, cluster token defaults to testClusterToken. If kill is not
+// nil, signals are sent with it.
+func newClusterServer(t *testing.T, index string, opts Options, kill func(pid int, sig syscall.Signal) error) *httptest.Server {
+	t.Helper()
+	vars := map[string]string{
+		"PBS_JOBID":    "7.server",
+		"PBS_NODEFILE": "/var/spool/pbs/aux/7.server",
+	}
+	if index != "" {
+		vars["PBS_NODENUM"] = index
+	}
+	opts.Scheduler = pbsScheduler{}
+	opts.Env = MapEnv(vars)
+	if opts.Root == nil {
+		opts.Root = clusterFS("n1", "n2", "n3", "n4")
+	}
+	opts.PeerTimeout = 500 * time.Millisecond
+	if opts.Token == "" {
+		opts.Token = testToken
+	}
+	if opts.ClusterToken == "" {
+		opts.ClusterToken = testClusterToken
+	}
+	s := NewServer(opts, func() {})
+	s.resources.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+	s.processes.self = 101
+	if kill != nil {
+		s.signals.kill = kill
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestHandleCluster(t *testing.T) {
+	// Instance tokens differ between nodes, so peers are queried
+	// with the cluster token, even if reads require authentication.
+	peer := newClusterServer(t, "1", Options{Token: "peer-token", AuthRead: true}, nil)
+
+	// Server on n3 accepts connections but never responds.
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(hang.Close)
+
+	// Nothing listens on n4.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	head := newClusterServer(t, "0", Options{NodeAddrs: map[string]string{
+		"n2": strings.TrimPrefix(peer.URL, "http://"),
+		"n3": strings.TrimPrefix(hang.URL, "http://"),
+		"n4": closed,
+	}}, nil)
+
+	start := time.Now()
+	var cluster Cluster
+	assert.Equal(t, http.StatusOK, getInto(t, head, "/cluster", &cluster))
+	assert.Less(t, time.Since(start), 5*time.Second, "peers must be queried with a timeout")
+
+	assert.Equal(t, "n1", cluster.Head)
+	assert.Equal(t, intPtr(7), cluster.Job.ID)
+	assert.Equal(t, []string{"n3", "n4"}, cluster.Summary.Unreachable)
+	assert.Equal(t, 4, cluster.Summary.Nodes)
+	assert.Equal(t, 2, cluster.Summary.Reachable)
+	assert.Equal(t, 8, cluster.Summary.CPUCount)
+	assert.Equal(t, int64(2*4096000*1024), cluster.Summary.MemoryUsed)
+	if !assert.Len(t, cluster.Nodes, 4) {
+		return
+	}
+
+	n1, n2, n3, n4 := cluster.Nodes[0], cluster.Nodes[1], cluster.Nodes[2], cluster.Nodes[3]
+	assert.True(t, n1.Reachable)
+	assert.Equal(t, intPtr(0), n1.Info.Node.Index)
+	assert.NotNil(t, n1.Resources)
+
+	assert.True(t, n2.Reachable)
+	assert.Empty(t, n2.Error)
+	assert.Equal(t, intPtr(1), n2.Info.Node.Index)
+	assert.Equal(t, 4, n2.Resources.CPU.Count)
+
+	assert.Equal(t, "n3", n3.Name)
+	assert.False(t, n3.Reachable)
+	assert.Nil(t, n3.Info)
+	assert.Contains(t, n3.Error, "deadline exceeded")
+
+	assert.False(t, n4.Reachable)
+	assert.Contains(t, n4.Error, "connection refused")
+
+	// Only the head node serves cluster view.
+	req, _ := http.NewRequest(http.MethodGet, peer.URL+"/cluster", nil)
+	req.Header.Set("Authorization", "Bearer peer-token")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestHandleClusterToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		token     string
+		reachable bool
+	}{
+		{name: "shared", token: testClusterToken, reachable: true},
+		{name: "mismatch", token: "other-cluster-token"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			peer := newClusterServer(t, "1", Options{Token: "peer-token", ClusterToken: tc.token, AuthRead: true}, nil)
+			head := newClusterServer(t, "0", Options{NodeAddrs: map[string]string{
+				"n2": strings.TrimPrefix(peer.URL, "http://"),
+			}}, nil)
+
+			var cluster Cluster
+			assert.Equal(t, http.StatusOK, getInto(t, head, "/cluster", &cluster))
+			if assert.Len(t, cluster.Nodes, 4) {
+				n2 := cluster.Nodes[1]
+				assert.Equal(t, tc.reachable, n2.Reachable)
+				if !tc.reachable {
+					assert.Contains(t, n2.Error, "401")
+				}
+			}
+		})
+	}
+}
+
+func TestHandleClusterHead(t *testing.T) {
+	hostname, _ := os.Hostname()
+	// Nothing listens on n1.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name      string
+		nodes     []string
+		index     string
+		code      int
+		reachable []string
+	}{
+		{name: "unknown-index-single-node", code: http.StatusOK, reachable: []string{hostname}},
+		{name: "unknown-index-many-nodes", nodes: []string{"n1", "n2"}, code: http.StatusNotFound},
+		// This node is found by name, and the first node is queried.
+		{name: "not-first", nodes: []string{"n1", hostname}, index: "0", code: http.StatusOK, reachable: []string{hostname}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newClusterServer(t, tc.index, Options{
+				Root:      clusterFS(tc.nodes...),
+				NodeAddrs: map[string]string{"n1": closed},
+			}, nil)
+
+			code, body := kvRequest(t, ts, http.MethodGet, "/cluster", "")
+			if !assert.Equal(t, tc.code, code) || code != http.StatusOK {
+				assert.Contains(t, body, ErrNotHead.Error())
+				return
+			}
+			var cluster Cluster
+			assert.Nil(t, json.Unmarshal([]byte(body), &cluster))
+			assert.Equal(t, hostname, cluster.Head)
+			var reachable []string
+			for _, node := range cluster.Nodes {
+				if node.Reachable {
+					reachable = append(reachable, node.Name)
+					assert.NotNil(t, node.Info)
+				}
+			}
+			assert.Equal(t, tc.reachable, reachable)
+			assert.Len(t, cluster.Summary.Unreachable, len(cluster.Nodes)-len(tc.reachable))
+		})
+	}
+}
+
+func TestPeerAddress(t *testing.T) {
+	s := NewServer(Options{
+		Scheduler: pbsScheduler{},
+		Env:       MapEnv(nil),
+		Root:      nodeFS,
+		Port:      8000,
+		NodeAddrs: map[string]string{"n2": "127.0.0.1:9000"},
+	}, func() {})
+	assert.Equal(t, "n1:8000", s.peerAddress("n1"))
+	assert.Equal(t, "127.0.0.1:9000", s.peerAddress("n2"))
+
+	s.opts.Port = 0
+	assert.Equal(t, "", s.peerAddress("n1"))
+}
+
+func TestAddrsFlag(t *testing.T) {
+	a := addrsFlag{}
+	assert.Nil(t, a.Set("n1=127.0.0.1:8001, n2=127.0.0.1:8002"))
+	assert.Nil(t, a.Set("n3=127.0.0.1:8003"))
+	assert.Equal(t, "n1=127.0.0.1:8001,n2=127.0.0.1:8002,n3=127.0.0.1:8003", a.String())
+	assert.NotNil(t, a.Set("n4"))
+	assert.NotNil(t, a.Set("=127.0.0.1:8004"))
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a subcommand of the server binary.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string, stdout, stderr io.Writer, env Env) int
+}
+
+// commands are subcommands of the server binary. Without a
+// subcommand, serve is run.
+var commands = []command{
+	{name: "serve", usage: "Run the metadata server (default)", run: cmdServe},
+	{name: "info", usage: "Print node and job info", run: cmdInfo},
+	{name: "wait-ready", usage: "Wait until readiness checks of the server pass", run: cmdWaitReady},
+	{name: "shutdown", usage: "Request the server to shutdown", run: cmdShutdown},
+	{name: "walltime", usage: "Print walltime status of the job", run: cmdWalltime},
+	{name: "events", usage: "Stream events of the server", run: cmdEvents},
+	{name: "barrier", usage: "Wait until all participants arrive at a named barrier", run: cmdBarrier},
+}
+
+// runCommand runs subcommand given by args, which excludes
+// program name, and returns exit code of the process.
+func runCommand(args []string, stdout, stderr io.Writer, env Env) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return cmdServe(args, stdout, stderr, env)
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:], stdout, stderr, env)
+		}
+	}
+	if args[0] != "help" {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+	}
+	fmt.Fprintf(stderr, "Usage: %s [command] [flags]\n\nCommands:\n", programName())
+	tw := tabwriter.NewWriter(stderr, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.usage)
+	}
+	tw.Flush()
+	fmt.Fprintf(stderr, "\nRun '%s <command> -h' for flags of a command.\n", programName())
+	if args[0] == "help" {
+		return exitClean
+	}
+	return 2
+}
+
+// programName returns name of the binary.
+func programName() string {
+	name := os.Args[0]
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// newFlagSet returns FlagSet for command name, which writes
+// its usage to stderr.
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(programName()+" "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// parseClientFlags parses args of client command name. It returns false
+// along with exit code if command should exit.
+func parseClientFlags(fs *flag.FlagSet, f *clientFlags, args []string) (int, bool) {
+	f.register(fs)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitClean, false
+		}
+		return 2, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return 2, false
+	}
+	return 0, true
+}
+
+// fail prints err to stderr and returns exit code of a failed command.
+func fail(stderr io.Writer, err error) int {
+	fmt.Fprintf(stderr, "error: %s\n", err)
+	return 1
+}
+
+// printJSON prints v as indented JSON.
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// orUnknown returns "unknown" if v is nil, otherwise v.
+func orUnknown(v *int) string {
+	if v == nil {
+		return "unknown"
+	}
+	return strconv.Itoa(*v)
+}
+
+// formatSeconds formats seconds as a duration, or unknown if nil.
+func formatSeconds(s *int) string {
+	if s == nil {
+		return "unknown"
+	}
+	return (time.Duration(*s) * time.Second).String()
+}
+
+func cmdInfo(args []string, stdout, stderr io.Writer, env Env) int {
+	var f clientFlags
+	fs := newFlagSet("info", stderr)
+	if code, ok := parseClientFlags(fs, &f, args); !ok {
+		return code
+	}
+	c, err := f.client(env)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	var info Info
+	if err := c.GetJSON(ctx, "/info", &info); err != nil {
+		return fail(stderr, err)
+	}
+	if f.json {
+		printJSON(stdout, info)
+		return exitClean
+	}
+
+	job := info.Job
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Node:\t%s (index %s, pid %d)\n", info.Node.Name, orUnknown(info.Node.Index), info.Node.PID)
+	fmt.Fprintf(tw, "Job:\t%s %s\n", orUnknown(job.ID), job.Name)
+	fmt.Fprintf(tw, "User:\t%s\n", job.Authorization)
+	fmt.Fprintf(tw, "Account:\t%s\n", job.Entitlement)
+	fmt.Fprintf(tw, "Queue:\t%s\n", job.Queue)
+	fmt.Fprintf(tw, "Nodes:\t%s (%s nodes, %s slots)\n", job.NodeList, orUnknown(job.NodeCount), orUnknown(job.SlotCount))
+	fmt.Fprintf(tw, "Tasks:\t%s (%s per node)\n", orUnknown(job.TaskCount), orUnknown(job.PPN))
+	fmt.Fprintf(tw, "Walltime:\t%s\n", formatSeconds(job.Walltime))
+	if a := job.Array; a != nil {
+		fmt.Fprintf(tw, "Array:\t%s[%s] (%s elements)\n", orUnknown(a.ParentID), orUnknown(a.Index), orUnknown(a.Size))
+	}
+	for _, warning := range info.Warnings {
+		fmt.Fprintf(tw, "Warning:\t%s\n", warning)
+	}
+	tw.Flush()
+	return exitClean
+}
+
+func cmdWaitReady(args []string, stdout, stderr io.Writer, env Env) int {
+	var f clientFlags
+	fs := newFlagSet("wait-ready", stderr)
+	wait := fs.Duration("wait", 30*time.Second, "Time to wait for the server to become ready")
+	interval := fs.Duration("interval", 200*time.Millisecond, "Interval between attempts")
+	if code, ok := parseClientFlags(fs, &f, args); !ok {
+		return code
+	}
+
+	deadline := time.Now().Add(*wait)
+	var lastErr error
+	for {
+		// Discovery file may not be written yet, so locate on every attempt.
+		if c, err := f.client(env); err != nil {
+			lastErr = err
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+			resp, err := c.Do(ctx, http.MethodGet, "/readyz", nil)
+			cancel()
+			if err == nil {
+				resp.Body.Close()
+				if f.json {
+					printJSON(stdout, map[string]bool{"ready": true})
+				} else {
+					fmt.Fprintln(stdout, "ready")
+				}
+				return exitClean
+			}
+			lastErr = err
+		}
+		if time.Now().Add(*interval).After(deadline) {
+			break
+		}
+		time.Sleep(*interval)
+	}
+	if f.json {
+		printJSON(stdout, map[string]interface{}{"ready": false, "error": lastErr.Error()})
+	}
+	return fail(stderr, fmt.Errorf("server is not ready after %s: %w", *wait, lastErr))
+}
+
+func cmdShutdown(args []string, stdout, stderr io.Writer, env Env) int {
+	var f clientFlags
+	fs := newFlagSet("shutdown", stderr)
+	if code, ok := parseClientFlags(fs, &f, args); !ok {
+		return code
+	}
+	c, err := f.client(env)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	resp, err := c.Do(ctx, http.MethodPost, "/shutdown", nil)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	resp.Body.Close()
+	if f.json {
+		printJSON(stdout, map[string]bool{"shutdown": true})
+	} else {
+		fmt.Fprintln(stdout, "shutdown requested")
+	}
+	return exitClean
+}
+
+func cmdWalltime(args []string, stdout, stderr io.Writer, env Env) int {
+	var f clientFlags
+	fs := newFlagSet("walltime", stderr)
+	wait := fs.Duration("wait", 0, "Wait until the next walltime warning or for this long, whichever is first")
+	if code, ok := parseClientFlags(fs, &f, args); !ok {
+		return code
+	}
+	c, err := f.client(env)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	path := "/walltime"
+	if *wait > 0 {
+		path += "?wait=" + url.QueryEscape(wait.String())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout+*wait)
+	defer cancel()
+
+	var status WalltimeStatus
+	if err := c.GetJSON(ctx, path, &status); err != nil {
+		return fail(stderr, err)
+	}
+	if f.json {
+		printJSON(stdout, status)
+		return exitClean
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Start:\t%s\n", status.Start.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Limit:\t%s\n", formatSeconds(status.Limit))
+	fmt.Fprintf(tw, "Elapsed:\t%s\n", formatSeconds(&status.Elapsed))
+	fmt.Fprintf(tw, "Remaining:\t%s\n", formatSeconds(status.Remaining))
+	if status.Deadline != nil {
+		fmt.Fprintf(tw, "Deadline:\t%s\n", status.Deadline.Format(time.RFC3339))
+	}
+	if status.Expired {
+		fmt.Fprintf(tw, "Expired:\tyes\n")
+	}
+	for _, t := range status.Thresholds {
+		state := "pending"
+		if t.Crossed {
+			state = "crossed"
+		}
+		fmt.Fprintf(tw, "Warning:\t%s before deadline, at %s (%s)\n",
+			formatSeconds(&t.BeforeSeconds), t.At.Format(time.RFC3339), state)
+	}
+	tw.Flush()
+	return exitClean
+}
+
+func cmdEvents(args []string, stdout, stderr io.Writer, env Env) int {
+	var f clientFlags
+	fs := newFlagSet("events", stderr)
+	after := fs.Uint64("after", 0, "Print events after this event ID")
+	if code, ok := parseClientFlags(fs, &f, args); !ok {
+		return code
+	}
+	c, err := f.client(env)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	header := http.Header{}
+	if *after > 0 {
+		header.Set("Last-Event-ID", strconv.FormatUint(*after, 10))
+	}
+	// Stream has no timeout, it ends when server shuts down.
+	resp, err := c.Do(context.Background(), http.MethodGet, "/events", header)
+	if err != nil {
+		return fail(stderr, err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data := strings.TrimPrefix(scanner.Text(), "data: ")
+		if data == scanner.Text() {
+			continue
+		}
+		if f.json {
+			fmt.Fprintln(stdout, data)
+			continue
+		}
+		var event struct {
+			ID   uint64          `json:"id"`
+			Type EventType       `json:"type"`
+			Time time.Time       `json:"time"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fail(stderr, fmt.Errorf("invalid event: %w", err))
+		}
+		fmt.Fprintf(stdout, "%s  #%-4d %-20s %s\n", event.Time.Format(time.RFC3339), event.ID, event.Type, event.Data)
+	}
+	if err := scanner.Err(); err != nil {
+		return fail(stderr, err)
+	}
+	return exitClean
+}
+
+func cmdBarrier(args []string, stdout, stderr io.Writer, env Env) int {
+	var f clientFlags
+	fs := newFlagSet("barrier", stderr)
+	parties := fs.Int("parties", 0, "Number of participants which must arrive for the barrier to be released (required)")
+	id := fs.String("id", getHostname(env), "ID of this participant, which must be unique among participants")
+	wait := fs.Duration("wait", 0, "Time to wait for other participants (default: no limit)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s barrier [flags] <name>\n\n", programName())
+		fs.PrintDefaults()
+	}
+	f.register(fs)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitClean
+		}
+		return 2
+	}
+	if fs.NArg() != 1 || *parties <= 0 {
+		fs.Usage()
+		return 2
+	}
+	c, err := f.client(env)
+	if err != nil {
+		return fail(stderr, err)
+	}
+
+	ctx := context.Background()
+	if *wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *wait+f.timeout)
+		defer cancel()
+	}
+	status, err := c.Barrier(ctx, fs.Arg(0), *id, *parties, *wait)
+	if f.json && (err == nil || errors.Is(err, ErrBarrierTimeout)) {
+		printJSON(stdout, status)
+	}
+	if errors.Is(err, ErrBarrierTimeout) {
+		missing := fmt.Sprintf("%d of %d participants", status.Missing, status.Parties)
+		if len(status.MissingNodes) > 0 {
+			missing += " on " + strings.Join(status.MissingNodes, ",")
+		}
+		return fail(stderr, fmt.Errorf("%w after %s, missing %s", err, *wait, missing))
+	}
+	if err != nil {
+		return fail(stderr, err)
+	}
+	if !f.json {
+		fmt.Fprintf(stdout, "barrier %s released with %d participants (generation %d)\n",
+			status.Name, status.Parties, status.Generation)
+	}
+	return exitClean
+}
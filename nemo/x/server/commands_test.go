@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// commandFixture is a running server along with its discovery file.
+type commandFixture struct {
+	server   *Server
+	dir      string
+	env      Env
+	shutdown chan struct{}
+}
+
+func newCommandFixture(t *testing.T) *commandFixture {
+	t.Helper()
+	f := &commandFixture{dir: t.TempDir(), shutdown: make(chan struct{}, 1)}
+	vars := map[string]string{
+		"PBS_JOBID":    "42.server",
+		"PBS_JOBNAME":  "sim",
+		"PBS_WALLTIME": "3600",
+	}
+	f.env = MapEnv(vars)
+	f.server = NewServer(Options{
+		Scheduler:        pbsScheduler{},
+		Env:              f.env,
+		Token:            testToken,
+		EventHistory:     10,
+		WalltimeWarnings: []time.Duration{15 * time.Minute},
+	}, func() { f.shutdown <- struct{}{} })
+	ts := httptest.NewServer(f.server)
+	t.Cleanup(ts.Close)
+
+	tokenFile := filepath.Join(f.dir, "1.token")
+	assert.Nil(t, writeTokenFile(tokenFile, testToken))
+	assert.Nil(t, writeDiscovery(discoveryPath(f.dir, "42"), Discovery{
+		Address:   strings.TrimPrefix(ts.URL, "http://"),
+		PID:       os.Getpid(),
+		JobID:     "42",
+		TokenFile: tokenFile,
+	}))
+	return f
+}
+
+// run runs command with args and returns exit code, stdout and stderr.
+func (f *commandFixture) run(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append([]string{args[0], "-runtime-dir", f.dir}, args[1:]...)
+	}
+	code := runCommand(args, &stdout, &stderr, f.env)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCmdInfo(t *testing.T) {
+	f := newCommandFixture(t)
+
+	code, stdout, stderr := f.run("info")
+	assert.Equal(t, exitClean, code, stderr)
+	assert.Contains(t, stdout, "Job:       42 sim\n")
+	assert.Contains(t, stdout, "Walltime:  1h0m0s\n")
+	assert.Contains(t, stdout, "Queue:     \n")
+
+	code, stdout, _ = f.run("info", "-json")
+	assert.Equal(t, exitClean, code)
+	var info Info
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &info))
+	assert.Equal(t, intPtr(42), info.Job.ID)
+}
+
+func TestCmdShutdown(t *testing.T) {
+	f := newCommandFixture(t)
+
+	code, _, stderr := f.run("shutdown", "-token-file", filepath.Join(f.dir, "missing.token"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "failed to read token")
+
+	assert.Nil(t, writeTokenFile(filepath.Join(f.dir, "wrong.token"), "wrong"))
+	code, _, stderr = f.run("shutdown", "-token-file", filepath.Join(f.dir, "wrong.token"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "401 Unauthorized")
+	assert.Len(t, f.shutdown, 0)
+
+	code, stdout, stderr := f.run("shutdown")
+	assert.Equal(t, exitClean, code, stderr)
+	assert.Equal(t, "shutdown requested\n", stdout)
+	assert.Len(t, f.shutdown, 1)
+}
+
+func TestCmdWalltime(t *testing.T) {
+	f := newCommandFixture(t)
+
+	code, stdout, stderr := f.run("walltime")
+	assert.Equal(t, exitClean, code, stderr)
+	assert.Contains(t, stdout, "Limit:      1h0m0s\n")
+	assert.Contains(t, stdout, "Remaining:  ")
+	assert.Contains(t, stdout, "Warning:    15m0s before deadline")
+
+	code, stdout, _ = f.run("walltime", "-json")
+	assert.Equal(t, exitClean, code)
+	var status WalltimeStatus
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &status))
+	assert.Equal(t, intPtr(3600), status.Limit)
+}
+
+func TestCmdEvents(t *testing.T) {
+	f := newCommandFixture(t)
+	f.server.events.Publish(EventServerStarted, map[string]int{"port": 1})
+	f.server.events.Publish(EventSignalReceived, map[string]string{"signal": "terminated"})
+	f.server.Drain("test")
+
+	code, stdout, stderr := f.run("events")
+	assert.Equal(t, exitClean, code, stderr)
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Contains(t, lines[0], `#1    server.started       {"port":1}`)
+		assert.Contains(t, lines[2], `#3    shutdown.requested   {"reason":"test"}`)
+	}
+
+	code, stdout, _ = f.run("events", "-json", "-after", "2")
+	assert.Equal(t, exitClean, code)
+	var event Event
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &event))
+	assert.Equal(t, uint64(3), event.ID)
+	assert.Equal(t, EventShutdownRequested, event.Type)
+}
+
+func TestCmdWaitReady(t *testing.T) {
+	f := newCommandFixture(t)
+
+	code, stdout, stderr := f.run("wait-ready")
+	assert.Equal(t, exitClean, code, stderr)
+	assert.Equal(t, "ready\n", stdout)
+
+	start := time.Now()
+	code, stdout, stderr = f.run("wait-ready", "-job", "43", "-wait", "300ms", "-interval", "50ms", "-json")
+	assert.Equal(t, 1, code)
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.Contains(t, stdout, `"ready": false`)
+	assert.Contains(t, stderr, "no running server found for job 43")
+}
+
+func TestCmdBarrier(t *testing.T) {
+	f := newCommandFixture(t)
+
+	code, stdout, stderr := f.run("barrier", "-parties", "1", "stage")
+	assert.Equal(t, exitClean, code, stderr)
+	assert.Equal(t, "barrier stage released with 1 participants (generation 0)\n", stdout)
+
+	code, stdout, stderr = f.run("barrier", "-parties", "2", "-id", "n1", "-wait", "50ms", "-json", "stage")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "barrier timed out after 50ms, missing 1 of 2 participants")
+	var status BarrierStatus
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &status))
+	assert.Equal(t, []string{"n1"}, status.Arrived)
+
+	code, _, stderr = f.run("barrier", "stage")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "Usage:")
+}
+
+func TestClientLocate(t *testing.T) {
+	dir := t.TempDir()
+	nojob := MapEnv(nil)
+
+	f := clientFlags{runtimeDir: dir}
+	_, err := f.locate(nojob)
+	assert.ErrorIs(t, err, ErrNoInstance)
+
+	// Outside of a job, the only running instance is used.
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "41"), Discovery{Address: "127.0.0.1:1", PID: deadPID(t)}))
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "42"), Discovery{Address: "127.0.0.1:2", PID: os.Getpid()}))
+	d, err := f.locate(nojob)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:2", d.Address)
+
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "43"), Discovery{Address: "127.0.0.1:3", PID: os.Getpid()}))
+	_, err = f.locate(nojob)
+	assert.NotNil(t, err, "instance must be selected when many are running")
+
+	// Job of the environment.
+	d, err = f.locate(MapEnv(map[string]string{"PBS_JOBID": "43.server"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:3", d.Address)
+
+	// Element of a job array.
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "44[2]"), Discovery{Address: "127.0.0.1:5", PID: os.Getpid()}))
+	d, err = f.locate(MapEnv(map[string]string{"PBS_JOBID": "44[2].server"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:5", d.Address)
+	_, err = f.locate(MapEnv(map[string]string{"PBS_JOBID": "44[1].server"}))
+	assert.ErrorIs(t, err, ErrNoInstance)
+
+	// Job of a crashed instance.
+	_, err = (&clientFlags{runtimeDir: dir, job: "41"}).locate(nojob)
+	assert.ErrorIs(t, err, ErrNoInstance)
+
+	// Explicit address.
+	d, err = (&clientFlags{addr: "127.0.0.1:4", tokenFile: "t"}).locate(nojob)
+	assert.Nil(t, err)
+	assert.Equal(t, Discovery{Address: "127.0.0.1:4", TokenFile: "t"}, d)
+}
+
+func TestRunCommandUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{name: "unknown", args: []string{"frobnicate"}, code: 2},
+		{name: "help", args: []string{"help"}, code: exitClean},
+		{name: "serve-help", args: []string{"-h"}, code: exitClean},
+		{name: "serve-bad-flag", args: []string{"serve", "-no-such-flag"}, code: 2},
+		{name: "info-extra-args", args: []string{"info", "extra"}, code: 2},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			assert.Equal(t, tc.code, runCommand(tc.args, &stdout, &stderr, MapEnv(nil)))
+			assert.NotEmpty(t, stderr.String())
+		})
+	}
+}
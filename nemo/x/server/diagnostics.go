@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// EnvVar reports how a variable consulted by the scheduler was used.
+type EnvVar struct {
+	Name    string `json:"name" yaml:"name" hcl:"name"`
+	Present bool   `json:"present" yaml:"present" hcl:"present"`
+	// Raw value, null if the variable is not present
+	Value *string `json:"value" yaml:"value" hcl:"value"`
+	// Whether the value was present and could be used
+	Parsed bool `json:"parsed" yaml:"parsed" hcl:"parsed"`
+	// Why the value could not be used
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty" hcl:"reason,omitempty"`
+}
+
+// Diagnostics lists variables consulted by the scheduler
+// while collecting job info, in the order they were consulted.
+type Diagnostics struct {
+	Scheduler string   `json:"scheduler" yaml:"scheduler" hcl:"scheduler"`
+	Variables []EnvVar `json:"variables" yaml:"variables" hcl:"variables"`
+	// Inconsistencies found in scheduler provided info
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty" hcl:"warnings"`
+}
+
+// envTrace records variables looked up via Env.
+type envTrace struct {
+	mu    sync.Mutex
+	vars  []EnvVar
+	index map[string]int
+}
+
+// Recording returns copy of e which records variables it consults.
+// They are returned by Consulted.
+func (e Env) Recording() Env {
+	e.trace = &envTrace{index: make(map[string]int)}
+	return e
+}
+
+// Consulted returns variables consulted since Recording was called.
+func (e Env) Consulted() []EnvVar {
+	if e.trace == nil {
+		return nil
+	}
+	e.trace.mu.Lock()
+	defer e.trace.mu.Unlock()
+	return append([]EnvVar{}, e.trace.vars...)
+}
+
+// get returns entry of variable key, adding it if necessary.
+// Caller must hold the lock.
+func (t *envTrace) get(key string) *EnvVar {
+	i, ok := t.index[key]
+	if !ok {
+		i = len(t.vars)
+		t.index[key] = i
+		t.vars = append(t.vars, EnvVar{Name: key})
+	}
+	return &t.vars[i]
+}
+
+func (t *envTrace) lookup(key, value string, present bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, seen := t.index[key]; seen {
+		return
+	}
+	v := t.get(key)
+	v.Present, v.Parsed = present, present
+	if present {
+		v.Value = &value
+	} else {
+		v.Reason = "not set"
+	}
+}
+
+func (t *envTrace) invalid(key string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v := t.get(key)
+	// Keep the first reason, later ones are usually consequences of it.
+	if v.Parsed || v.Reason == "" {
+		v.Parsed = false
+		v.Reason = err.Error()
+	}
+}
+
+// handleDiagnostics reports variables consulted to collect job info,
+// along with whether they could be used and why not.
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	env := s.opts.Env.Recording()
+	info := getJobInfo(s.opts.Scheduler, env)
+	if st, ok := s.opts.Scheduler.(StartTimer); ok {
+		st.StartTime(env)
+	}
+	writeResponse(w, r, http.StatusOK, Diagnostics{
+		Scheduler: s.opts.Scheduler.Name(),
+		Variables: env.Consulted(),
+		Warnings:  info.Warnings,
+	})
+}
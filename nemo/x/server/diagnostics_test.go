@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestEnvRecording(t *testing.T) {
+	env := MapEnv(map[string]string{"A": "1", "B": "two", "C": "3"})
+	assert.Nil(t, env.Consulted(), "lookups must not be recorded by default")
+
+	env = env.Recording()
+	env.Int("MISSING", "A")
+	env.Int("B", "C")
+	env.String("A")
+	env.Invalid("A", errors.New("out of range"))
+	env.Invalid("A", errors.New("second reason"))
+	assert.Equal(t, []EnvVar{
+		{Name: "MISSING", Reason: "not set"},
+		{Name: "A", Present: true, Value: strPtr("1"), Reason: "out of range"},
+		{Name: "B", Present: true, Value: strPtr("two"), Reason: `"two" is not an integer`},
+	}, env.Consulted())
+}
+
+func TestHandleDiagnostics(t *testing.T) {
+	tests := []struct {
+		name     string
+		sched    Scheduler
+		env      map[string]string
+		vars     map[string]EnvVar
+		warnings []string
+	}{
+		{
+			name:  "pbs",
+			sched: pbsScheduler{},
+			env: map[string]string{
+				"PBS_JOBID":     "x.server",
+				"PBS_NUM_NODES": "two",
+				"PBS_WALLTIME":  "1h",
+				"PBS_NODEFILE":  "/var/spool/pbs/aux/3.server",
+			},
+			vars: map[string]EnvVar{
+				"PBS_JOBID": {
+					Name: "PBS_JOBID", Present: true, Value: strPtr("x.server"),
+					Reason: `"x.server" does not start with a numeric job ID`,
+				},
+				"PBS_NUM_NODES": {
+					Name: "PBS_NUM_NODES", Present: true, Value: strPtr("two"),
+					Reason: `"two" is not an integer`,
+				},
+				"PBS_WALLTIME": {
+					Name: "PBS_WALLTIME", Present: true, Value: strPtr("1h"),
+					Reason: ErrInvalidWalltime.Error(),
+				},
+				"PBS_NODEFILE": {
+					Name: "PBS_NODEFILE", Present: true, Value: strPtr("/var/spool/pbs/aux/3.server"),
+					Reason: "open /var/spool/pbs/aux/3.server: file does not exist",
+				},
+				"PBS_NUM_PPN": {Name: "PBS_NUM_PPN", Reason: "not set"},
+				"PBS_NODENUM": {Name: "PBS_NODENUM", Reason: "not set"},
+			},
+			warnings: []string{"PBS_NODEFILE is missing, unreadable or empty"},
+		},
+		{
+			name:  "pbs-ok",
+			sched: pbsScheduler{},
+			env: map[string]string{
+				"PBS_JOBID":    "1.server",
+				"PBS_WALLTIME": "01:00:00",
+				"PBS_NODEFILE": "/var/spool/pbs/aux/1.server",
+			},
+			vars: map[string]EnvVar{
+				"PBS_JOBID":    {Name: "PBS_JOBID", Present: true, Value: strPtr("1.server"), Parsed: true},
+				"PBS_WALLTIME": {Name: "PBS_WALLTIME", Present: true, Value: strPtr("01:00:00"), Parsed: true},
+				"PBS_NODEFILE": {
+					Name: "PBS_NODEFILE", Present: true, Value: strPtr("/var/spool/pbs/aux/1.server"), Parsed: true,
+				},
+			},
+		},
+		{
+			name:  "pbs-empty-nodefile",
+			sched: pbsScheduler{},
+			env:   map[string]string{"PBS_NODEFILE": "/var/spool/pbs/aux/2.server"},
+			vars: map[string]EnvVar{
+				"PBS_NODEFILE": {
+					Name: "PBS_NODEFILE", Present: true, Value: strPtr("/var/spool/pbs/aux/2.server"),
+					Reason: "/var/spool/pbs/aux/2.server lists no hosts",
+				},
+			},
+			warnings: []string{"PBS_NODEFILE is missing, unreadable or empty"},
+		},
+		{
+			name:  "slurm",
+			sched: slurmScheduler{},
+			env: map[string]string{
+				"SLURM_JOB_ID":            "9",
+				"SLURM_NODELIST":          "n[1-2]",
+				"SLURM_JOB_CPUS_PER_NODE": "4",
+				"SLURM_JOB_START_TIME":    "200",
+				"SLURM_JOB_END_TIME":      "100",
+			},
+			vars: map[string]EnvVar{
+				"SLURM_JOB_NODELIST": {Name: "SLURM_JOB_NODELIST", Reason: "not set"},
+				"SLURM_NODELIST":     {Name: "SLURM_NODELIST", Present: true, Value: strPtr("n[1-2]"), Parsed: true},
+				"SLURM_JOB_CPUS_PER_NODE": {
+					Name: "SLURM_JOB_CPUS_PER_NODE", Present: true, Value: strPtr("4"),
+					Reason: "lists CPUs of 1 nodes, but node list has 2 nodes",
+				},
+				"SLURM_JOB_START_TIME": {
+					Name: "SLURM_JOB_START_TIME", Present: true, Value: strPtr("200"), Parsed: true,
+				},
+				"SLURM_JOB_END_TIME": {
+					Name: "SLURM_JOB_END_TIME", Present: true, Value: strPtr("100"),
+					Reason: "100 is before SLURM_JOB_START_TIME",
+				},
+			},
+		},
+		{
+			name:  "slurm-malformed-nodelist",
+			sched: slurmScheduler{},
+			env:   map[string]string{"SLURM_JOB_ID": "9", "SLURM_JOB_NODELIST": "n[1-"},
+			vars: map[string]EnvVar{
+				"SLURM_JOB_NODELIST": {Name: "SLURM_JOB_NODELIST", Present: true, Value: strPtr("n[1-")},
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newEnvServer(t, tc.sched, tc.env)
+			var d Diagnostics
+			assert.Equal(t, http.StatusOK, getInto(t, ts, "/diagnostics", &d))
+			assert.Equal(t, tc.sched.Name(), d.Scheduler)
+			assert.Equal(t, tc.warnings, d.Warnings)
+
+			vars := make(map[string]EnvVar)
+			for _, v := range d.Variables {
+				_, duplicate := vars[v.Name]
+				assert.False(t, duplicate, "%s is listed more than once", v.Name)
+				vars[v.Name] = v
+			}
+			for name, expect := range tc.vars {
+				if expect.Reason == "" && !expect.Parsed {
+					// Reason is only checked to be present.
+					assert.NotEmpty(t, vars[name].Reason, name)
+					expect.Reason = vars[name].Reason
+				}
+				assert.Equal(t, expect, vars[name], name)
+			}
+		})
+	}
+}
+
+func TestInfoUnknownIsNull(t *testing.T) {
+	ts := newEnvServer(t, pbsScheduler{}, map[string]string{"PBS_JOBID": "1.server", "PBS_NUM_NODES": "two"})
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/info", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	var info struct {
+		Job map[string]interface{} `json:"job"`
+	}
+	assert.Nil(t, json.Unmarshal(body, &info))
+	assert.Equal(t, float64(1), info.Job["id"])
+	for _, key := range []string{"nodeCount", "slotCount", "ppn", "taskCount", "walltime"} {
+		v, ok := info.Job[key]
+		assert.True(t, ok, "%s must be present", key)
+		assert.Nil(t, v, "%s must be null", key)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Discovery describes a running server instance. It is written to
+// <runtime-dir>/<jobid>.json, so that clients on the node can find
+// the server of a job without knowing its port.
+type Discovery struct {
+	// Address to connect to, like 127.0.0.1:43521
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	// Unix socket, if server listens on one
+	Socket string `json:"socket,omitempty"`
+	PID    int    `json:"pid"`
+	JobID  string `json:"jobId"`
+	// File holding bearer token of the server
+	TokenFile string    `json:"tokenFile"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// discoveryJobID returns job ID used to name discovery file of job.
+// It is the ID used by the scheduler, so that elements of job arrays
+// sharing a node get files of their own. Outside of a job, it is
+// derived from pid of the server, like pid-1234.
+func discoveryJobID(job JobInfo, pid int) string {
+	if job.SchedulerID == "" {
+		return "pid-" + strconv.Itoa(pid)
+	}
+	return job.SchedulerID
+}
+
+// discoveryPath returns path of discovery file of jobID in dir.
+func discoveryPath(dir, jobID string) string {
+	return filepath.Join(dir, jobID+".json")
+}
+
+// writeDiscovery atomically writes discovery file to path.
+func writeDiscovery(path string, d Discovery) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0o600)
+}
+
+// readDiscovery reads discovery file at path.
+func readDiscovery(path string) (Discovery, error) {
+	var d Discovery
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return d, err
+	}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return d, fmt.Errorf("invalid discovery file %s: %w", path, err)
+	}
+	return d, nil
+}
+
+// cleanStaleDiscovery removes discovery files in dir left behind by
+// instances which are no longer running, along with their token files
+// and sockets. Other JSON files, like those which are not discovery
+// files or do not have a PID, are left alone, as the directory may be
+// shared with them. It returns paths of removed discovery files.
+func cleanStaleDiscovery(dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil
+	}
+	var removed []string
+	for _, path := range paths {
+		d, err := readDiscovery(path)
+		if err != nil || d.PID <= 0 {
+			log.Printf("[INFO] Skipping %s, it is not a discovery file", path)
+			continue
+		}
+		if processAlive(d.PID) {
+			continue
+		}
+		// Only remove files the instance created in runtime dir.
+		for _, file := range []string{d.TokenFile, d.Socket} {
+			if file != "" && filepath.Dir(file) == dir {
+				os.Remove(file)
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("[WARN] Failed to remove stale discovery file: %s", err)
+			continue
+		}
+		removed = append(removed, path)
+	}
+	return removed
+}
+
+// publishDiscovery writes discovery file of d to dir, after removing
+// stale files. It fails if another instance of the same job is running.
+// Returned function removes the file.
+func publishDiscovery(dir string, d Discovery) (func(), error) {
+	for _, path := range cleanStaleDiscovery(dir) {
+		log.Printf("[INFO] Removed stale discovery file: %s", path)
+	}
+	path := discoveryPath(dir, d.JobID)
+	if existing, err := readDiscovery(path); err == nil && existing.PID != d.PID {
+		return nil, fmt.Errorf("server of job %s is already running with PID %d", d.JobID, existing.PID)
+	}
+	if err := writeDiscovery(path, d); err != nil {
+		return nil, fmt.Errorf("failed to write discovery file: %w", err)
+	}
+	log.Printf("[INFO] Discovery file written to: %s", path)
+	return func() {
+		// Do not remove the file if it was taken over by another instance.
+		if current, err := readDiscovery(path); err == nil && current.PID == d.PID {
+			os.Remove(path)
+		}
+	}, nil
+}
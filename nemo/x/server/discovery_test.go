@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// deadPID returns PID of a process which has exited.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("failed to run process: %s", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestDiscoveryJobID(t *testing.T) {
+	assert.Equal(t, "42", discoveryJobID(JobInfo{ID: intPtr(42), SchedulerID: "42"}, 7))
+	assert.Equal(t, "42[1]", discoveryJobID(JobInfo{SchedulerID: "42[1]"}, 7))
+	assert.Equal(t, "pid-7", discoveryJobID(JobInfo{}, 7))
+}
+
+func TestWriteDiscovery(t *testing.T) {
+	path := discoveryPath(t.TempDir(), "42")
+	d := Discovery{
+		Address:   "127.0.0.1:4000",
+		Port:      4000,
+		PID:       os.Getpid(),
+		JobID:     "42",
+		TokenFile: "/run/user/1000/nemo/1.token",
+		StartTime: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	assert.Nil(t, writeDiscovery(path, d))
+
+	fi, err := os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	}
+	read, err := readDiscovery(path)
+	assert.Nil(t, err)
+	assert.Equal(t, d, read)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1, "temporary files must not be left behind")
+}
+
+func TestCleanStaleDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	dead := deadPID(t)
+
+	staleToken := filepath.Join(dir, "1.token")
+	outsideToken := filepath.Join(t.TempDir(), "2.token")
+	for _, file := range []string{staleToken, outsideToken} {
+		assert.Nil(t, os.WriteFile(file, []byte("token"), 0o600))
+	}
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "1"), Discovery{PID: dead, TokenFile: staleToken}))
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "2"), Discovery{PID: dead, TokenFile: outsideToken}))
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "3"), Discovery{PID: os.Getpid()}))
+	// Other files in runtime dir are left alone.
+	assert.Nil(t, os.WriteFile(discoveryPath(dir, "4"), []byte("{"), 0o600))
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "5"), Discovery{TokenFile: staleToken}))
+	kv, _ := NewKVStore(filepath.Join(dir, "kv.json"))
+	kv.Put("key", "value", nil)
+
+	removed := cleanStaleDiscovery(dir)
+	assert.ElementsMatch(t, []string{
+		discoveryPath(dir, "1"),
+		discoveryPath(dir, "2"),
+	}, removed)
+
+	assert.FileExists(t, discoveryPath(dir, "3"))
+	assert.FileExists(t, discoveryPath(dir, "4"))
+	assert.FileExists(t, discoveryPath(dir, "5"), "files without PID must not be removed")
+	assert.FileExists(t, filepath.Join(dir, "kv.json"))
+	assert.NoFileExists(t, staleToken)
+	assert.FileExists(t, outsideToken, "files outside runtime dir must not be removed")
+}
+
+func TestPublishDiscovery(t *testing.T) {
+	dir := t.TempDir()
+
+	// Stale file of the same job is replaced.
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "42"), Discovery{PID: deadPID(t), JobID: "42"}))
+	remove, err := publishDiscovery(dir, Discovery{PID: os.Getpid(), JobID: "42"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	d, err := readDiscovery(discoveryPath(dir, "42"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getpid(), d.PID)
+	remove()
+	assert.NoFileExists(t, discoveryPath(dir, "42"))
+
+	// Running instance of the same job is not replaced.
+	assert.Nil(t, writeDiscovery(discoveryPath(dir, "43"), Discovery{PID: os.Getppid(), JobID: "43"}))
+	_, err = publishDiscovery(dir, Discovery{PID: os.Getpid(), JobID: "43"})
+	assert.NotNil(t, err)
+	d, err = readDiscovery(discoveryPath(dir, "43"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getppid(), d.PID)
+}
+
+func TestPublishDiscoveryArray(t *testing.T) {
+	// Elements of a job array running on the same node
+	// must not take over discovery files of each other.
+	dir := t.TempDir()
+	var jobIDs []string
+	for _, id := range []string{"43[1].server", "43[2].server"} {
+		job := pbsScheduler{}.JobInfo(MapEnv(map[string]string{"PBS_JOBID": id}))
+		jobIDs = append(jobIDs, discoveryJobID(job, os.Getpid()))
+	}
+	assert.Equal(t, []string{"43[1]", "43[2]"}, jobIDs)
+
+	_, err := publishDiscovery(dir, Discovery{PID: os.Getppid(), JobID: jobIDs[0]})
+	assert.Nil(t, err)
+	remove, err := publishDiscovery(dir, Discovery{PID: os.Getpid(), JobID: jobIDs[1]})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer remove()
+	for i, pid := range []int{os.Getppid(), os.Getpid()} {
+		d, err := readDiscovery(discoveryPath(dir, jobIDs[i]))
+		assert.Nil(t, err)
+		assert.Equal(t, pid, d.PID)
+	}
+}
+
+func TestServerDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "server.token")
+	code := make(chan int, 1)
+	go func() {
+		code <- server(Options{
+			Port:         0,
+			Scheduler:    pbsScheduler{},
+			Env:          MapEnv(map[string]string{"PBS_JOBID": "42.server"}),
+			TokenFile:    tokenFile,
+			RuntimeDir:   dir,
+			DrainTimeout: 5 * time.Second,
+		})
+	}()
+
+	path := discoveryPath(dir, "42")
+	var d Discovery
+	for i := 0; ; i++ {
+		var err error
+		if d, err = readDiscovery(path); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("discovery file was not written: %s", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, os.Getpid(), d.PID)
+	assert.Equal(t, "42", d.JobID)
+	assert.Equal(t, tokenFile, d.TokenFile)
+	assert.NotZero(t, d.Port)
+	assert.NotEqual(t, 8000, d.Port)
+	assert.WithinDuration(t, time.Now(), d.StartTime, time.Minute)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + d.Address + "/info")
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	token, err := readTokenFile(d.TokenFile)
+	assert.Nil(t, err)
+	r, _ := http.NewRequest(http.MethodPost, "http://"+d.Address+"/shutdown", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err = client.Do(r)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	select {
+	case c := <-code:
+		assert.Equal(t, exitClean, c)
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not shutdown")
+	}
+	assert.NoFileExists(t, path)
+	assert.NoFileExists(t, tokenFile)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LookupEnvFunc looks up an environment variable.
+// It has the same semantics as os.LookupEnv.
+type LookupEnvFunc func(key string) (string, bool)
+
+// Env provides typed access to environment variables.
+// Lookups are done via LookupEnvFunc, so that it can be
+// backed by something other than process environment in tests.
+// Files named by variables, like PBS_NODEFILE, are read from
+// its filesystem, which is host filesystem by default.
+type Env struct {
+	lookup LookupEnvFunc
+	fsys   fs.FS
+	// trace records variables consulted, if not nil.
+	trace *envTrace
+}
+
+// NewEnv returns an Env backed by given lookup function.
+// If lookup is nil, os.LookupEnv is used.
+func NewEnv(lookup LookupEnvFunc) Env {
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	return Env{lookup: lookup}
+}
+
+// MapEnv returns an Env backed by given map.
+func MapEnv(m map[string]string) Env {
+	return NewEnv(func(key string) (string, bool) {
+		v, ok := m[key]
+		return v, ok
+	})
+}
+
+// WithFS returns copy of e which reads files from fsys. Absolute
+// paths are resolved relative to root of fsys, as if it is mounted at /.
+func (e Env) WithFS(fsys fs.FS) Env {
+	e.fsys = fsys
+	return e
+}
+
+// Open opens file at path, which is usually value of a variable.
+func (e Env) Open(path string) (io.ReadCloser, error) {
+	if e.fsys == nil {
+		return os.Open(path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimPrefix(filepath.ToSlash(abs), "/")
+	if name == "" {
+		name = "."
+	}
+	file, err := e.fsys.Open(name)
+	if err != nil {
+		// Report path as given rather than its name within fsys.
+		return nil, &fs.PathError{Op: "open", Path: path, Err: unwrapPathError(err)}
+	}
+	return file, nil
+}
+
+// unwrapPathError returns underlying error of a *fs.PathError.
+func unwrapPathError(err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+// ReadLines reads non empty lines from file at path,
+// with leading and trailing whitespace removed.
+func (e Env) ReadLines(path string) ([]string, error) {
+	file, err := e.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	var lines []string
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// Lookup returns value of the variable and whether it was present.
+func (e Env) Lookup(key string) (string, bool) {
+	val, ok := e.lookup(key)
+	e.trace.lookup(key, val, ok)
+	return val, ok
+}
+
+// Has returns true if variable is present.
+func (e Env) Has(key string) bool {
+	_, ok := e.Lookup(key)
+	return ok
+}
+
+// String returns value of the first variable present among keys.
+// Returns empty string if none of them are present.
+func (e Env) String(keys ...string) string {
+	_, val, _ := e.First(keys...)
+	return val
+}
+
+// First returns name and value of the first variable present
+// among keys. Returns false if none of them are present.
+func (e Env) First(keys ...string) (string, string, bool) {
+	for _, key := range keys {
+		if val, ok := e.Lookup(key); ok {
+			return key, val, true
+		}
+	}
+	return "", "", false
+}
+
+// Int returns value of the first variable present among keys
+// as an integer. Returns nil if none of them are present
+// or if value is not an integer.
+func (e Env) Int(keys ...string) *int {
+	for _, key := range keys {
+		val, ok := e.Lookup(key)
+		if !ok {
+			continue
+		}
+		v, err := strconv.Atoi(val)
+		if err != nil {
+			e.Invalid(key, fmt.Errorf("%q is not an integer", val))
+			return nil
+		}
+		return &v
+	}
+	return nil
+}
+
+// Invalid records that value of variable key could not be used
+// because of err. It is reported by diagnostics.
+func (e Env) Invalid(key string, err error) {
+	e.trace.invalid(key, err)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventType is type of a job lifecycle event.
+type EventType string
+
+// Event types published by the server.
+const (
+	EventServerStarted     EventType = "server.started"
+	EventWalltimeThreshold EventType = "walltime.threshold"
+	EventNodeRegistered    EventType = "node.registered"
+	EventNodeLost          EventType = "node.lost"
+	EventSignalReceived    EventType = "signal.received"
+	EventShutdownRequested EventType = "shutdown.requested"
+)
+
+// Event is a job lifecycle event. IDs are sequential,
+// starting from 1 when the server starts.
+type Event struct {
+	ID   uint64      `json:"id" yaml:"id" hcl:"id"`
+	Type EventType   `json:"type" yaml:"type" hcl:"type"`
+	Time time.Time   `json:"time" yaml:"time" hcl:"time"`
+	Data interface{} `json:"data,omitempty" yaml:"data,omitempty" hcl:"data"`
+}
+
+// subscriberBuffer is number of events buffered per subscriber.
+// Subscribers which fall further behind are disconnected and
+// are expected to resume from history.
+const subscriberBuffer = 64
+
+// EventBus publishes events to subscribers and keeps a bounded
+// history of recent events so that subscribers can resume.
+type EventBus struct {
+	mu          sync.Mutex
+	seq         uint64
+	size        int
+	history     []Event
+	subscribers map[chan Event]bool
+}
+
+// NewEventBus returns an event bus which keeps last size events.
+func NewEventBus(size int) *EventBus {
+	if size < 1 {
+		size = 1
+	}
+	return &EventBus{
+		size:        size,
+		subscribers: make(map[chan Event]bool),
+	}
+}
+
+// Publish publishes an event and returns it.
+func (b *EventBus) Publish(typ EventType, data interface{}) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event := Event{ID: b.seq, Type: typ, Time: time.Now(), Data: data}
+	b.history = append(b.history, event)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber, disconnect it.
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return event
+}
+
+// History returns events in history with ID greater than after.
+func (b *EventBus) History(after uint64) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.historyLocked(after)
+}
+
+func (b *EventBus) historyLocked(after uint64) []Event {
+	var events []Event
+	for _, event := range b.history {
+		if event.ID > after {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Subscribe returns events in history with ID greater than after,
+// along with a channel on which new events are delivered. Channel is
+// closed if subscriber falls behind or cancel is called.
+func (b *EventBus) Subscribe(after uint64) ([]Event, <-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, subscriberBuffer)
+	b.subscribers[ch] = true
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.subscribers[ch] {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return b.historyLocked(after), ch, cancel
+}
+
+// sseKeepalive is interval at which comments are sent on idle streams,
+// so that proxies do not close the connection.
+var sseKeepalive = 15 * time.Second
+
+// handleEvents streams events as Server-Sent Events. Clients may resume
+// from where they left off with Last-Event-ID header or lastEventId
+// query parameter, as long as the events are still in history.
+// Stream is closed after shutdown.requested event is sent.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var after uint64
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	if lastID != "" {
+		v, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			http.Error(w, "Last-Event-ID must be a non negative integer", http.StatusBadRequest)
+			return
+		}
+		after = v
+	}
+
+	backlog, ch, cancel := s.events.Subscribe(after)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", 3000)
+	flusher.Flush()
+
+	for _, event := range backlog {
+		if err := writeSSE(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	if len(backlog) > 0 && backlog[len(backlog)-1].Type == EventShutdownRequested {
+		return
+	}
+
+	ticker := time.NewTicker(sseKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-ch:
+			if !ok {
+				// Fell behind, client should reconnect with Last-Event-ID.
+				return
+			}
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+			if event.Type == EventShutdownRequested {
+				return
+			}
+		}
+	}
+}
+
+// writeSSE writes event in text/event-stream format.
+func writeSSE(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode event %d: %s", event.ID, err)
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
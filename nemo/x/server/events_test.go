@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBusHistory(t *testing.T) {
+	b := NewEventBus(3)
+	for i := 0; i < 5; i++ {
+		b.Publish(EventServerStarted, i)
+	}
+	history := b.History(0)
+	assert.Len(t, history, 3)
+	assert.Equal(t, uint64(3), history[0].ID)
+	assert.Equal(t, uint64(5), history[2].ID)
+	assert.Equal(t, 3, history[1].Data)
+
+	assert.Len(t, b.History(4), 1)
+	assert.Empty(t, b.History(5))
+	assert.Empty(t, b.History(100))
+}
+
+func TestEventBusSubscribe(t *testing.T) {
+	b := NewEventBus(10)
+	b.Publish(EventServerStarted, nil)
+	b.Publish(EventSignalReceived, nil)
+
+	backlog, ch, cancel := b.Subscribe(1)
+	assert.Len(t, backlog, 1)
+	assert.Equal(t, EventSignalReceived, backlog[0].Type)
+
+	b.Publish(EventShutdownRequested, nil)
+	event := <-ch
+	assert.Equal(t, uint64(3), event.ID)
+	assert.Equal(t, EventShutdownRequested, event.Type)
+
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok, "channel must be closed on cancel")
+	// Cancel must be idempotent.
+	cancel()
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	b := NewEventBus(1000)
+	_, ch, cancel := b.Subscribe(0)
+	defer cancel()
+
+	for i := 0; i < subscriberBuffer+1; i++ {
+		b.Publish(EventServerStarted, i)
+	}
+	count := 0
+	for range ch {
+		count++
+	}
+	assert.Equal(t, subscriberBuffer, count, "slow subscriber must be disconnected")
+}
+
+// sseEvent is an event parsed from text/event-stream.
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  Event
+}
+
+// readSSE reads n events from stream.
+func readSSE(t *testing.T, scanner *bufio.Scanner, n int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	for len(events) < n && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if current.ID != "" {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			current.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &current.Data))
+		}
+	}
+	return events
+}
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	s := NewServer(Options{
+		Scheduler:    pbsScheduler{},
+		Env:          MapEnv(map[string]string{"PBS_JOBID": "1"}),
+		EventHistory: 10,
+	}, func() {})
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func TestHandleEvents(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.events.Publish(EventServerStarted, nil)
+
+	resp, err := http.Get(ts.URL + "/events")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(resp.Body)
+	events := readSSE(t, scanner, 1)
+	assert.Equal(t, []sseEvent{{ID: "1", Event: "server.started", Data: events[0].Data}}, events)
+
+	s.events.Publish(EventSignalReceived, map[string]string{"signal": "interrupt"})
+	s.requestShutdown("test")
+
+	events = readSSE(t, scanner, 2)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "2", events[0].ID)
+		assert.Equal(t, "signal.received", events[0].Event)
+		assert.Equal(t, map[string]interface{}{"signal": "interrupt"}, events[0].Data.Data)
+		assert.Equal(t, "3", events[1].ID)
+		assert.Equal(t, "shutdown.requested", events[1].Event)
+	}
+	// Stream must end after shutdown event.
+	assert.False(t, scanner.Scan())
+}
+
+func TestHandleEventsResume(t *testing.T) {
+	s, ts := newTestServer(t)
+	for i := 0; i < 15; i++ {
+		s.events.Publish(EventServerStarted, i)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		first  string
+	}{
+		{name: "header", header: "12", first: "13"},
+		{name: "query", query: "?lastEventId=13", first: "14"},
+		{name: "evicted", header: "1", first: "6"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			r, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/events"+tc.query, nil)
+			if tc.header != "" {
+				r.Header.Set("Last-Event-ID", tc.header)
+			}
+			resp, err := http.DefaultClient.Do(r)
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			events := readSSE(t, bufio.NewScanner(resp.Body), 1)
+			if assert.Len(t, events, 1) {
+				assert.Equal(t, tc.first, events[0].ID)
+			}
+		})
+	}
+
+	resp, err := http.Get(ts.URL + "/events?lastEventId=abc")
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestServerRunPublishesWalltime(t *testing.T) {
+	s := NewServer(Options{
+		Scheduler:        pbsScheduler{},
+		Env:              MapEnv(map[string]string{"PBS_JOBID": "1", "PBS_WALLTIME": "60"}),
+		WalltimeWarnings: []time.Duration{2 * time.Minute},
+		EventHistory:     10,
+	}, func() {})
+	_, ch, cancel := s.events.Subscribe(0)
+	defer cancel()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go s.Run(ctx)
+
+	select {
+	case event := <-ch:
+		assert.Equal(t, EventWalltimeThreshold, event.Type)
+		assert.Equal(t, 2*time.Minute, event.Data.(Threshold).Before)
+	case <-time.After(5 * time.Second):
+		t.Fatal("walltime threshold event was not published")
+	}
+}
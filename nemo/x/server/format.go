@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prefix of variable names used in env, bash and fish formats.
+const envPrefix = "NEMO"
+
+// format is an output format for responses.
+type format struct {
+	// Name as used in ?format= query parameter.
+	Name string
+	// Content-Type of the encoded response.
+	ContentType string
+	// Media types in Accept header which select this format.
+	Accepts []string
+	// Encode writes v to w.
+	Encode func(w io.Writer, v interface{}) error
+}
+
+// formats is list of supported formats. First one is the default.
+var formats = []format{
+	{
+		Name:        "json",
+		ContentType: "application/json",
+		Accepts:     []string{"application/json", "text/json"},
+		Encode:      encodeJSON,
+	},
+	{
+		Name:        "yaml",
+		ContentType: "application/yaml",
+		Accepts:     []string{"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"},
+		Encode:      encodeYAML,
+	},
+	{
+		Name:        "hcl",
+		ContentType: "application/hcl",
+		Accepts:     []string{"application/hcl", "application/x-hcl", "text/x-hcl"},
+		Encode:      encodeHCL,
+	},
+	{
+		Name:        "toml",
+		ContentType: "application/toml",
+		Accepts:     []string{"application/toml", "application/x-toml", "text/x-toml"},
+		Encode:      encodeTOML,
+	},
+	{
+		Name:        "env",
+		ContentType: "text/plain; charset=utf-8",
+		Accepts:     []string{"text/x-env"},
+		Encode:      encodeEnv,
+	},
+	{
+		Name:        "bash",
+		ContentType: "text/x-shellscript; charset=utf-8",
+		Accepts:     []string{"text/x-shellscript", "application/x-sh", "text/x-sh"},
+		Encode:      encodeBash,
+	},
+	{
+		Name:        "fish",
+		ContentType: "text/x-fish; charset=utf-8",
+		Accepts:     []string{"text/x-fish"},
+		Encode:      encodeFish,
+	},
+}
+
+// formatNames returns names of all supported formats.
+func formatNames() []string {
+	names := make([]string, 0, len(formats))
+	for _, f := range formats {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// formatByName returns format with given name.
+func formatByName(name string) (format, bool) {
+	for _, f := range formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return format{}, false
+}
+
+// formatByMediaType returns format matching media type from Accept header.
+// Wildcards */* and application/* select the default format.
+func formatByMediaType(mediaType string) (format, bool) {
+	if mediaType == "*/*" || mediaType == "application/*" {
+		return formats[0], true
+	}
+	for _, f := range formats {
+		for _, accept := range f.Accepts {
+			if accept == mediaType {
+				return f, true
+			}
+		}
+	}
+	return format{}, false
+}
+
+// negotiateFormat selects response format for the request.
+// ?format= query parameter takes precedence over Accept header.
+// Returns HTTP status code and an error if no supported format
+// can be selected.
+func negotiateFormat(r *http.Request) (format, int, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		if f, ok := formatByName(name); ok {
+			return f, http.StatusOK, nil
+		}
+		return format{}, http.StatusBadRequest, fmt.Errorf(
+			"unsupported format %q, must be one of %s", name, strings.Join(formatNames(), ","))
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return formats[0], http.StatusOK, nil
+	}
+
+	type candidate struct {
+		mediaType string
+		q         float64
+	}
+	var candidates []candidate
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{mediaType: mediaType, q: q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	for _, c := range candidates {
+		if f, ok := formatByMediaType(c.mediaType); ok {
+			return f, http.StatusOK, nil
+		}
+	}
+	return format{}, http.StatusNotAcceptable, fmt.Errorf(
+		"none of the media types in Accept header are supported, use ?format= with one of %s",
+		strings.Join(formatNames(), ","))
+}
+
+// writeResponse encodes v in the format negotiated with the client
+// and writes it to w along with Content-Type header. Response is
+// fully encoded before anything is written, so that errors can
+// still be reported with a proper status code.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	f, code, err := negotiateFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := f.Encode(&buf, v); err != nil {
+		log.Printf("[ERROR] Failed to encode response as %s: %s", f.Name, err)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("[ERROR] Failed to write response: %s", err)
+	}
+}
+
+func encodeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func encodeYAML(w io.Writer, v interface{}) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// field is a named struct field or map entry.
+type field struct {
+	Name  string
+	Value reflect.Value
+}
+
+// fieldsOf returns fields of struct or entries of a map with string keys.
+// Field names are taken from the first of given struct tags which is set,
+// falling back to Go field name. Fields tagged "-", unexported fields
+// and nil pointers are skipped, as are empty values tagged omitempty.
+func fieldsOf(v reflect.Value, tags ...string) []field {
+	var fields []field
+	switch v.Kind() {
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		for _, key := range keys {
+			if value := indirect(v.MapIndex(key)); value.IsValid() {
+				fields = append(fields, field{Name: key.String(), Value: value})
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if sf.PkgPath != "" {
+				continue
+			}
+			name, omitEmpty := sf.Name, false
+			for _, tag := range tags {
+				if value, ok := sf.Tag.Lookup(tag); ok {
+					parts := strings.Split(value, ",")
+					if parts[0] != "" {
+						name = parts[0]
+					}
+					for _, opt := range parts[1:] {
+						omitEmpty = omitEmpty || opt == "omitempty"
+					}
+					break
+				}
+			}
+			if name == "-" {
+				continue
+			}
+			value := indirect(v.Field(i))
+			if !value.IsValid() || (omitEmpty && value.IsZero()) {
+				continue
+			}
+			if omitEmpty && (value.Kind() == reflect.Slice || value.Kind() == reflect.Map) && value.Len() == 0 {
+				continue
+			}
+			fields = append(fields, field{Name: name, Value: value})
+		}
+	}
+	return fields
+}
+
+// indirect dereferences pointers and interfaces.
+// Returns zero Value if v is nil.
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// isTable returns true if v is encoded as a nested block or table
+// rather than as a scalar value.
+func isTable(v reflect.Value) bool {
+	if _, ok := textMarshaler(v); ok {
+		return false
+	}
+	return v.Kind() == reflect.Struct || (v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String)
+}
+
+// isTableList returns true if v is a slice of tables.
+func isTableList(v reflect.Value) bool {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return false
+	}
+	elem := v.Type().Elem()
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	return isTable(reflect.New(elem).Elem())
+}
+
+// textMarshaler returns text form of v if it implements encoding.TextMarshaler.
+func textMarshaler(v reflect.Value) (string, bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return "", false
+	}
+	m, ok := v.Interface().(encoding.TextMarshaler)
+	if !ok {
+		return "", false
+	}
+	text, err := m.MarshalText()
+	if err != nil {
+		return "", false
+	}
+	return string(text), true
+}
+
+// quoteString quotes s as a JSON string, which is also
+// a valid basic string in TOML and HCL.
+func quoteString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// scalarString formats a scalar value for HCL and TOML.
+// Lists are formatted inline. Returns false if v is not a scalar
+// or a list of scalars.
+func scalarString(v reflect.Value, quote func(string) string) (string, bool) {
+	if text, ok := textMarshaler(v); ok {
+		return quote(text), true
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return quote(v.String()), true
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		s := strconv.FormatFloat(v.Float(), 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEnN") {
+			s += ".0"
+		}
+		return s, true
+	case reflect.Slice, reflect.Array:
+		items := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			item := indirect(v.Index(i))
+			if !item.IsValid() {
+				continue
+			}
+			s, ok := scalarString(item, quote)
+			if !ok {
+				return "", false
+			}
+			items = append(items, s)
+		}
+		return "[" + strings.Join(items, ", ") + "]", true
+	}
+	return "", false
+}
+
+// quoteHCL quotes s as HCL string, escaping template sequences.
+func quoteHCL(s string) string {
+	s = quoteString(s)
+	s = strings.ReplaceAll(s, "${", "$${")
+	return strings.ReplaceAll(s, "%{", "%%{")
+}
+
+func encodeHCL(w io.Writer, v interface{}) error {
+	var buf bytes.Buffer
+	if err := writeHCLBody(&buf, indirect(reflect.ValueOf(v)), 0); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// writeHCLBody writes fields of struct v as HCL attributes and blocks.
+func writeHCLBody(buf *bytes.Buffer, v reflect.Value, depth int) error {
+	if !isTable(v) {
+		return fmt.Errorf("hcl: cannot encode %s as body", v.Type())
+	}
+	indent := strings.Repeat("  ", depth)
+	for _, f := range fieldsOf(v, "hcl", "json") {
+		switch {
+		case isTable(f.Value):
+			fmt.Fprintf(buf, "%s%s {\n", indent, f.Name)
+			if err := writeHCLBody(buf, f.Value, depth+1); err != nil {
+				return err
+			}
+			fmt.Fprintf(buf, "%s}\n", indent)
+		case isTableList(f.Value):
+			for i := 0; i < f.Value.Len(); i++ {
+				item := indirect(f.Value.Index(i))
+				if !item.IsValid() {
+					continue
+				}
+				fmt.Fprintf(buf, "%s%s {\n", indent, f.Name)
+				if err := writeHCLBody(buf, item, depth+1); err != nil {
+					return err
+				}
+				fmt.Fprintf(buf, "%s}\n", indent)
+			}
+		default:
+			s, ok := scalarString(f.Value, quoteHCL)
+			if !ok {
+				return fmt.Errorf("hcl: unsupported type %s for %s", f.Value.Type(), f.Name)
+			}
+			fmt.Fprintf(buf, "%s%s = %s\n", indent, f.Name, s)
+		}
+	}
+	return nil
+}
+
+func encodeTOML(w io.Writer, v interface{}) error {
+	var buf bytes.Buffer
+	if err := writeTOMLTable(&buf, indirect(reflect.ValueOf(v)), nil, false); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// writeTOMLTable writes fields of struct v as a TOML table at path.
+// Key/value pairs are written before sub tables, as TOML requires.
+func writeTOMLTable(buf *bytes.Buffer, v reflect.Value, path []string, arrayItem bool) error {
+	if !isTable(v) {
+		return fmt.Errorf("toml: cannot encode %s as table", v.Type())
+	}
+	if len(path) > 0 {
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		if arrayItem {
+			fmt.Fprintf(buf, "[[%s]]\n", strings.Join(path, "."))
+		} else {
+			fmt.Fprintf(buf, "[%s]\n", strings.Join(path, "."))
+		}
+	}
+
+	fields := fieldsOf(v, "toml", "json")
+	for _, f := range fields {
+		if isTable(f.Value) || isTableList(f.Value) {
+			continue
+		}
+		s, ok := scalarString(f.Value, quoteString)
+		if !ok {
+			return fmt.Errorf("toml: unsupported type %s for %s", f.Value.Type(), f.Name)
+		}
+		fmt.Fprintf(buf, "%s = %s\n", tomlKey(f.Name), s)
+	}
+	for _, f := range fields {
+		sub := append(append([]string{}, path...), tomlKey(f.Name))
+		switch {
+		case isTable(f.Value):
+			if err := writeTOMLTable(buf, f.Value, sub, false); err != nil {
+				return err
+			}
+		case isTableList(f.Value):
+			for i := 0; i < f.Value.Len(); i++ {
+				if item := indirect(f.Value.Index(i)); item.IsValid() {
+					if err := writeTOMLTable(buf, item, sub, true); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// tomlKey returns key as a bare key if possible, quoted otherwise.
+func tomlKey(key string) string {
+	for _, r := range key {
+		if !(r == '_' || r == '-' || (r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)))) {
+			return quoteString(key)
+		}
+	}
+	if key == "" {
+		return `""`
+	}
+	return key
+}
+
+// envVar is a shell variable with one or more values.
+type envVar struct {
+	Name   string
+	Values []string
+}
+
+// envVars flattens v into list of shell variables. Nested fields are
+// joined with underscores, and names are converted to upper snake case,
+// for example job.nodeCount becomes NEMO_JOB_NODE_COUNT. Lists of
+// structs are indexed, like NEMO_JOB_HOSTS_0_NAME.
+func envVars(prefix string, v reflect.Value) []envVar {
+	v = indirect(v)
+	if !v.IsValid() {
+		return nil
+	}
+	if isTable(v) {
+		var vars []envVar
+		for _, f := range fieldsOf(v, "json") {
+			vars = append(vars, envVars(prefix+"_"+envName(f.Name), f.Value)...)
+		}
+		return vars
+	}
+	if isTableList(v) {
+		var vars []envVar
+		for i := 0; i < v.Len(); i++ {
+			vars = append(vars, envVars(fmt.Sprintf("%s_%d", prefix, i), v.Index(i))...)
+		}
+		return vars
+	}
+	if text, ok := textMarshaler(v); ok {
+		return []envVar{{Name: prefix, Values: []string{text}}}
+	}
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		values := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if item := indirect(v.Index(i)); item.IsValid() {
+				values = append(values, fmt.Sprint(item.Interface()))
+			}
+		}
+		return []envVar{{Name: prefix, Values: values}}
+	}
+	return []envVar{{Name: prefix, Values: []string{fmt.Sprint(v.Interface())}}}
+}
+
+// envName converts camelCase name to UPPER_SNAKE_CASE.
+func envName(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) ||
+			(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			b.WriteRune('_')
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToUpper(r))
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// quoteShell quotes s for POSIX shells using single quotes.
+func quoteShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// quoteFish quotes s for fish shell using single quotes.
+func quoteFish(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
+
+// encodeEnv writes v as POSIX shell variable assignments.
+// Lists are newline separated, so that they can be iterated
+// over with for loops.
+func encodeEnv(w io.Writer, v interface{}) error {
+	var buf bytes.Buffer
+	for _, e := range envVars(envPrefix, reflect.ValueOf(v)) {
+		fmt.Fprintf(&buf, "%s=%s\n", e.Name, quoteShell(strings.Join(e.Values, "\n")))
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// encodeBash writes v as exported bash variables.
+func encodeBash(w io.Writer, v interface{}) error {
+	var buf bytes.Buffer
+	for _, e := range envVars(envPrefix, reflect.ValueOf(v)) {
+		fmt.Fprintf(&buf, "export %s=%s\n", e.Name, quoteShell(strings.Join(e.Values, "\n")))
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// encodeFish writes v as exported fish variables.
+// Lists are written as fish lists.
+func encodeFish(w io.Writer, v interface{}) error {
+	var buf bytes.Buffer
+	for _, e := range envVars(envPrefix, reflect.ValueOf(v)) {
+		buf.WriteString("set -gx " + e.Name)
+		for _, value := range e.Values {
+			buf.WriteString(" " + quoteFish(value))
+		}
+		buf.WriteString("\n")
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// testInfo returns Info used for testing encoders.
+func testInfo() Info {
+	job := JobInfo{
+		Name:          "it's a ${job}",
+		Authorization: "ab123",
+		Entitlement:   "bw1",
+		ID:            intPtr(42),
+		SchedulerID:   "42",
+		NodeCount:     intPtr(2),
+		PPN:           intPtr(2),
+		TaskCount:     intPtr(4),
+		Walltime:      intPtr(3600),
+		Queue:         "short",
+	}
+	job.setHosts([]HostSlots{{Name: "n1", Slots: intPtr(2)}, {Name: "n2", Slots: intPtr(2)}})
+	return Info{
+		Node:     NodeInfo{Name: "n1", Index: intPtr(0), PID: 100},
+		Job:      job,
+		Warnings: []string{"a warning"},
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		expect string
+		status int
+	}{
+		{name: "default", expect: "json", status: http.StatusOK},
+		{name: "wildcard", accept: "*/*", expect: "json", status: http.StatusOK},
+		{name: "application-wildcard", accept: "application/*", expect: "json", status: http.StatusOK},
+		{name: "json", accept: "application/json", expect: "json", status: http.StatusOK},
+		{name: "yaml", accept: "application/yaml", expect: "yaml", status: http.StatusOK},
+		{name: "x-yaml", accept: "application/x-yaml", expect: "yaml", status: http.StatusOK},
+		{name: "hcl", accept: "application/hcl", expect: "hcl", status: http.StatusOK},
+		{name: "toml", accept: "application/toml", expect: "toml", status: http.StatusOK},
+		{name: "bash", accept: "text/x-shellscript", expect: "bash", status: http.StatusOK},
+		{name: "fish", accept: "text/x-fish", expect: "fish", status: http.StatusOK},
+		{name: "env", accept: "text/x-env", expect: "env", status: http.StatusOK},
+		{name: "with-params", accept: "application/yaml; charset=utf-8", expect: "yaml", status: http.StatusOK},
+		{name: "first-supported", accept: "text/html, application/toml", expect: "toml", status: http.StatusOK},
+		{name: "q-values", accept: "application/json;q=0.5, application/yaml;q=0.9", expect: "yaml", status: http.StatusOK},
+		{name: "q-zero", accept: "application/yaml;q=0, application/toml", expect: "toml", status: http.StatusOK},
+		{name: "wildcard-low-q", accept: "*/*;q=0.1, application/hcl", expect: "hcl", status: http.StatusOK},
+		{name: "not-acceptable", accept: "text/html", status: http.StatusNotAcceptable},
+		{name: "query", query: "format=fish", expect: "fish", status: http.StatusOK},
+		{name: "query-overrides-accept", query: "format=toml", accept: "application/yaml", expect: "toml", status: http.StatusOK},
+		{name: "query-invalid", query: "format=xml", status: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/info?"+tc.query, nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			f, status, err := negotiateFormat(r)
+			assert.Equal(t, tc.status, status)
+			if tc.status == http.StatusOK {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expect, f.Name)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestWriteResponseContentType(t *testing.T) {
+	for _, f := range formats {
+		f := f
+		t.Run(f.Name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeResponse(w, httptest.NewRequest(http.MethodGet, "/info?format="+f.Name, nil), http.StatusOK, testInfo())
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, f.ContentType, w.Header().Get("Content-Type"))
+			assert.NotEmpty(t, w.Body.String())
+		})
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/info", nil)
+	r.Header.Set("Accept", "text/html")
+	writeResponse(w, r, http.StatusOK, testInfo())
+	assert.Equal(t, http.StatusNotAcceptable, w.Code)
+}
+
+func TestEncodeJSON(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, encodeJSON(&buf, testInfo()))
+	var actual Info
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &actual))
+	assert.Equal(t, testInfo(), actual)
+}
+
+func TestEncodeYAML(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, encodeYAML(&buf, testInfo()))
+	var actual Info
+	assert.Nil(t, yaml.Unmarshal(buf.Bytes(), &actual))
+	assert.Equal(t, testInfo(), actual)
+}
+
+func TestEncodeHCL(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, encodeHCL(&buf, testInfo()))
+	assert.Equal(t, `node {
+  name = "n1"
+  index = 0
+  pid = 100
+}
+job {
+  name = "it's a $${job}"
+  authorization = "ab123"
+  entitlement = "bw1"
+  id = 42
+  schedulerId = "42"
+  nodeCount = 2
+  nodes = ["n1", "n2"]
+  nodeList = "n[1-2]"
+  hosts {
+    name = "n1"
+    slots = 2
+  }
+  hosts {
+    name = "n2"
+    slots = 2
+  }
+  slotCount = 4
+  ppn = 2
+  taskCount = 4
+  walltime = 3600
+  queue = "short"
+}
+warnings = ["a warning"]
+`, buf.String())
+}
+
+func TestEncodeTOML(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, encodeTOML(&buf, testInfo()))
+	assert.Equal(t, `warnings = ["a warning"]
+
+[node]
+name = "n1"
+index = 0
+pid = 100
+
+[job]
+name = "it's a ${job}"
+authorization = "ab123"
+entitlement = "bw1"
+id = 42
+schedulerId = "42"
+nodeCount = 2
+nodes = ["n1", "n2"]
+nodeList = "n[1-2]"
+slotCount = 4
+ppn = 2
+taskCount = 4
+walltime = 3600
+queue = "short"
+
+[[job.hosts]]
+name = "n1"
+slots = 2
+
+[[job.hosts]]
+name = "n2"
+slots = 2
+`, buf.String())
+}
+
+func TestEncodeScalars(t *testing.T) {
+	v := struct {
+		F     float64           `json:"f"`
+		B     bool              `json:"b"`
+		P     *int              `json:"p"`
+		Skip  string            `json:"-"`
+		Empty string            `json:"empty,omitempty"`
+		M     map[string]string `json:"m"`
+	}{F: 2, B: true, Skip: "x", M: map[string]string{"b": "2", "a": "1"}}
+
+	var buf bytes.Buffer
+	assert.Nil(t, encodeTOML(&buf, v))
+	assert.Equal(t, "f = 2.0\nb = true\n\n[m]\na = \"1\"\nb = \"2\"\n", buf.String())
+
+	buf.Reset()
+	assert.Nil(t, encodeHCL(&buf, v))
+	assert.Equal(t, "f = 2.0\nb = true\nm {\n  a = \"1\"\n  b = \"2\"\n}\n", buf.String())
+
+	buf.Reset()
+	assert.Nil(t, encodeEnv(&buf, v))
+	assert.Equal(t, "NEMO_F='2'\nNEMO_B='true'\nNEMO_M_A='1'\nNEMO_M_B='2'\n", buf.String())
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"name":      "NAME",
+		"nodeCount": "NODE_COUNT",
+		"ppn":       "PPN",
+		"PID":       "PID",
+		"jobID":     "JOB_ID",
+		"HTTPPort":  "HTTP_PORT",
+		"node-list": "NODE_LIST",
+	}
+	for name, expect := range tests {
+		assert.Equal(t, expect, envName(name), name)
+	}
+}
+
+func TestEncodeEnv(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, encodeEnv(&buf, testInfo()))
+	out := buf.String()
+	assert.Contains(t, out, "NEMO_NODE_NAME='n1'\n")
+	assert.Contains(t, out, "NEMO_JOB_NAME='it'\\''s a ${job}'\n")
+	assert.Contains(t, out, "NEMO_JOB_SCHEDULER_ID='42'\n")
+	assert.Contains(t, out, "NEMO_JOB_NODE_COUNT='2'\n")
+	assert.Contains(t, out, "NEMO_JOB_NODES='n1\nn2'\n")
+	assert.Contains(t, out, "NEMO_JOB_HOSTS_1_SLOTS='2'\n")
+	assert.Contains(t, out, "NEMO_WARNINGS='a warning'\n")
+	assert.NotContains(t, out, "export")
+}
+
+func TestEncodeFish(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, encodeFish(&buf, testInfo()))
+	out := buf.String()
+	assert.Contains(t, out, "set -gx NEMO_NODE_NAME 'n1'\n")
+	assert.Contains(t, out, "set -gx NEMO_JOB_NAME 'it\\'s a ${job}'\n")
+	assert.Contains(t, out, "set -gx NEMO_JOB_NODES 'n1' 'n2'\n")
+}
+
+func TestEncodeBashSourceable(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, encodeBash(&buf, testInfo()))
+	script := buf.String() + `
+printf '%s|' "$NEMO_JOB_NAME" "$NEMO_JOB_ID" "$NEMO_JOB_HOSTS_0_NAME"
+for n in $NEMO_JOB_NODES; do printf '%s,' "$n"; done
+bash -c 'printf "|%s" "$NEMO_NODE_NAME"'
+`
+	out, err := exec.Command("bash", "-c", script).CombinedOutput()
+	assert.Nil(t, err, string(out))
+	assert.Equal(t, "it's a ${job}|42|n1|n1,n2,|n1", string(out))
+}
+
+func TestEncodeFishSourceable(t *testing.T) {
+	if _, err := exec.LookPath("fish"); err != nil {
+		t.Skip("fish not available")
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, encodeFish(&buf, testInfo()))
+	script := buf.String() + `printf '%s,' $NEMO_JOB_NAME $NEMO_JOB_NODES`
+	out, err := exec.Command("fish", "--no-config", "-c", script).CombinedOutput()
+	assert.Nil(t, err, string(out))
+	assert.Equal(t, "it's a ${job},n1,n2,", strings.TrimSpace(string(out)))
+}
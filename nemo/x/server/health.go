@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCheckTimeout is time allowed for a single health check.
+const defaultCheckTimeout = 5 * time.Second
+
+// Status of a health check or of a probe.
+const (
+	checkOK      = "ok"
+	checkFailing = "failing"
+)
+
+// nodefileVars are variables holding path of the file listing
+// nodes of the job, for schedulers which provide one.
+var nodefileVars = []string{"PBS_NODEFILE", "PE_HOSTFILE", "LSB_DJOB_HOSTFILE"}
+
+// probe is a set of probes a health check is part of.
+type probe int
+
+const (
+	// Liveness checks fail if the server is broken beyond repair.
+	probeLiveness probe = 1 << iota
+	// Readiness checks fail if the server or the job environment
+	// is not ready to serve clients.
+	probeReadiness
+)
+
+// CheckFunc returns an error if the checked condition does not hold.
+// It must return once ctx is done.
+type CheckFunc func(ctx context.Context) error
+
+type healthCheck struct {
+	name   string
+	probes probe
+	fn     CheckFunc
+}
+
+// CheckResult is result of a single health check.
+type CheckResult struct {
+	Name   string `json:"name" yaml:"name" hcl:"name"`
+	Status string `json:"status" yaml:"status" hcl:"status"`
+	// Time taken by the check in seconds
+	Latency float64 `json:"latency" yaml:"latency" hcl:"latency"`
+	// Reason the check is failing
+	Error string `json:"error,omitempty" yaml:"error,omitempty" hcl:"error,omitempty"`
+}
+
+// HealthReport is result of all checks of a probe. It is ok
+// only if all of its checks are ok.
+type HealthReport struct {
+	Status string        `json:"status" yaml:"status" hcl:"status"`
+	Checks []CheckResult `json:"checks" yaml:"checks" hcl:"checks"`
+}
+
+// Health is a registry of named health checks.
+type Health struct {
+	timeout time.Duration
+	mu      sync.RWMutex
+	checks  []healthCheck
+}
+
+// NewHealth returns an empty registry. Each check is given timeout
+// to complete, defaultCheckTimeout if it is not positive.
+func NewHealth(timeout time.Duration) *Health {
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	return &Health{timeout: timeout}
+}
+
+// Register adds check name to given probes, replacing
+// any existing check with the same name.
+func (h *Health) Register(name string, probes probe, fn CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	check := healthCheck{name: name, probes: probes, fn: fn}
+	for i := range h.checks {
+		if h.checks[i].name == name {
+			h.checks[i] = check
+			return
+		}
+	}
+	h.checks = append(h.checks, check)
+}
+
+// Run runs all checks of probe p concurrently and returns their results
+// in the order checks were registered.
+func (h *Health) Run(ctx context.Context, p probe) HealthReport {
+	h.mu.RLock()
+	var checks []healthCheck
+	for _, check := range h.checks {
+		if check.probes&p != 0 {
+			checks = append(checks, check)
+		}
+	}
+	h.mu.RUnlock()
+
+	report := HealthReport{Status: checkOK, Checks: make([]CheckResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			report.Checks[i] = h.run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status != checkOK {
+			report.Status = checkFailing
+		}
+	}
+	return report
+}
+
+// run runs a single check, failing it if it does not return in time.
+func (h *Health) run(ctx context.Context, check healthCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.fn(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("check did not complete: %w", ctx.Err())
+	}
+	result := CheckResult{Name: check.name, Status: checkOK, Latency: time.Since(start).Seconds()}
+	if err != nil {
+		result.Status = checkFailing
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// nodefileCheck returns check which fails if nodefile of the job
+// is unreadable or empty. Returns false if env has no nodefile.
+func nodefileCheck(env Env) (CheckFunc, bool) {
+	for _, name := range nodefileVars {
+		path, ok := env.Lookup(name)
+		if !ok {
+			continue
+		}
+		return func(ctx context.Context) error {
+			lines, err := env.ReadLines(path)
+			if err != nil {
+				return err
+			}
+			if len(lines) == 0 {
+				return fmt.Errorf("%s %s is empty", name, path)
+			}
+			return nil
+		}, true
+	}
+	return nil, false
+}
+
+// walltimeCheck returns check which fails once walltime is exceeded.
+func walltimeCheck(w *Walltime) CheckFunc {
+	return func(ctx context.Context) error {
+		if status := w.Status(); status.Expired {
+			return fmt.Errorf("walltime of %s is exceeded", formatSeconds(status.Limit))
+		}
+		return nil
+	}
+}
+
+// envCheck returns check which fails if any of variables are not set.
+func envCheck(env Env, names []string) CheckFunc {
+	return func(ctx context.Context) error {
+		var missing []string
+		for _, name := range names {
+			if _, ok := env.Lookup(name); !ok {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing variables: %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
+
+// peersCheck returns check which fails if TCP connections cannot be
+// established to any of peers, given as host:port.
+func peersCheck(peers []string) CheckFunc {
+	return func(ctx context.Context) error {
+		unreachable := make([]string, len(peers))
+		var wg sync.WaitGroup
+		for i, peer := range peers {
+			wg.Add(1)
+			go func(i int, peer string) {
+				defer wg.Done()
+				var d net.Dialer
+				conn, err := d.DialContext(ctx, "tcp", peer)
+				if err != nil {
+					unreachable[i] = peer
+					return
+				}
+				conn.Close()
+			}(i, peer)
+		}
+		wg.Wait()
+
+		var failed []string
+		for _, peer := range unreachable {
+			if peer != "" {
+				failed = append(failed, peer)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("unreachable peers: %s", strings.Join(failed, ", "))
+		}
+		return nil
+	}
+}
+
+// errDraining is reported by readiness once server starts to drain.
+var errDraining = errors.New("server is shutting down")
+
+// registerChecks registers built in health checks of the server.
+func (s *Server) registerChecks() {
+	s.health.Register("shutdown", probeReadiness, func(ctx context.Context) error {
+		select {
+		case <-s.draining:
+			return errDraining
+		default:
+			return nil
+		}
+	})
+	if check, ok := nodefileCheck(s.opts.Env); ok {
+		s.health.Register("nodefile", probeReadiness, check)
+	}
+	s.health.Register("walltime", probeReadiness, walltimeCheck(s.walltime))
+	if len(s.opts.RequiredEnv) > 0 {
+		s.health.Register("env", probeReadiness, envCheck(s.opts.Env, s.opts.RequiredEnv))
+	}
+	if len(s.opts.Peers) > 0 {
+		s.health.Register("peers", probeReadiness, peersCheck(s.opts.Peers))
+	}
+}
+
+// handleProbe returns handler reporting health checks of probe p.
+// Status is 200 if all checks are ok, 503 otherwise.
+func (s *Server) handleProbe(p probe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := s.health.Run(r.Context(), p)
+		status := http.StatusOK
+		if report.Status != checkOK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeResponse(w, r, status, report)
+	}
+}
+
+// listFlag is a flag.Value for comma separated list of strings.
+// It can be given more than once to append to the list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthRun(t *testing.T) {
+	h := NewHealth(50 * time.Millisecond)
+	h.Register("ok", probeLiveness|probeReadiness, func(ctx context.Context) error { return nil })
+	h.Register("broken", probeReadiness, func(ctx context.Context) error { return errors.New("broken") })
+	h.Register("slow", probeReadiness, func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	report := h.Run(context.Background(), probeLiveness)
+	assert.Equal(t, checkOK, report.Status)
+	if assert.Len(t, report.Checks, 1) {
+		assert.Equal(t, "ok", report.Checks[0].Name)
+	}
+
+	start := time.Now()
+	report = h.Run(context.Background(), probeReadiness)
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond), "checks must run concurrently and time out")
+	assert.Equal(t, checkFailing, report.Status)
+	if assert.Len(t, report.Checks, 3) {
+		assert.Equal(t, CheckResult{Name: "ok", Status: checkOK, Latency: report.Checks[0].Latency}, report.Checks[0])
+		assert.Equal(t, "broken", report.Checks[1].Error)
+		assert.Equal(t, checkFailing, report.Checks[2].Status)
+		assert.Contains(t, report.Checks[2].Error, "deadline exceeded")
+		assert.GreaterOrEqual(t, report.Checks[2].Latency, 0.05)
+	}
+
+	// Checks with the same name are replaced.
+	h.Register("broken", probeReadiness, func(ctx context.Context) error { return nil })
+	h.Register("slow", probeLiveness, func(ctx context.Context) error { return nil })
+	report = h.Run(context.Background(), probeReadiness)
+	assert.Equal(t, checkOK, report.Status)
+	assert.Len(t, report.Checks, 2)
+}
+
+func TestHealthChecks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	nodefile := writeTempFile(t, "nodefile", "n1")
+	empty := filepath.Join(t.TempDir(), "empty")
+	assert.Nil(t, os.WriteFile(empty, nil, 0o644))
+
+	env := MapEnv(map[string]string{"A": "1", "B": ""})
+	tests := []struct {
+		name  string
+		check CheckFunc
+		err   string
+	}{
+		{name: "env", check: envCheck(env, []string{"A", "B"})},
+		{name: "env-missing", check: envCheck(env, []string{"A", "C", "D"}), err: "missing variables: C, D"},
+		{name: "peers", check: peersCheck([]string{l.Addr().String()})},
+		{
+			name:  "peers-unreachable",
+			check: peersCheck([]string{l.Addr().String(), closed.Addr().String()}),
+			err:   "unreachable peers: " + closed.Addr().String(),
+		},
+		{name: "walltime", check: walltimeCheck(NewWalltime(time.Now(), time.Hour, nil))},
+		{name: "walltime-unlimited", check: walltimeCheck(NewWalltime(time.Now(), 0, nil))},
+		{
+			name:  "walltime-exceeded",
+			check: walltimeCheck(NewWalltime(time.Now().Add(-2*time.Hour), time.Hour, nil)),
+			err:   "walltime of 1h0m0s is exceeded",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.check(context.Background())
+			if tc.err == "" {
+				assert.Nil(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.Equal(t, tc.err, err.Error())
+			}
+		})
+	}
+
+	_, ok := nodefileCheck(MapEnv(nil))
+	assert.False(t, ok)
+	check, ok := nodefileCheck(MapEnv(map[string]string{"PE_HOSTFILE": nodefile}))
+	if assert.True(t, ok) {
+		assert.Nil(t, check(context.Background()))
+	}
+	check, _ = nodefileCheck(MapEnv(map[string]string{"PBS_NODEFILE": empty}))
+	assert.EqualError(t, check(context.Background()), "PBS_NODEFILE "+empty+" is empty")
+	check, _ = nodefileCheck(MapEnv(map[string]string{"PBS_NODEFILE": empty + ".missing"}))
+	assert.NotNil(t, check(context.Background()))
+}
+
+func TestServerProbes(t *testing.T) {
+	s := NewServer(Options{
+		Scheduler:   pbsScheduler{},
+		Env:         MapEnv(map[string]string{"PBS_JOBID": "1", "PBS_NODEFILE": writeTempFile(t, "nodefile", "n1")}),
+		RequiredEnv: []string{"PBS_JOBID"},
+		AuthRead:    true,
+	}, func() {})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	get := func(path string) (int, HealthReport) {
+		var report HealthReport
+		resp, err := http.Get(ts.URL + path)
+		if !assert.Nil(t, err) {
+			return 0, report
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&report))
+		return resp.StatusCode, report
+	}
+	names := func(report HealthReport) []string {
+		var names []string
+		for _, check := range report.Checks {
+			names = append(names, check.Name)
+		}
+		return names
+	}
+
+	code, report := get("/healthz")
+	assert.Equal(t, http.StatusOK, code, "probes must not require a token")
+	assert.Equal(t, checkOK, report.Status)
+
+	code, report = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"shutdown", "nodefile", "walltime", "env"}, names(report))
+
+	s.health.Register("custom", probeLiveness, func(ctx context.Context) error { return errors.New("custom") })
+	code, report = get("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, checkFailing, report.Status)
+
+	// Readiness fails once server starts to drain.
+	s.Drain("test")
+	code, report = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	if assert.NotEmpty(t, report.Checks) {
+		assert.Equal(t, CheckResult{
+			Name:    "shutdown",
+			Status:  checkFailing,
+			Latency: report.Checks[0].Latency,
+			Error:   errDraining.Error(),
+		}, report.Checks[0])
+	}
+
+	resp, err := http.Get(ts.URL + "/readyz?format=hcl")
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "application/hcl", resp.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,280 @@
+// Package hostlist implements expansion and compression of
+// hostlist expressions as used by Slurm, for example
+// node[001-004,007],gpu[1-2].
+package hostlist
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxHosts is maximum number of hosts a single expression may expand to.
+// This guards against expressions like node[0-999999999].
+const MaxHosts = 1 << 16
+
+// ErrTooManyHosts is returned when expression expands to more than MaxHosts.
+var ErrTooManyHosts = errors.New("hostlist: expression expands to too many hosts")
+
+// SyntaxError is returned when expression is malformed.
+type SyntaxError struct {
+	Expr   string
+	Offset int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("hostlist: %s at offset %d in %q", e.Msg, e.Offset, e.Expr)
+}
+
+// Expand expands hostlist expression into list of hosts.
+// Hosts are returned in the order they appear in the expression.
+// Duplicates are preserved. Empty expression returns nil.
+//
+// An expression is a comma separated list of host patterns.
+// Each pattern may contain one or more bracketed range lists,
+// like rack[1-2]n[01-04]. Ranges are expanded as a cartesian product.
+// Zero padded ranges like [001-010] preserve width of the lower bound.
+func Expand(expr string) ([]string, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, nil
+	}
+
+	var hosts []string
+	start := 0
+	depth := 0
+	for i := 0; i <= len(expr); i++ {
+		if i < len(expr) {
+			switch expr[i] {
+			case '[':
+				if depth > 0 {
+					return nil, &SyntaxError{Expr: expr, Offset: i, Msg: "nested bracket"}
+				}
+				depth++
+				continue
+			case ']':
+				if depth == 0 {
+					return nil, &SyntaxError{Expr: expr, Offset: i, Msg: "unmatched closing bracket"}
+				}
+				depth--
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if depth > 0 {
+			return nil, &SyntaxError{Expr: expr, Offset: i, Msg: "unclosed bracket"}
+		}
+		if start == i {
+			return nil, &SyntaxError{Expr: expr, Offset: i, Msg: "empty host"}
+		}
+		expanded, err := expandPattern(expr, start, expr[start:i])
+		if err != nil {
+			return nil, err
+		}
+		if len(hosts)+len(expanded) > MaxHosts {
+			return nil, ErrTooManyHosts
+		}
+		hosts = append(hosts, expanded...)
+		start = i + 1
+	}
+	return hosts, nil
+}
+
+// expandPattern expands a single host pattern without top level commas.
+// offset is position of pattern in expr, used for error reporting.
+func expandPattern(expr string, offset int, pattern string) ([]string, error) {
+	if strings.ContainsAny(pattern, " \t\r\n") {
+		return nil, &SyntaxError{Expr: expr, Offset: offset, Msg: "whitespace in host"}
+	}
+	open := strings.IndexByte(pattern, '[')
+	if open < 0 {
+		return []string{pattern}, nil
+	}
+	// Brackets are already validated to be balanced and not nested.
+	close := open + strings.IndexByte(pattern[open:], ']')
+	prefix := pattern[:open]
+
+	values, err := expandRanges(expr, offset+open+1, pattern[open+1:close])
+	if err != nil {
+		return nil, err
+	}
+	suffixes, err := expandPattern(expr, offset+close+1, pattern[close+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(values)*len(suffixes) > MaxHosts {
+		return nil, ErrTooManyHosts
+	}
+
+	hosts := make([]string, 0, len(values)*len(suffixes))
+	for _, v := range values {
+		for _, s := range suffixes {
+			hosts = append(hosts, prefix+v+s)
+		}
+	}
+	return hosts, nil
+}
+
+// expandRanges expands comma separated list of ranges like 001-004,007.
+func expandRanges(expr string, offset int, list string) ([]string, error) {
+	if list == "" {
+		return nil, &SyntaxError{Expr: expr, Offset: offset, Msg: "empty range list"}
+	}
+	var values []string
+	for _, r := range strings.Split(list, ",") {
+		lo, hi := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+		if !isDigits(lo) || !isDigits(hi) {
+			return nil, &SyntaxError{Expr: expr, Offset: offset, Msg: fmt.Sprintf("invalid range %q", r)}
+		}
+		loVal, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, &SyntaxError{Expr: expr, Offset: offset, Msg: fmt.Sprintf("invalid range %q", r)}
+		}
+		hiVal, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, &SyntaxError{Expr: expr, Offset: offset, Msg: fmt.Sprintf("invalid range %q", r)}
+		}
+		if hiVal < loVal {
+			return nil, &SyntaxError{Expr: expr, Offset: offset, Msg: fmt.Sprintf("decreasing range %q", r)}
+		}
+		if hiVal-loVal >= MaxHosts-len(values) {
+			return nil, ErrTooManyHosts
+		}
+		width := 0
+		if len(lo) > 1 && lo[0] == '0' {
+			width = len(lo)
+		}
+		for v := loVal; v <= hiVal; v++ {
+			values = append(values, fmt.Sprintf("%0*d", width, v))
+		}
+		offset += len(r) + 1
+	}
+	return values, nil
+}
+
+// group is a set of hosts sharing a prefix and numeric width.
+type group struct {
+	prefix  string
+	width   int
+	numbers []int
+}
+
+// Compress compresses list of hosts into a hostlist expression.
+// Hosts sharing a prefix and a numeric suffix of same width are
+// merged into ranges. Duplicates are removed. Groups appear in the
+// order in which their first host appears in the list.
+//
+// Expand(Compress(hosts)) returns unique hosts, sorted numerically
+// within each group.
+func Compress(hosts []string) string {
+	// Collect widths of zero padded numbers per prefix, so that
+	// unpadded numbers of same width can join them. For example
+	// n09,n10 compresses to n[09-10].
+	padded := make(map[string]map[int]bool)
+	for _, host := range hosts {
+		prefix, digits := splitNumericSuffix(host)
+		if len(digits) > 1 && digits[0] == '0' {
+			if padded[prefix] == nil {
+				padded[prefix] = make(map[int]bool)
+			}
+			padded[prefix][len(digits)] = true
+		}
+	}
+
+	var groups []*group
+	index := make(map[string]*group)
+	seenPlain := make(map[string]bool)
+	for _, host := range hosts {
+		prefix, digits := splitNumericSuffix(host)
+		n, err := strconv.Atoi(digits)
+		if digits == "" || err != nil {
+			if !seenPlain[host] {
+				seenPlain[host] = true
+				groups = append(groups, &group{prefix: host})
+			}
+			continue
+		}
+		width := 0
+		if (len(digits) > 1 && digits[0] == '0') || padded[prefix][len(digits)] {
+			width = len(digits)
+		}
+		key := fmt.Sprintf("%s\x00%d", prefix, width)
+		g, ok := index[key]
+		if !ok {
+			g = &group{prefix: prefix, width: width}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.numbers = append(g.numbers, n)
+	}
+
+	parts := make([]string, 0, len(groups))
+	for _, g := range groups {
+		parts = append(parts, g.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// String returns hostlist expression for the group.
+func (g *group) String() string {
+	if len(g.numbers) == 0 {
+		return g.prefix
+	}
+	sort.Ints(g.numbers)
+	var ranges []string
+	count := 0
+	for i := 0; i < len(g.numbers); {
+		lo := g.numbers[i]
+		hi := lo
+		for i < len(g.numbers) && g.numbers[i] <= hi+1 {
+			if g.numbers[i] > hi {
+				hi = g.numbers[i]
+			}
+			i++
+		}
+		if lo == hi {
+			ranges = append(ranges, fmt.Sprintf("%0*d", g.width, lo))
+			count++
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%0*d-%0*d", g.width, lo, g.width, hi))
+			count += 2
+		}
+	}
+	if count == 1 {
+		return g.prefix + ranges[0]
+	}
+	return fmt.Sprintf("%s[%s]", g.prefix, strings.Join(ranges, ","))
+}
+
+// splitNumericSuffix splits host into prefix and trailing digits.
+func splitNumericSuffix(host string) (string, string) {
+	i := len(host)
+	for i > 0 && host[i-1] >= '0' && host[i-1] <= '9' {
+		i--
+	}
+	return host[:i], host[i:]
+}
+
+// isDigits returns true if s is a non empty string of ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
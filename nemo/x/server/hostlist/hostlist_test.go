@@ -0,0 +1,159 @@
+package hostlist_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tprasadtp/dotfiles/nemo/x/server/hostlist"
+)
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name   string
+		expr   string
+		expect []string
+	}{
+		{name: "empty", expr: "", expect: nil},
+		{name: "whitespace-only", expr: "  ", expect: nil},
+		{name: "single", expr: "node1", expect: []string{"node1"}},
+		{name: "plain-list", expr: "a,b,c", expect: []string{"a", "b", "c"}},
+		{name: "fqdn", expr: "n1.cluster.local", expect: []string{"n1.cluster.local"}},
+		{name: "trim", expr: " node1 ", expect: []string{"node1"}},
+		{name: "range", expr: "n[1-3]", expect: []string{"n1", "n2", "n3"}},
+		{name: "single-in-brackets", expr: "n[7]", expect: []string{"n7"}},
+		{name: "range-and-single", expr: "n[1-2,5]", expect: []string{"n1", "n2", "n5"}},
+		{name: "zero-padded", expr: "node[001-004,007]", expect: []string{"node001", "node002", "node003", "node004", "node007"}},
+		{name: "zero-padded-rollover", expr: "n[08-11]", expect: []string{"n08", "n09", "n10", "n11"}},
+		{name: "zero-padded-single", expr: "n[007]", expect: []string{"n007"}},
+		{name: "zero-lower-bound", expr: "n[0-2]", expect: []string{"n0", "n1", "n2"}},
+		{name: "unpadded-rollover", expr: "n[9-11]", expect: []string{"n9", "n10", "n11"}},
+		{name: "mixed-padding", expr: "n[01-02,10]", expect: []string{"n01", "n02", "n10"}},
+		{name: "multiple-groups", expr: "node[001-002],gpu[1-2]", expect: []string{"node001", "node002", "gpu1", "gpu2"}},
+		{name: "group-and-plain", expr: "login,n[1-2]", expect: []string{"login", "n1", "n2"}},
+		{name: "suffix", expr: "n[1-2]-ib", expect: []string{"n1-ib", "n2-ib"}},
+		{name: "cartesian", expr: "r[1-2]n[1-2]", expect: []string{"r1n1", "r1n2", "r2n1", "r2n2"}},
+		{name: "no-prefix", expr: "[1-2]", expect: []string{"1", "2"}},
+		{name: "duplicates-preserved", expr: "n1,n[1-2]", expect: []string{"n1", "n1", "n2"}},
+		{name: "same-bounds", expr: "n[3-3]", expect: []string{"n3"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := hostlist.Expand(tc.expr)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expect, actual)
+		})
+	}
+}
+
+func TestExpandMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{name: "unclosed", expr: "n[1-2"},
+		{name: "unopened", expr: "n1-2]"},
+		{name: "nested", expr: "n[1-[2]]"},
+		{name: "empty-brackets", expr: "n[]"},
+		{name: "empty-range-item", expr: "n[1,]"},
+		{name: "empty-host", expr: "a,,b"},
+		{name: "leading-comma", expr: ",a"},
+		{name: "trailing-comma", expr: "a,"},
+		{name: "decreasing", expr: "n[5-1]"},
+		{name: "open-range", expr: "n[1-]"},
+		{name: "open-lower-range", expr: "n[-1]"},
+		{name: "double-dash", expr: "n[1--2]"},
+		{name: "non-numeric", expr: "n[a-b]"},
+		{name: "hex", expr: "n[0x1-0x2]"},
+		{name: "negative", expr: "n[-2--1]"},
+		{name: "space-in-range", expr: "n[1 - 2]"},
+		{name: "space-in-host", expr: "a b"},
+		{name: "space-after-comma", expr: "a, b"},
+		{name: "overflow", expr: "n[1-99999999999999999999]"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := hostlist.Expand(tc.expr)
+			assert.Nil(t, actual)
+			var syntaxErr *hostlist.SyntaxError
+			assert.True(t, errors.As(err, &syntaxErr), "expected SyntaxError, got %v", err)
+		})
+	}
+}
+
+func TestExpandTooManyHosts(t *testing.T) {
+	tests := []string{
+		fmt.Sprintf("n[0-%d]", hostlist.MaxHosts),
+		"n[0-9223372036854775806]",
+		"r[0-999]n[0-999]",
+		fmt.Sprintf("a[1-%d],b[1-2]", hostlist.MaxHosts-1),
+	}
+	for _, expr := range tests {
+		actual, err := hostlist.Expand(expr)
+		assert.Nil(t, actual, expr)
+		assert.ErrorIs(t, err, hostlist.ErrTooManyHosts, expr)
+	}
+
+	actual, err := hostlist.Expand(fmt.Sprintf("n[1-%d]", hostlist.MaxHosts))
+	assert.Nil(t, err)
+	assert.Len(t, actual, hostlist.MaxHosts)
+}
+
+func TestCompress(t *testing.T) {
+	tests := []struct {
+		name   string
+		hosts  []string
+		expect string
+	}{
+		{name: "nil", hosts: nil, expect: ""},
+		{name: "single", hosts: []string{"node1"}, expect: "node1"},
+		{name: "no-digits", hosts: []string{"login", "head"}, expect: "login,head"},
+		{name: "range", hosts: []string{"n1", "n2", "n3"}, expect: "n[1-3]"},
+		{name: "pair", hosts: []string{"n1", "n2"}, expect: "n[1-2]"},
+		{name: "gap", hosts: []string{"n1", "n3"}, expect: "n[1,3]"},
+		{name: "unsorted", hosts: []string{"n3", "n1", "n2"}, expect: "n[1-3]"},
+		{name: "duplicates", hosts: []string{"n1", "n1", "n2", "n2"}, expect: "n[1-2]"},
+		{name: "duplicate-single", hosts: []string{"n1", "n1"}, expect: "n1"},
+		{name: "duplicate-plain", hosts: []string{"login", "login"}, expect: "login"},
+		{
+			name:   "zero-padded",
+			hosts:  []string{"node001", "node002", "node003", "node004", "node007"},
+			expect: "node[001-004,007]",
+		},
+		{name: "padded-rollover", hosts: []string{"n09", "n10", "n11"}, expect: "n[09-11]"},
+		{name: "unpadded-rollover", hosts: []string{"n9", "n10"}, expect: "n[9-10]"},
+		{name: "different-widths", hosts: []string{"n01", "n1"}, expect: "n01,n1"},
+		{name: "multiple-groups", hosts: []string{"node001", "node002", "gpu1", "gpu2"}, expect: "node[001-002],gpu[1-2]"},
+		{name: "group-order", hosts: []string{"gpu2", "node1", "gpu1"}, expect: "gpu[1-2],node1"},
+		{name: "prefix-with-digits", hosts: []string{"r1n1", "r1n2", "r2n1"}, expect: "r1n[1-2],r2n1"},
+		{name: "suffix-not-merged", hosts: []string{"n1-ib", "n2-ib"}, expect: "n1-ib,n2-ib"},
+		{name: "zero", hosts: []string{"n0", "n1"}, expect: "n[0-1]"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, hostlist.Compress(tc.hosts))
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []string{
+		"n1",
+		"n[1-3]",
+		"node[001-004,007]",
+		"node[001-002],gpu[1-2]",
+		"n[08-12]",
+		"n[9-10]",
+		"login,n[1-2]",
+		"a[1,3,5-9]",
+	}
+	for _, expr := range tests {
+		hosts, err := hostlist.Expand(expr)
+		assert.Nil(t, err, expr)
+		assert.Equal(t, expr, hostlist.Compress(hosts), expr)
+	}
+}
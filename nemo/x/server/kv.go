@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxKeySize is maximum length of a key.
+	maxKeySize = 256
+	// maxValueSize is maximum size of a value.
+	maxValueSize = 64 * 1024
+)
+
+var (
+	// ErrKeyNotFound is returned when key does not exist.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrVersionMismatch is returned when version of the key
+	// does not match the version expected by compare-and-swap.
+	ErrVersionMismatch = errors.New("version does not match")
+	// ErrNotHeadKV is returned when key/value store is used on a
+	// node other than the head node, and head node is unknown.
+	ErrNotHeadKV = errors.New("key/value store is only served by node with index 0")
+)
+
+// KVEntry is a key along with its value. Version is the store revision
+// at which key was last modified. It increases on every modification
+// of any key, so a key which is deleted and created again never gets
+// a version it had before.
+type KVEntry struct {
+	Key      string    `json:"key" yaml:"key" hcl:"key"`
+	Value    string    `json:"value" yaml:"value" hcl:"value"`
+	Version  uint64    `json:"version" yaml:"version" hcl:"version"`
+	Created  time.Time `json:"created" yaml:"created" hcl:"created"`
+	Modified time.Time `json:"modified" yaml:"modified" hcl:"modified"`
+}
+
+// KVList is the list of entries in the store.
+type KVList struct {
+	// Current revision of the store
+	Revision uint64    `json:"revision" yaml:"revision" hcl:"revision"`
+	Entries  []KVEntry `json:"entries" yaml:"entries" hcl:"entries"`
+}
+
+// kvSnapshot is the on-disk form of the store.
+type kvSnapshot struct {
+	Revision uint64    `json:"revision"`
+	Entries  []KVEntry `json:"entries"`
+}
+
+// KVStore is an in-memory key/value store with optional snapshot
+// to disk, written after every modification.
+type KVStore struct {
+	snapshot string
+
+	mu       sync.Mutex
+	revision uint64
+	entries  map[string]KVEntry
+	// changed is closed and removed when key is modified.
+	changed map[string]chan struct{}
+}
+
+// NewKVStore returns a store, loading snapshot if it exists. Snapshot
+// is disabled if path is empty.
+func NewKVStore(snapshot string) (*KVStore, error) {
+	s := &KVStore{
+		snapshot: snapshot,
+		entries:  make(map[string]KVEntry),
+		changed:  make(map[string]chan struct{}),
+	}
+	if snapshot == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to read key/value snapshot: %w", err)
+	}
+	var snap kvSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return s, fmt.Errorf("invalid key/value snapshot %s: %w", snapshot, err)
+	}
+	s.revision = snap.Revision
+	for _, entry := range snap.Entries {
+		s.entries[entry.Key] = entry
+	}
+	return s, nil
+}
+
+// Get returns entry of key.
+func (s *KVStore) Get(key string) (KVEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return KVEntry{}, ErrKeyNotFound
+	}
+	return entry, nil
+}
+
+// List returns entries whose keys start with prefix, ordered by key.
+func (s *KVStore) List(prefix string) KVList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := KVList{Revision: s.revision, Entries: []KVEntry{}}
+	for key, entry := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			list.Entries = append(list.Entries, entry)
+		}
+	}
+	sort.Slice(list.Entries, func(i, j int) bool {
+		return list.Entries[i].Key < list.Entries[j].Key
+	})
+	return list
+}
+
+// Put sets value of key. If version is not nil, value is only set if
+// key is at that version, or if version is 0 and key does not exist.
+// On mismatch, ErrVersionMismatch is returned along with current entry.
+func (s *KVStore) Put(key, value string, version *uint64) (KVEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists := s.entries[key]
+	if version != nil && *version != current.Version {
+		return current, ErrVersionMismatch
+	}
+	now := time.Now()
+	s.revision++
+	entry := KVEntry{Key: key, Value: value, Version: s.revision, Created: now, Modified: now}
+	if exists {
+		entry.Created = current.Created
+	}
+	s.entries[key] = entry
+	s.modifiedLocked(key)
+	return entry, nil
+}
+
+// Delete deletes key. If version is not nil, key is only deleted
+// if it is at that version.
+func (s *KVStore) Delete(key string, version *uint64) (KVEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists := s.entries[key]
+	if !exists {
+		return KVEntry{}, ErrKeyNotFound
+	}
+	if version != nil && *version != current.Version {
+		return current, ErrVersionMismatch
+	}
+	s.revision++
+	delete(s.entries, key)
+	s.modifiedLocked(key)
+	return current, nil
+}
+
+// Wait returns entry of key once it exists, or an error
+// if ctx is done before that.
+func (s *KVStore) Wait(ctx context.Context, key string) (KVEntry, error) {
+	for {
+		s.mu.Lock()
+		entry, ok := s.entries[key]
+		ch, waiting := s.changed[key]
+		if !ok && !waiting {
+			ch = make(chan struct{})
+			s.changed[key] = ch
+		}
+		s.mu.Unlock()
+		if ok {
+			return entry, nil
+		}
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return KVEntry{}, ctx.Err()
+		}
+	}
+}
+
+// modifiedLocked wakes up waiters of key and writes snapshot.
+// Caller must hold the lock.
+func (s *KVStore) modifiedLocked(key string) {
+	if ch, ok := s.changed[key]; ok {
+		close(ch)
+		delete(s.changed, key)
+	}
+	if s.snapshot == "" {
+		return
+	}
+	snap := kvSnapshot{Revision: s.revision, Entries: make([]KVEntry, 0, len(s.entries))}
+	for _, entry := range s.entries {
+		snap.Entries = append(snap.Entries, entry)
+	}
+	data, err := json.Marshal(snap)
+	if err == nil {
+		err = writeFileAtomic(s.snapshot, data, 0o600)
+	}
+	if err != nil {
+		// Store remains usable, it is only the snapshot which is stale.
+		log.Printf("[ERROR] Failed to write key/value snapshot: %s", err)
+	}
+}
+
+// validKey returns an error if key is empty, too long
+// or contains control characters.
+func validKey(key string) error {
+	if key == "" || len(key) > maxKeySize {
+		return fmt.Errorf("key must be 1 to %d bytes long", maxKeySize)
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return errors.New("key must not contain control characters")
+		}
+	}
+	return nil
+}
+
+// handleKV serves key/value store at /kv/{key}.
+//
+//	GET    returns the entry, wait=30s waits for the key to exist
+//	       and raw=true returns only the value. Without a key,
+//	       entries are listed, optionally filtered by prefix.
+//	PUT    sets value to request body. version=N sets it only if the
+//	       key is at version N, version=0 only if it does not exist.
+//	DELETE deletes the key, version=N only if it is at version N.
+//
+// Conflicts are reported with 409 along with the current entry.
+// Other nodes forward requests to the head node.
+func (s *Server) handleKV(w http.ResponseWriter, r *http.Request) {
+	if info := getJobInfo(s.opts.Scheduler, s.opts.Env); !isHead(info) {
+		if !s.forwardToHead(w, r, info) {
+			http.Error(w, ErrNotHeadKV.Error(), http.StatusNotFound)
+		}
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	if key == "" && r.Method == http.MethodGet {
+		writeResponse(w, r, http.StatusOK, s.kv.List(r.URL.Query().Get("prefix")))
+		return
+	}
+	if err := validKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var version *uint64
+	if value := r.URL.Query().Get("version"); value != "" {
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "version must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		version = &v
+	}
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			http.Error(w, "wait must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+
+	var entry KVEntry
+	var err error
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		entry, err = s.getKey(r, key, wait)
+		if err == nil {
+			if raw, _ := strconv.ParseBool(r.URL.Query().Get("raw")); raw {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Header().Set("X-Version", strconv.FormatUint(entry.Version, 10))
+				io.WriteString(w, entry.Value)
+				return
+			}
+		}
+	case http.MethodPut:
+		body, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+		if readErr != nil {
+			http.Error(w, fmt.Sprintf("value must be at most %d bytes", maxValueSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		entry, err = s.kv.Put(key, string(body), version)
+	case http.MethodDelete:
+		entry, err = s.kv.Delete(key, version)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case errors.Is(err, ErrVersionMismatch):
+		status = http.StatusConflict
+	case errors.Is(err, ErrKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errDraining):
+		http.Error(w, ErrKeyNotFound.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		// Client went away while waiting.
+		return
+	case r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeResponse(w, r, status, entry)
+}
+
+// getKey returns entry of key. If wait is not zero, it waits
+// up to that long for the key to exist.
+func (s *Server) getKey(r *http.Request, key string, wait time.Duration) (KVEntry, error) {
+	if wait == 0 {
+		return s.kv.Get(key)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.draining:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	entry, err := s.kv.Wait(ctx, key)
+	select {
+	case <-s.draining:
+		if err != nil {
+			return entry, errDraining
+		}
+	default:
+	}
+	return entry, err
+}
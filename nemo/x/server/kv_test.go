@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// uint64Ptr returns pointer to v.
+func uint64Ptr(v uint64) *uint64 {
+	return &v
+}
+
+// kvRequest sends request with body to ts and returns status code
+// and response body.
+func kvRequest(t *testing.T, ts *httptest.Server, method, path, body string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestKVStore(t *testing.T) {
+	s, err := NewKVStore("")
+	assert.Nil(t, err)
+
+	_, err = s.Get("a")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// Version 0 creates key only if it does not exist.
+	a, err := s.Put("a", "1", uint64Ptr(0))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), a.Version)
+	current, err := s.Put("a", "2", uint64Ptr(0))
+	assert.Equal(t, ErrVersionMismatch, err)
+	assert.Equal(t, a, current)
+
+	b, err := s.Put("b", "1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), b.Version)
+
+	a2, err := s.Put("a", "2", uint64Ptr(1))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), a2.Version)
+	assert.Equal(t, a.Created, a2.Created)
+
+	_, err = s.Delete("a", uint64Ptr(1))
+	assert.Equal(t, ErrVersionMismatch, err)
+	_, err = s.Delete("a", uint64Ptr(3))
+	assert.Nil(t, err)
+	_, err = s.Delete("a", nil)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// Recreated key does not get a version it had before.
+	a3, err := s.Put("a", "3", uint64Ptr(0))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), a3.Version)
+
+	list := s.List("")
+	assert.Equal(t, uint64(5), list.Revision)
+	if assert.Len(t, list.Entries, 2) {
+		assert.Equal(t, "a", list.Entries[0].Key)
+		assert.Equal(t, "b", list.Entries[1].Key)
+	}
+	assert.Len(t, s.List("b").Entries, 1)
+}
+
+func TestKVStoreWait(t *testing.T) {
+	s, _ := NewKVStore("")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := s.Wait(ctx, "ready")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	var wg sync.WaitGroup
+	entries := make([]KVEntry, 8)
+	for i := range entries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entries[i], _ = s.Wait(context.Background(), "ready")
+		}(i)
+	}
+	// Waiters keep waiting on changes to other keys.
+	s.Put("other", "x", nil)
+	s.Put("ready", "yes", nil)
+	wg.Wait()
+	for _, entry := range entries {
+		assert.Equal(t, "yes", entry.Value)
+	}
+}
+
+func TestKVStoreSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv", "snapshot.json")
+	s, err := NewKVStore(path)
+	assert.Nil(t, err)
+	s.Put("a", "1", nil)
+	s.Put("b", "2", nil)
+	s.Delete("a", nil)
+
+	restored, err := NewKVStore(path)
+	assert.Nil(t, err)
+	_, err = restored.Get("a")
+	assert.Equal(t, ErrKeyNotFound, err)
+	b, err := restored.Get("b")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", b.Value)
+	c, _ := restored.Put("c", "3", nil)
+	assert.Equal(t, uint64(4), c.Version, "revision must be restored")
+
+	invalid := writeTempFile(t, "kv.json", "{")
+	_, err = NewKVStore(invalid)
+	assert.NotNil(t, err)
+}
+
+func TestHandleKV(t *testing.T) {
+	ts := newEnvServer(t, pbsScheduler{}, map[string]string{"PBS_NODENUM": "0"})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{name: "missing", method: http.MethodGet, path: "/kv/config", code: http.StatusNotFound},
+		{name: "create", method: http.MethodPut, path: "/kv/config?version=0", body: "a", code: http.StatusOK},
+		{name: "create-exists", method: http.MethodPut, path: "/kv/config?version=0", body: "b", code: http.StatusConflict},
+		{name: "update", method: http.MethodPut, path: "/kv/config?version=1", body: "b", code: http.StatusOK},
+		{name: "nested", method: http.MethodPut, path: "/kv/rank/0/addr", body: "n1", code: http.StatusOK},
+		{name: "get", method: http.MethodGet, path: "/kv/config", code: http.StatusOK},
+		{name: "invalid-wait", method: http.MethodGet, path: "/kv/config?wait=abc", code: http.StatusBadRequest},
+		{name: "negative-wait", method: http.MethodGet, path: "/kv/config?wait=-1s", code: http.StatusBadRequest},
+		{name: "invalid-version", method: http.MethodPut, path: "/kv/config?version=x", code: http.StatusBadRequest},
+		{name: "too-long", method: http.MethodPut, path: "/kv/" + strings.Repeat("k", maxKeySize+1), code: http.StatusBadRequest},
+		{name: "too-large", method: http.MethodPut, path: "/kv/large", body: strings.Repeat("v", maxValueSize+1), code: http.StatusRequestEntityTooLarge},
+		{name: "delete-stale", method: http.MethodDelete, path: "/kv/config?version=1", code: http.StatusConflict},
+		{name: "delete", method: http.MethodDelete, path: "/kv/config?version=2", code: http.StatusNoContent},
+		{name: "delete-missing", method: http.MethodDelete, path: "/kv/config", code: http.StatusNotFound},
+		{name: "post", method: http.MethodPost, path: "/kv/config", code: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			code, _ := kvRequest(t, ts, tc.method, tc.path, tc.body)
+			assert.Equal(t, tc.code, code)
+		})
+	}
+
+	code, body := kvRequest(t, ts, http.MethodGet, "/kv/rank/0/addr?raw=true", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "n1", body)
+
+	var list KVList
+	assert.Equal(t, http.StatusOK, getInto(t, ts, "/kv/?prefix=rank/", &list))
+	if assert.Len(t, list.Entries, 1) {
+		assert.Equal(t, "rank/0/addr", list.Entries[0].Key)
+	}
+
+	// Conflict reports the current entry.
+	code, body = kvRequest(t, ts, http.MethodPut, "/kv/rank/0/addr?version=1", "n2")
+	assert.Equal(t, http.StatusConflict, code)
+	var current KVEntry
+	assert.Nil(t, json.Unmarshal([]byte(body), &current))
+	assert.Equal(t, "n1", current.Value)
+
+	// Only the head node serves the store.
+	peer := newEnvServer(t, pbsScheduler{}, map[string]string{"PBS_NODENUM": "1"})
+	code, _ = kvRequest(t, peer, http.MethodGet, "/kv/config", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestHandleKVUnknownIndex(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodefile string
+		code     int
+	}{
+		{name: "single-node", nodefile: "2.server", code: http.StatusOK},
+		{name: "many-nodes", nodefile: "1.server", code: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newEnvServer(t, pbsScheduler{}, map[string]string{"PBS_NODEFILE": "/var/spool/pbs/aux/" + tc.nodefile})
+			code, _ := kvRequest(t, ts, http.MethodGet, "/kv/", "")
+			assert.Equal(t, tc.code, code)
+		})
+	}
+}
+
+func TestHandleKVWait(t *testing.T) {
+	ts := newEnvServer(t, pbsScheduler{}, map[string]string{"PBS_NODENUM": "0"})
+
+	start := time.Now()
+	code, _ := kvRequest(t, ts, http.MethodGet, "/kv/ready?wait=100ms", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	done := make(chan string)
+	go func() {
+		_, body := kvRequest(t, ts, http.MethodGet, "/kv/ready?wait=10s&raw=true", "")
+		done <- body
+	}()
+	time.Sleep(50 * time.Millisecond)
+	code, _ = kvRequest(t, ts, http.MethodPut, "/kv/ready", "yes")
+	assert.Equal(t, http.StatusOK, code)
+	select {
+	case body := <-done:
+		assert.Equal(t, "yes", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter was not woken up by put")
+	}
+}
+
+// TestHandleKVConcurrent increments a counter from many clients using
+// compare-and-swap. Run with -race.
+func TestHandleKVConcurrent(t *testing.T) {
+	ts := newEnvServer(t, pbsScheduler{}, map[string]string{"PBS_NODENUM": "0"})
+	const clients, increments = 8, 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				var version uint64
+				value := 0
+				code, body := kvRequest(t, ts, http.MethodGet, "/kv/counter", "")
+				if code == http.StatusOK {
+					var entry KVEntry
+					json.Unmarshal([]byte(body), &entry)
+					version = entry.Version
+					value, _ = strconv.Atoi(entry.Value)
+				}
+				path := "/kv/counter?version=" + strconv.FormatUint(version, 10)
+				code, _ = kvRequest(t, ts, http.MethodPut, path, strconv.Itoa(value+1))
+				switch code {
+				case http.StatusOK:
+					n++
+				case http.StatusConflict:
+				default:
+					t.Errorf("unexpected status %d", code)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	code, body := kvRequest(t, ts, http.MethodGet, "/kv/counter?raw=true", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, strconv.Itoa(clients*increments), body)
+}
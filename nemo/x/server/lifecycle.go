@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Exit codes of the server. 2 is not used, as flag
+// package exits with it on invalid usage.
+const (
+	// exitClean is returned when server shuts down after
+	// draining all in-flight requests.
+	exitClean = 0
+	// exitStartupFailure is returned when server fails to start.
+	exitStartupFailure = 1
+	// exitForced is returned when in-flight requests could not be
+	// drained within drain timeout, or when shutdown was forced
+	// by a second signal.
+	exitForced = 3
+)
+
+// shutdownSignals are signals which trigger graceful shutdown.
+// PBS and Slurm send SIGTERM before killing the job, SIGHUP is sent
+// when the session it was started from goes away.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// ShutdownHook is called before server stops accepting requests.
+// ctx is done when drain timeout expires.
+type ShutdownHook func(ctx context.Context, reason string) error
+
+type namedHook struct {
+	name string
+	fn   ShutdownHook
+}
+
+// Lifecycle runs an http.Server until a shutdown signal or request,
+// then drains in-flight requests within a timeout.
+type Lifecycle struct {
+	// DrainTimeout is the time allowed for shutdown hooks and
+	// in-flight requests to complete.
+	DrainTimeout time.Duration
+	// OnSignal, if set, is called when a shutdown signal is received.
+	OnSignal func(sig os.Signal)
+
+	mu       sync.Mutex
+	hooks    []namedHook
+	requests chan string
+}
+
+// NewLifecycle returns a new Lifecycle with given drain timeout.
+func NewLifecycle(drainTimeout time.Duration) *Lifecycle {
+	return &Lifecycle{
+		DrainTimeout: drainTimeout,
+		requests:     make(chan string, 1),
+	}
+}
+
+// PreShutdown registers a hook, which is run before server stops
+// accepting requests. Hooks are run in the order they are registered.
+func (l *Lifecycle) PreShutdown(name string, fn ShutdownHook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, namedHook{name: name, fn: fn})
+}
+
+// Shutdown requests a graceful shutdown. It does not wait for
+// shutdown to complete and it is safe to call multiple times.
+func (l *Lifecycle) Shutdown(reason string) {
+	select {
+	case l.requests <- reason:
+	default:
+	}
+}
+
+// Run serves srv on listeners until a shutdown signal is received or
+// Shutdown is called. It then runs shutdown hooks and drains in-flight
+// requests. Returned value is the exit code of the process.
+func (l *Lifecycle) Run(srv *http.Server, listeners ...net.Listener) int {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, shutdownSignals...)
+	defer signal.Stop(signals)
+
+	serveErrs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serveErrs <- err
+			}
+		}(listener)
+	}
+
+	var reason string
+	select {
+	case sig := <-signals:
+		log.Printf("[INFO] OS Signal: %s", sig)
+		if l.OnSignal != nil {
+			l.OnSignal(sig)
+		}
+		reason = "signal"
+	case reason = <-l.requests:
+		log.Printf("[INFO] Shutdown requested: %s", reason)
+	case err := <-serveErrs:
+		log.Printf("[ERROR] Failed to serve: %s", err)
+		srv.Close()
+		return exitStartupFailure
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.DrainTimeout)
+	defer cancel()
+
+	// A second signal forces shutdown.
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("[WARN] OS Signal: %s, forcing shutdown", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if code := l.drain(ctx, srv, reason); code != exitClean {
+		srv.Close()
+		return code
+	}
+	log.Printf("[INFO] Metadata server cleanup is complete")
+	return exitClean
+}
+
+// drain runs shutdown hooks and waits for in-flight requests to complete.
+func (l *Lifecycle) drain(ctx context.Context, srv *http.Server, reason string) int {
+	l.mu.Lock()
+	hooks := append([]namedHook(nil), l.hooks...)
+	l.mu.Unlock()
+
+	for _, hook := range hooks {
+		if err := hook.fn(ctx, reason); err != nil {
+			log.Printf("[ERROR] Shutdown hook %s failed: %s", hook.name, err)
+		}
+		if ctx.Err() != nil {
+			log.Printf("[WARN] Drain timeout exceeded while running shutdown hook %s", hook.name)
+			return exitForced
+		}
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("[WARN] Failed to drain in-flight requests: %s", err)
+		return exitForced
+	}
+	return exitClean
+}
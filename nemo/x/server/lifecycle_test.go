@@ -0,0 +1,231 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lifecycleClient does not keep connections alive, as a connection dialed
+// but not used yet would hold up shutdown for 5 seconds.
+var lifecycleClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+// runLifecycle runs l with a server which has a /slow endpoint taking
+// given duration. It returns server URL and a channel for the exit code.
+func runLifecycle(t *testing.T, l *Lifecycle, slow time.Duration) (string, <-chan int) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(slow)
+		w.Write([]byte("done"))
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	code := make(chan int, 1)
+	go func() {
+		code <- l.Run(&http.Server{Handler: mux}, listener)
+	}()
+
+	url := "http://" + listener.Addr().String()
+	// Signal handlers are installed before serving starts.
+	for i := 0; ; i++ {
+		resp, err := lifecycleClient.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("server did not start: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return url, code
+}
+
+// waitCode waits for exit code from Lifecycle.Run.
+func waitCode(t *testing.T, code <-chan int) int {
+	t.Helper()
+	select {
+	case c := <-code:
+		return c
+	case <-time.After(10 * time.Second):
+		t.Fatal("lifecycle did not stop")
+		return -1
+	}
+}
+
+func TestLifecycleSignals(t *testing.T) {
+	tests := []struct {
+		name string
+		sig  syscall.Signal
+	}{
+		{name: "SIGINT", sig: syscall.SIGINT},
+		{name: "SIGTERM", sig: syscall.SIGTERM},
+		{name: "SIGHUP", sig: syscall.SIGHUP},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewLifecycle(5 * time.Second)
+			var received os.Signal
+			l.OnSignal = func(sig os.Signal) { received = sig }
+			var calls []string
+			l.PreShutdown("first", func(ctx context.Context, reason string) error {
+				calls = append(calls, "first:"+reason)
+				return errors.New("hook errors are not fatal")
+			})
+			l.PreShutdown("second", func(ctx context.Context, reason string) error {
+				calls = append(calls, "second:"+reason)
+				return nil
+			})
+
+			_, code := runLifecycle(t, l, 0)
+			assert.Nil(t, syscall.Kill(os.Getpid(), tc.sig))
+
+			assert.Equal(t, exitClean, waitCode(t, code))
+			assert.Equal(t, tc.sig, received)
+			assert.Equal(t, []string{"first:signal", "second:signal"}, calls)
+		})
+	}
+}
+
+func TestLifecycleShutdownRequest(t *testing.T) {
+	l := NewLifecycle(5 * time.Second)
+	reason := ""
+	l.PreShutdown("reason", func(ctx context.Context, r string) error {
+		reason = r
+		return nil
+	})
+	_, code := runLifecycle(t, l, 0)
+	l.Shutdown("request")
+	l.Shutdown("ignored")
+	assert.Equal(t, exitClean, waitCode(t, code))
+	assert.Equal(t, "request", reason)
+}
+
+// startSlowRequest starts a request to /slow and waits until
+// server has received it.
+func startSlowRequest(t *testing.T, url string) <-chan error {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() {
+		resp, err := lifecycleClient.Get(url + "/slow")
+		if err != nil {
+			result <- err
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		}
+		result <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	return result
+}
+
+func TestLifecycleDrain(t *testing.T) {
+	l := NewLifecycle(5 * time.Second)
+	url, code := runLifecycle(t, l, 500*time.Millisecond)
+	result := startSlowRequest(t, url)
+
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	assert.Equal(t, exitClean, waitCode(t, code))
+	assert.Nil(t, <-result, "in-flight request must complete")
+}
+
+func TestLifecycleDrainTimeout(t *testing.T) {
+	l := NewLifecycle(200 * time.Millisecond)
+	url, code := runLifecycle(t, l, 5*time.Second)
+	result := startSlowRequest(t, url)
+
+	start := time.Now()
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	assert.Equal(t, exitForced, waitCode(t, code))
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.NotNil(t, <-result, "in-flight request must be aborted")
+}
+
+func TestLifecycleHookTimeout(t *testing.T) {
+	l := NewLifecycle(200 * time.Millisecond)
+	l.PreShutdown("stuck", func(ctx context.Context, reason string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	_, code := runLifecycle(t, l, 0)
+	l.Shutdown("request")
+	assert.Equal(t, exitForced, waitCode(t, code))
+}
+
+func TestLifecycleSecondSignal(t *testing.T) {
+	l := NewLifecycle(time.Minute)
+	url, code := runLifecycle(t, l, 5*time.Second)
+	result := startSlowRequest(t, url)
+
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGINT))
+	assert.Equal(t, exitForced, waitCode(t, code))
+	assert.NotNil(t, <-result)
+}
+
+func TestServerStartupFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	code := server(Options{
+		Port:      listener.Addr().(*net.TCPAddr).Port,
+		Scheduler: pbsScheduler{},
+		Env:       MapEnv(nil),
+	})
+	assert.Equal(t, exitStartupFailure, code)
+}
+
+func TestServerDrainEndsLongRequests(t *testing.T) {
+	s, ts := newTestServer(t)
+	result := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/walltime?wait=1h")
+		if err != nil {
+			result <- -1
+			return
+		}
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	s.Drain("test")
+	s.Drain("ignored")
+	select {
+	case status := <-result:
+		assert.Equal(t, http.StatusOK, status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("walltime wait did not end on drain")
+	}
+	history := s.events.History(0)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, EventShutdownRequested, history[0].Type)
+		assert.Equal(t, map[string]string{"reason": "test"}, history[0].Data)
+	}
+}
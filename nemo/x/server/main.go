@@ -1,177 +1,199 @@
 package main
 
 import (
-	"bufio"
-	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
-	"os/signal"
-	"strconv"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // Info Provide node and task info
 type Info struct {
 	Node NodeInfo `json:"node" yaml:"node" hcl:"node"`
 	Job  JobInfo  `json:"job" yaml:"job" hcl:"job"`
+	// Inconsistencies found in scheduler provided info
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty" hcl:"warnings"`
 }
 
 // NodeInfo Info on current node
 type NodeInfo struct {
-	Name  string `json:"name" yaml:"name" hcl:"name"`
-	Index int    `json:"index" yaml:"index" hcl:"index"`
-	PID   int    `json:"pid" yaml:"pid" hcl:"pid"`
+	Name string `json:"name" yaml:"name" hcl:"name"`
+	// Index of the node within the job, null if unknown
+	Index *int `json:"index" yaml:"index" hcl:"index"`
+	PID   int  `json:"pid" yaml:"pid" hcl:"pid"`
 }
 
-// JobInfo from PBS env variables
+// JobInfo from PBS env variables. Numeric fields are null
+// if scheduler does not provide them or provides invalid values,
+// see /diagnostics for the reason.
 type JobInfo struct {
 	// Name of the job
 	Name string `json:"name" yaml:"name" hcl:"name"`
 	// User who submitted the job
 	Authorization string `json:"authorization" yaml:"authorization" hcl:"authorization"`
 	Entitlement   string `json:"entitlement" yaml:"entitlement" hcl:"entitlement"`
-	ID            int    `json:"id" yaml:"id" hcl:"id"`
+	ID            *int   `json:"id" yaml:"id" hcl:"id"`
+	// ID of the job as used by the scheduler, which is unique for each
+	// element of job arrays, like 1234[5], empty if unknown
+	SchedulerID string `json:"schedulerId" yaml:"schedulerId" hcl:"schedulerId"`
 	// Number of nodes
-	NodeCount int      `json:"nodeCount" yaml:"nodeCount" hcl:"nodeCount"`
-	Nodes     []string `json:"nodes" yaml:"nodes" hcl:"nodes"`
-	PPN       int      `json:"ppn" yaml:"ppn" hcl:"ppn"`
+	NodeCount *int `json:"nodeCount" yaml:"nodeCount" hcl:"nodeCount"`
+	// Unique nodes allocated to the job
+	Nodes []string `json:"nodes" yaml:"nodes" hcl:"nodes"`
+	// Nodes in compact hostlist form, like node[001-004]
+	NodeList string `json:"nodeList" yaml:"nodeList" hcl:"nodeList"`
+	// Nodes along with slots allocated on each of them
+	Hosts []HostSlots `json:"hosts" yaml:"hosts" hcl:"hosts"`
+	// Total number of slots across all nodes
+	SlotCount *int `json:"slotCount" yaml:"slotCount" hcl:"slotCount"`
+	PPN       *int `json:"ppn" yaml:"ppn" hcl:"ppn"`
 	// Tasks
-	TaskCount int `json:"taskCount" yaml:"taskCount" hcl:"taskCount"`
-	Walltime  int `json:"walltime" yaml:"walltime" hcl:"walltime"`
+	TaskCount *int `json:"taskCount" yaml:"taskCount" hcl:"taskCount"`
+	// Walltime limit in seconds
+	Walltime *int `json:"walltime" yaml:"walltime" hcl:"walltime"`
 	// Job Queue
 	Queue string `json:"queue" yaml:"queue" hcl:"queue"`
+	// Job array the job is an element of, null if it is not
+	Array *JobArray `json:"array" yaml:"array" hcl:"array"`
 }
 
-// lookup env vars and typecast to int
-func lookupEnvInt(key string) int {
-	val, ok := os.LookupEnv(key)
-	if !ok {
-		return -1
-	}
-
-	if val, err := strconv.Atoi(val); err == nil {
-		return val
-	}
-	return -1
-}
-
-func nodefile2NodeList() []string {
-	nodefilePath, nodefileEnvPresent := os.LookupEnv("PBS_NODEFILE")
-	if !nodefileEnvPresent {
-		log.Printf("[ERROR] Nodefile not preset. Not running inside a job?")
-		return nil
-	}
-
-	file, err := os.Open(nodefilePath)
-	if err != nil {
-		log.Printf("[ERROR] Faied to opnen nodefile? check if job has not exceeded walltime")
-		return nil
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-	var nodes []string
-
-	for scanner.Scan() {
-		nodes = append(nodes, scanner.Text())
-	}
-	return nodes
-}
-
-// getHostname Get name of current host
-func getHostname() string {
+// getHostname Get name of current host, falling back to HOSTNAME of env.
+func getHostname(env Env) string {
 	host, err := os.Hostname()
 	if err == nil {
 		return host
 	}
 	log.Printf("[WARN] Failed to get nodename, %+v", err)
-	return os.Getenv("HOSTNAME")
-
+	return env.String("HOSTNAME")
 }
 
-func getJobInfo() Info {
-	return Info{
+// getJobInfo returns info on current node and job as reported by scheduler.
+// Variables are looked up in env and files they name, like PBS_NODEFILE,
+// are read from its filesystem.
+func getJobInfo(sched Scheduler, env Env) Info {
+	hostname := getHostname(env)
+	info := Info{
 		Node: NodeInfo{
-			Name:  getHostname(),
+			Name:  hostname,
 			PID:   os.Getpid(),
-			Index: lookupEnvInt("PBS_NODENUM"),
-		},
-		Job: JobInfo{
-			Name:          os.Getenv("PBS_JOBNAME"),
-			Authorization: os.Getenv("PBS_O_LOGNAME"),
-			Entitlement:   os.Getenv("MOAB_ACCOUNT"),
-			ID:            lookupEnvInt("MOAB_JOBID"),
-			NodeCount:     lookupEnvInt("PBS_NUM_NODES"),
-			Nodes:         nodefile2NodeList(),
-			PPN:           lookupEnvInt("PBS_NUM_PPN"),
-			TaskCount:     lookupEnvInt("PBS_NUM_PPN"),
-			Walltime:      lookupEnvInt("PBS_WALLTIME"),
-			Queue:         os.Getenv("PBS_QUEUE"),
+			Index: sched.NodeIndex(env, hostname),
 		},
+		Job: sched.JobInfo(env),
+	}
+	if v, ok := sched.(Validator); ok {
+		info.Warnings = v.Validate(env, info.Job)
+		for _, warning := range info.Warnings {
+			log.Printf("[WARN] %s", warning)
+		}
 	}
+	return info
 }
 
-func server(port int) {
-	log.Printf("[INFO] Running on port: %d with PID:%d", port, os.Getpid())
-	mux := http.NewServeMux()
-	s := http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// SIGNAL handlers
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-
-	go func() {
-		oscall := <-c
-		log.Printf("[INFO] OS Signal:%+v", oscall)
-		cancel()
-	}()
-
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[INFO] %s %s", r.Method, r.RequestURI)
-		w.Write([]byte("OK"))
-	})
-
-	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[INFO] %s %s", r.Method, r.RequestURI)
-		if err := json.NewEncoder(w).Encode(getJobInfo()); err != nil {
-			log.Printf("[ERROR] Failed to parse response to JSON")
-			w.WriteHeader(http.StatusInternalServerError)
+// cmdServe runs the metadata server.
+func cmdServe(args []string, stdout, stderr io.Writer, env Env) int {
+	var jobStart timeFlag
+	walltimeWarnings := durationsFlag{15 * time.Minute, 5 * time.Minute}
+
+	fs := newFlagSet("serve", stderr)
+	port := fs.Int("port", 8000, "Port to listen on, 0 to pick a free port")
+	schedName := fs.String("scheduler", "auto",
+		fmt.Sprintf("Scheduler backend (auto,%s)", strings.Join(schedulerNames(), ",")))
+	fs.Var(&jobStart, "job-start", "Job start time, in RFC3339 form or seconds since epoch (default: from scheduler or server start time)")
+	fs.Var(&walltimeWarnings, "walltime-warn", "Comma separated list of remaining walltime at which warnings are fired")
+	eventHistory := fs.Int("event-history", 256, "Number of events kept in history for /events clients to resume from")
+	tokenFile := fs.String("token-file", "", "File to write bearer token to (default: <runtime-dir>/<pid>.token)")
+	authRead := fs.Bool("auth-read", false, "Require bearer token on read only endpoints as well")
+	socket := fs.String("socket", "", "Unix socket to listen on in addition to TCP port, \"auto\" for <runtime-dir>/<pid>.sock (default: disabled)")
+	drainTimeout := fs.Duration("drain-timeout", 10*time.Second, "Time allowed for in-flight requests to complete on shutdown")
+	resourceWindow := fs.Duration("resource-window", time.Second, "Default window over which /node/resources samples CPU utilization")
+	var requiredEnv, peers, allowedSignals listFlag
+	fs.Var(&requiredEnv, "require-env", "Comma separated list of variables which must be set for /readyz to pass")
+	fs.Var(&peers, "ready-peer", "Comma separated list of host:port which must be reachable for /readyz to pass")
+	checkTimeout := fs.Duration("check-timeout", defaultCheckTimeout, "Time allowed for each health check")
+	checkjob := fs.String("checkjob", "checkjob", "Path of Moab checkjob executable")
+	nodeAddrs := addrsFlag{}
+	fs.Var(nodeAddrs, "node-addr", "Comma separated list of host=host:port of servers on other nodes (default: <host>:<port>)")
+	peerTimeout := fs.Duration("peer-timeout", defaultPeerTimeout, "Time allowed for each node to respond to /cluster")
+	head := fs.String("head", "", "Address, as host:port, of server on the head node to register with (default: <first node>:<port>)")
+	clusterTokenFile := fs.String("cluster-token-file", "", "File with token shared by servers on all nodes of the job, required for them to register with and forward requests to the head node")
+	memberTTL := fs.Duration("member-ttl", defaultMemberTTL, "Time after which nodes which stopped sending heartbeats are lost")
+	heartbeatInterval := fs.Duration("heartbeat-interval", defaultHeartbeatInterval, "Time between heartbeats sent to the head node")
+	qstat := fs.String("qstat", "qstat", "Path of Torque qstat executable")
+	pbsnodes := fs.String("pbsnodes", "pbsnodes", "Path of Torque pbsnodes executable")
+	fs.Var(&allowedSignals, "allow-signal", "Comma separated list of signals which may be sent to job processes over /signal (default: USR1,USR2)")
+	kvSnapshot := fs.String("kv-snapshot", "", "File to save key/value store to after every change and load it from on start (default: disabled)")
+	checkjobCache := fs.Duration("checkjob-cache", defaultCheckjobCache, "Time job details reported by checkjob are cached for")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitClean
 		}
-		w.Header().Set("Content-Type", "application/json")
-	})
+		return 2
+	}
 
-	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[INFO] %s %s", r.Method, r.RequestURI)
-		w.WriteHeader(http.StatusNoContent)
-		// Cancel the context on request
-		cancel()
-	})
-	go func() {
-		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("[INFO] Faied to start server! %+v", err)
+	sched, err := getScheduler(*schedName, env)
+	if err != nil {
+		log.Printf("[FATAL] %s", err)
+		return exitStartupFailure
+	}
+	dir, err := runtimeDir(env)
+	if err != nil {
+		log.Printf("[FATAL] %s", err)
+		return exitStartupFailure
+	}
+	if *tokenFile == "" {
+		*tokenFile = filepath.Join(dir, fmt.Sprintf("%d.token", os.Getpid()))
+	}
+	for _, name := range allowedSignals {
+		if _, err := parseSignal(name); err != nil {
+			log.Printf("[FATAL] Invalid -allow-signal: %s", err)
+			return exitStartupFailure
 		}
-	}()
-
-	select {
-	case <-ctx.Done():
-		// Shutdown the server when the context is canceled
-		if err := s.Shutdown(ctx); err == nil || err == context.Canceled {
-			log.Printf("[INFO] Metadata server cleanup is complete")
-		} else {
-			log.Fatalf("[FATAL] Failed to shutdown server: %+v", err)
+	}
+	var clusterToken string
+	if *clusterTokenFile != "" {
+		if clusterToken, err = readTokenFile(*clusterTokenFile); err != nil {
+			log.Printf("[FATAL] Failed to read cluster token: %s", err)
+			return exitStartupFailure
 		}
 	}
-	log.Printf("[INFO] Finished")
+	if *socket == "auto" {
+		*socket = filepath.Join(dir, fmt.Sprintf("%d.sock", os.Getpid()))
+	}
+	return server(Options{
+		Port:              *port,
+		Scheduler:         sched,
+		Env:               env,
+		JobStart:          jobStart.Time,
+		WalltimeWarnings:  walltimeWarnings,
+		EventHistory:      *eventHistory,
+		TokenFile:         *tokenFile,
+		AuthRead:          *authRead,
+		Socket:            *socket,
+		DrainTimeout:      *drainTimeout,
+		ResourceWindow:    *resourceWindow,
+		RuntimeDir:        dir,
+		RequiredEnv:       requiredEnv,
+		Peers:             peers,
+		CheckTimeout:      *checkTimeout,
+		Checkjob:          *checkjob,
+		CheckjobCache:     *checkjobCache,
+		NodeAddrs:         nodeAddrs,
+		PeerTimeout:       *peerTimeout,
+		Head:              *head,
+		ClusterToken:      clusterToken,
+		MemberTTL:         *memberTTL,
+		HeartbeatInterval: *heartbeatInterval,
+		Qstat:             *qstat,
+		Pbsnodes:          *pbsnodes,
+		KVSnapshot:        *kvSnapshot,
+		AllowedSignals:    allowedSignals,
+	})
 }
 
 func main() {
-	port := flag.Int("port", 8000, "Port to listen on")
-	flag.Parse()
-	server(*port)
+	os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr, NewEnv(os.LookupEnv)))
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMemberTTL is time after which nodes which stopped sending
+	// heartbeats are considered lost.
+	defaultMemberTTL = 30 * time.Second
+	// defaultHeartbeatInterval is time between heartbeats sent to the head node.
+	defaultHeartbeatInterval = 10 * time.Second
+	// maxRegistrationSize is maximum size of a registration request body.
+	maxRegistrationSize = 64 * 1024
+)
+
+// Registration is sent by servers on other nodes to the head node,
+// first to register and then periodically as heartbeat.
+type Registration struct {
+	// Name of the node
+	Name string `json:"name"`
+	// Index of the node within the job, null if unknown
+	Index *int `json:"index"`
+	// Port the server listens on
+	Port int `json:"port"`
+	PID  int `json:"pid"`
+}
+
+// Member is a node which registered with the head node.
+type Member struct {
+	Name  string `json:"name" yaml:"name" hcl:"name"`
+	Index *int   `json:"index" yaml:"index" hcl:"index"`
+	// Address of the server on the node, as host:port
+	Address      string    `json:"address" yaml:"address" hcl:"address"`
+	PID          int       `json:"pid" yaml:"pid" hcl:"pid"`
+	RegisteredAt time.Time `json:"registeredAt" yaml:"registeredAt" hcl:"registeredAt"`
+	LastSeen     time.Time `json:"lastSeen" yaml:"lastSeen" hcl:"lastSeen"`
+	Heartbeats   int       `json:"heartbeats" yaml:"heartbeats" hcl:"heartbeats"`
+	// Whether node sent a heartbeat within TTL
+	Alive bool `json:"alive" yaml:"alive" hcl:"alive"`
+	// Time at which node was found to have stopped sending heartbeats,
+	// null if it is alive
+	LostAt *time.Time `json:"lostAt" yaml:"lostAt" hcl:"lostAt"`
+}
+
+// Members is the membership table of the head node.
+type Members struct {
+	// Time in seconds after which nodes which stopped sending heartbeats are lost
+	TTL   float64 `json:"ttl" yaml:"ttl" hcl:"ttl"`
+	Alive int     `json:"alive" yaml:"alive" hcl:"alive"`
+	// Nodes which registered but stopped sending heartbeats
+	Lost []string `json:"lost" yaml:"lost" hcl:"lost"`
+	// Nodes of the job which never registered
+	Missing []string `json:"missing" yaml:"missing" hcl:"missing"`
+	Members []Member `json:"members" yaml:"members" hcl:"members"`
+}
+
+// Membership tracks nodes registered with the head node. Nodes which
+// do not send a heartbeat within TTL are marked lost, and are alive
+// again once they send one. Changes are published as events.
+type Membership struct {
+	ttl    time.Duration
+	events *EventBus
+	now    func() time.Time
+
+	mu      sync.Mutex
+	members map[string]*Member
+}
+
+// NewMembership returns Membership expiring nodes after ttl,
+// publishing changes to events.
+func NewMembership(ttl time.Duration, events *EventBus) *Membership {
+	if ttl <= 0 {
+		ttl = defaultMemberTTL
+	}
+	return &Membership{ttl: ttl, events: events, now: time.Now, members: make(map[string]*Member)}
+}
+
+// Register registers node, or records a heartbeat if it is
+// already registered. address is address of its server.
+func (m *Membership) Register(reg Registration, address string) Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	member, ok := m.members[reg.Name]
+	if !ok {
+		member = &Member{Name: reg.Name, RegisteredAt: now}
+		m.members[reg.Name] = member
+	}
+	// A restarted server registers with a new address and PID.
+	restarted := ok && (member.PID != reg.PID || member.Address != address)
+	rejoined := ok && !member.Alive
+	member.Index, member.Address, member.PID = reg.Index, address, reg.PID
+	member.LastSeen = now
+	member.Heartbeats++
+	member.Alive, member.LostAt = true, nil
+
+	if !ok || restarted || rejoined {
+		log.Printf("[INFO] Node %s registered from %s", member.Name, member.Address)
+		m.events.Publish(EventNodeRegistered, *member)
+	}
+	return *member
+}
+
+// Expire marks nodes which did not send a heartbeat within TTL as lost.
+func (m *Membership) Expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for _, member := range m.members {
+		if member.Alive && now.Sub(member.LastSeen) > m.ttl {
+			member.Alive = false
+			lostAt := now
+			member.LostAt = &lostAt
+			log.Printf("[WARN] Node %s was last seen at %s", member.Name, member.LastSeen.Format(time.RFC3339))
+			m.events.Publish(EventNodeLost, *member)
+		}
+	}
+}
+
+// List returns membership table, ordered by node index. Nodes of
+// the job which never registered, except head, are listed as missing.
+func (m *Membership) List(nodes []string, head string) Members {
+	m.Expire()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := Members{
+		TTL:     m.ttl.Seconds(),
+		Lost:    []string{},
+		Missing: []string{},
+		Members: make([]Member, 0, len(m.members)),
+	}
+	for _, member := range m.members {
+		list.Members = append(list.Members, *member)
+	}
+	sort.Slice(list.Members, func(i, j int) bool {
+		a, b := list.Members[i], list.Members[j]
+		if a.Index != nil && b.Index != nil && *a.Index != *b.Index {
+			return *a.Index < *b.Index
+		}
+		if (a.Index == nil) != (b.Index == nil) {
+			return a.Index != nil
+		}
+		return a.Name < b.Name
+	})
+	for _, member := range list.Members {
+		if member.Alive {
+			list.Alive++
+		} else {
+			list.Lost = append(list.Lost, member.Name)
+		}
+	}
+	for _, node := range nodes {
+		if _, ok := m.members[node]; !ok && node != head {
+			list.Missing = append(list.Missing, node)
+		}
+	}
+	return list
+}
+
+// Address returns address of server on node if it is alive.
+func (m *Membership) Address(node string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if member, ok := m.members[node]; ok && member.Alive {
+		return member.Address, true
+	}
+	return "", false
+}
+
+// Run expires nodes periodically until ctx is done.
+func (m *Membership) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.ttl / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Expire()
+		}
+	}
+}
+
+// handleRegister registers node sending the request with the head node.
+// Nodes send the same request periodically as heartbeat. Address of the
+// node's server is taken from address of the request and port it reports.
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reg Registration
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRegistrationSize)).Decode(&reg); err != nil {
+		http.Error(w, fmt.Sprintf("invalid registration: %s", err), http.StatusBadRequest)
+		return
+	}
+	if reg.Name == "" || reg.Port <= 0 || reg.Port > 65535 {
+		http.Error(w, "invalid registration: name and port are required", http.StatusBadRequest)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Requests over Unix socket come from this node.
+		host = "127.0.0.1"
+	}
+	member := s.members.Register(reg, net.JoinHostPort(host, strconv.Itoa(reg.Port)))
+	writeResponse(w, r, http.StatusOK, member)
+}
+
+// handleMembers returns membership table of the head node.
+func (s *Server) handleMembers(w http.ResponseWriter, r *http.Request) {
+	info := getJobInfo(s.opts.Scheduler, s.opts.Env)
+	var head string
+	if len(info.Job.Nodes) > 0 {
+		head = info.Job.Nodes[0]
+	}
+	writeResponse(w, r, http.StatusOK, s.members.List(info.Job.Nodes, head))
+}
+
+// isHead returns true if this is the head node, which is the first
+// node of the job, or the only one if its index is unknown.
+func isHead(info Info) bool {
+	if info.Node.Index != nil {
+		return *info.Node.Index == 0
+	}
+	return len(info.Job.Nodes) <= 1
+}
+
+// headAddress returns address of server on the head node. Head is
+// expected to listen on the same port as this server, unless Head
+// option is set. It returns empty string if this is the head node
+// or if its address is unknown.
+func (s *Server) headAddress(info Info) string {
+	if isHead(info) {
+		return ""
+	}
+	if s.opts.Head != "" {
+		return s.opts.Head
+	}
+	if len(info.Job.Nodes) == 0 || s.opts.Port <= 0 {
+		return ""
+	}
+	return net.JoinHostPort(info.Job.Nodes[0], strconv.Itoa(s.opts.Port))
+}
+
+// peerToken returns token used to authenticate with servers on other
+// nodes. It is the cluster token, as instance tokens are random and
+// differ between nodes. It is empty if cluster token is not set.
+func (s *Server) peerToken() string {
+	return s.opts.ClusterToken
+}
+
+// forwardedHeader marks requests forwarded to the head node,
+// so that they are never forwarded again.
+const forwardedHeader = "X-Nemo-Forwarded-By"
+
+// forwardToHead forwards request to server on the head node, along with
+// the cluster token. It returns false without writing a response if
+// cluster token is not set, address of the head node is unknown or
+// request was already forwarded.
+func (s *Server) forwardToHead(w http.ResponseWriter, r *http.Request, info Info) bool {
+	head := s.headAddress(info)
+	token := s.peerToken()
+	if head == "" || token == "" || r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme, req.URL.Host, req.Host = "http", head, head
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set(forwardedHeader, info.Node.Name)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[WARN] Failed to forward %s to head node at %s: %s", r.URL.Path, head, err)
+			http.Error(w, fmt.Sprintf("failed to forward to head node: %s", err), http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	return true
+}
+
+// Heartbeat registers this node with the head node and sends
+// heartbeats every HeartbeatInterval until ctx is done. port
+// is the port this server listens on. Nodes do not register
+// if cluster token is not set, as head node would reject them.
+func (s *Server) Heartbeat(ctx context.Context, port int) {
+	info := getJobInfo(s.opts.Scheduler, s.opts.Env)
+	head := s.headAddress(info)
+	if head == "" {
+		if !isHead(info) {
+			log.Printf("[WARN] Address of head node is unknown, not registering with it")
+		}
+		return
+	}
+	token := s.peerToken()
+	if token == "" {
+		log.Printf("[INFO] Cluster token is not set, not registering with head node at %s", head)
+		return
+	}
+
+	c := NewClient(head, token)
+	reg := Registration{Name: info.Node.Name, Index: info.Node.Index, Port: port, PID: os.Getpid()}
+	registered := false
+
+	ticker := time.NewTicker(s.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		reqCtx, cancel := context.WithTimeout(ctx, s.opts.HeartbeatInterval)
+		err := c.PostJSON(reqCtx, "/register", reg, nil)
+		cancel()
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("[WARN] Failed to send heartbeat to %s: %s", head, err)
+			registered = false
+		case err == nil && !registered:
+			log.Printf("[INFO] Registered with head node at %s", head)
+			registered = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
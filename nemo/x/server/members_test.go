@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eventTypes returns types of events in history of b.
+func eventTypes(b *EventBus) []EventType {
+	var types []EventType
+	for _, event := range b.History(0) {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestMembership(t *testing.T) {
+	events := NewEventBus(100)
+	m := NewMembership(30*time.Second, events)
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time { return now }
+
+	m.Register(Registration{Name: "n3", Index: intPtr(2), Port: 8000, PID: 30}, "10.0.0.3:8000")
+	m.Register(Registration{Name: "n2", Index: intPtr(1), Port: 8000, PID: 20}, "10.0.0.2:8000")
+	assert.Equal(t, []EventType{EventNodeRegistered, EventNodeRegistered}, eventTypes(events))
+
+	// Heartbeats do not publish events.
+	now = now.Add(20 * time.Second)
+	member := m.Register(Registration{Name: "n2", Index: intPtr(1), Port: 8000, PID: 20}, "10.0.0.2:8000")
+	assert.Equal(t, 2, member.Heartbeats)
+	assert.Equal(t, time.Unix(1700000000, 0), member.RegisteredAt)
+	assert.Len(t, events.History(0), 2)
+
+	now = now.Add(20 * time.Second)
+	list := m.List([]string{"n1", "n2", "n3", "n4"}, "n1")
+	assert.Equal(t, 30.0, list.TTL)
+	assert.Equal(t, 1, list.Alive)
+	assert.Equal(t, []string{"n3"}, list.Lost)
+	assert.Equal(t, []string{"n4"}, list.Missing)
+	if assert.Len(t, list.Members, 2) {
+		assert.Equal(t, "n2", list.Members[0].Name)
+		assert.True(t, list.Members[0].Alive)
+		assert.Nil(t, list.Members[0].LostAt)
+		assert.Equal(t, "n3", list.Members[1].Name)
+		assert.False(t, list.Members[1].Alive)
+		assert.Equal(t, &now, list.Members[1].LostAt)
+		assert.Equal(t, time.Unix(1700000000, 0), list.Members[1].LastSeen)
+	}
+	assert.Equal(t, []EventType{EventNodeRegistered, EventNodeRegistered, EventNodeLost}, eventTypes(events))
+	_, ok := m.Address("n3")
+	assert.False(t, ok, "lost nodes must not have an address")
+
+	// Lost node is expired only once, and is alive again once it is seen.
+	m.Expire()
+	assert.Len(t, events.History(0), 3)
+	m.Register(Registration{Name: "n3", Index: intPtr(2), Port: 8000, PID: 30}, "10.0.0.3:8000")
+	addr, ok := m.Address("n3")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.3:8000", addr)
+	assert.Equal(t, EventNodeRegistered, events.History(3)[0].Type)
+
+	// Restarted server registers again.
+	m.Register(Registration{Name: "n2", Index: intPtr(1), Port: 8001, PID: 21}, "10.0.0.2:8001")
+	assert.Len(t, events.History(0), 5)
+}
+
+func TestHandleRegister(t *testing.T) {
+	head := NewServer(Options{
+		Scheduler:    pbsScheduler{},
+		Env:          MapEnv(map[string]string{"PBS_NODENUM": "0", "PBS_NODEFILE": "/var/spool/pbs/aux/1.server"}),
+		Root:         nodeFS,
+		Token:        testToken,
+		ClusterToken: testClusterToken,
+	}, func() {})
+	ts := httptest.NewServer(head)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		code   int
+	}{
+		{name: "cluster-token", method: http.MethodPost, token: testClusterToken, body: `{"name":"n2","index":1,"port":8000,"pid":20}`, code: http.StatusOK},
+		{name: "instance-token", method: http.MethodPost, token: testToken, body: `{"name":"n2","index":1,"port":8000,"pid":20}`, code: http.StatusOK},
+		{name: "invalid-token", method: http.MethodPost, token: "guess", body: `{"name":"n2","port":8000}`, code: http.StatusUnauthorized},
+		{name: "missing-port", method: http.MethodPost, token: testClusterToken, body: `{"name":"n2"}`, code: http.StatusBadRequest},
+		{name: "malformed", method: http.MethodPost, token: testClusterToken, body: `{"name":`, code: http.StatusBadRequest},
+		{name: "get", method: http.MethodGet, token: testClusterToken, code: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, ts.URL+"/register", strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			resp, err := http.DefaultClient.Do(req)
+			if assert.Nil(t, err) {
+				resp.Body.Close()
+				assert.Equal(t, tc.code, resp.StatusCode)
+			}
+		})
+	}
+
+	var members Members
+	assert.Equal(t, http.StatusOK, getInto(t, ts, "/members", &members))
+	if assert.Len(t, members.Members, 1) {
+		assert.Equal(t, "127.0.0.1:8000", members.Members[0].Address)
+		assert.Equal(t, 2, members.Members[0].Heartbeats)
+	}
+	assert.Equal(t, []string{}, members.Missing)
+	assert.Equal(t, "127.0.0.1:8000", head.peerAddress("n2"), "cluster view must use registered address")
+}
+
+func TestHeartbeat(t *testing.T) {
+	head, headTS := newOptionsServer(t, Options{
+		Scheduler:    pbsScheduler{},
+		Env:          MapEnv(map[string]string{"PBS_NODENUM": "0"}),
+		ClusterToken: testClusterToken,
+		MemberTTL:    200 * time.Millisecond,
+	})
+	// Instance tokens differ between nodes.
+	node, _ := newOptionsServer(t, Options{
+		Scheduler:         pbsScheduler{},
+		Env:               MapEnv(map[string]string{"PBS_NODENUM": "1"}),
+		Token:             "node-token",
+		ClusterToken:      testClusterToken,
+		Head:              strings.TrimPrefix(headTS.URL, "http://"),
+		HeartbeatInterval: 20 * time.Millisecond,
+	})
+
+	_, events, cancelEvents := head.events.Subscribe(0)
+	defer cancelEvents()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	headCtx, cancelHead := context.WithCancel(context.Background())
+	defer cancelHead()
+	go head.members.Run(headCtx)
+	done := make(chan struct{})
+	go func() {
+		node.Heartbeat(ctx, 9000)
+		close(done)
+	}()
+
+	hostname, _ := os.Hostname()
+	select {
+	case event := <-events:
+		assert.Equal(t, EventNodeRegistered, event.Type)
+		member := event.Data.(Member)
+		assert.Equal(t, hostname, member.Name)
+		assert.Equal(t, intPtr(1), member.Index)
+		assert.Equal(t, "127.0.0.1:9000", member.Address)
+	case <-time.After(5 * time.Second):
+		t.Fatal("node did not register")
+	}
+
+	// Heartbeats keep the node alive beyond TTL.
+	time.Sleep(300 * time.Millisecond)
+	list := head.members.List(nil, "")
+	assert.Equal(t, 1, list.Alive)
+	assert.Greater(t, list.Members[0].Heartbeats, 2)
+
+	cancel()
+	<-done
+	select {
+	case event := <-events:
+		assert.Equal(t, EventNodeLost, event.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("node was not lost after heartbeats stopped")
+	}
+}
+
+func TestHeartbeatWithoutClusterToken(t *testing.T) {
+	head, headTS := newOptionsServer(t, Options{
+		Scheduler: pbsScheduler{},
+		Env:       MapEnv(map[string]string{"PBS_NODENUM": "0"}),
+	})
+	node, _ := newOptionsServer(t, Options{
+		Scheduler:         pbsScheduler{},
+		Env:               MapEnv(map[string]string{"PBS_NODENUM": "1"}),
+		Head:              strings.TrimPrefix(headTS.URL, "http://"),
+		HeartbeatInterval: 20 * time.Millisecond,
+	})
+
+	// Heartbeat returns without registering, even though ctx is not done.
+	done := make(chan struct{})
+	go func() {
+		node.Heartbeat(context.Background(), 9000)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat did not return without cluster token")
+	}
+	assert.Empty(t, head.members.List(nil, "").Members)
+}
+
+func TestIsHead(t *testing.T) {
+	tests := []struct {
+		name   string
+		index  *int
+		nodes  []string
+		expect bool
+	}{
+		{name: "first", index: intPtr(0), nodes: []string{"n1", "n2"}, expect: true},
+		{name: "other", index: intPtr(1), nodes: []string{"n1", "n2"}},
+		{name: "unknown-index-single-node", nodes: []string{"n1"}, expect: true},
+		{name: "unknown-index-unknown-nodes", expect: true},
+		{name: "unknown-index-many-nodes", nodes: []string{"n1", "n2"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			info := Info{Node: NodeInfo{Index: tc.index}, Job: JobInfo{Nodes: tc.nodes}}
+			assert.Equal(t, tc.expect, isHead(info))
+		})
+	}
+}
+
+func TestHeadAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		index  *int
+		nodes  []string
+		head   string
+		expect string
+	}{
+		{name: "head", index: intPtr(0), nodes: []string{"n1", "n2"}, expect: ""},
+		{name: "first-node", index: intPtr(1), nodes: []string{"n1", "n2"}, expect: "n1:8000"},
+		{name: "option", index: intPtr(1), nodes: []string{"n1", "n2"}, head: "10.0.0.1:9000", expect: "10.0.0.1:9000"},
+		{name: "unknown-index-single-node", nodes: []string{"n1"}, head: "10.0.0.1:9000", expect: ""},
+		{name: "unknown-index-many-nodes", nodes: []string{"n1", "n2"}, expect: "n1:8000"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer(Options{Scheduler: pbsScheduler{}, Env: MapEnv(nil), Port: 8000, Head: tc.head}, func() {})
+			info := Info{Node: NodeInfo{Index: tc.index}, Job: JobInfo{Nodes: tc.nodes}}
+			assert.Equal(t, tc.expect, s.headAddress(info))
+		})
+	}
+}
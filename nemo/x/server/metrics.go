@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsContentType is content type of Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are upper bounds of request latency histogram, in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestKey identifies a request counter.
+type requestKey struct {
+	path string
+	code int
+}
+
+// histogram is a Prometheus histogram with fixed buckets.
+type histogram struct {
+	// counts has a count per bucket, and one more for +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// Metrics collects HTTP request metrics of the server.
+type Metrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[string]*histogram
+}
+
+// NewMetrics returns empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestKey]uint64),
+		latencies: make(map[string]*histogram),
+	}
+}
+
+// Observe records a request to path, which completed with
+// given status code after duration d. path should be the pattern
+// the request was routed to, so that number of series is bounded.
+func (m *Metrics) Observe(path string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{path: path, code: code}]++
+	h, ok := m.latencies[path]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latencies[path] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// label is a metric label.
+type label struct {
+	name  string
+	value string
+}
+
+// labelEscaper escapes label values as required by text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricWriter writes metrics in Prometheus text exposition format.
+type metricWriter struct {
+	w *bufio.Writer
+}
+
+// family writes HELP and TYPE lines of a metric family.
+func (m metricWriter) family(name, typ, help string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample line.
+func (m metricWriter) sample(name string, value float64, labels ...label) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			fmt.Fprintf(m.w, `%s="%s"`, l.name, labelEscaper.Replace(l.value))
+		}
+		m.w.WriteByte('}')
+	}
+	m.w.WriteByte(' ')
+	m.w.WriteString(formatMetricValue(value))
+	m.w.WriteByte('\n')
+}
+
+// formatMetricValue formats v as a Prometheus sample value.
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write writes request metrics to mw.
+func (m *Metrics) write(mw metricWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].code < keys[j].code
+	})
+	mw.family("nemo_http_requests_total", "counter", "Total number of HTTP requests by path and status code.")
+	for _, key := range keys {
+		mw.sample("nemo_http_requests_total", float64(m.requests[key]),
+			label{"path", key.path}, label{"code", strconv.Itoa(key.code)})
+	}
+
+	paths := make([]string, 0, len(m.latencies))
+	for path := range m.latencies {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	mw.family("nemo_http_request_duration_seconds", "histogram", "HTTP request latency by path.")
+	for _, path := range paths {
+		h := m.latencies[path]
+		var cumulative uint64
+		for i, count := range h.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(latencyBuckets) {
+				le = latencyBuckets[i]
+			}
+			mw.sample("nemo_http_request_duration_seconds_bucket", float64(cumulative),
+				label{"path", path}, label{"le", formatMetricValue(le)})
+		}
+		mw.sample("nemo_http_request_duration_seconds_sum", h.sum, label{"path", path})
+		mw.sample("nemo_http_request_duration_seconds_count", float64(h.count), label{"path", path})
+	}
+}
+
+// statusRecorder records status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher, so that event streams work.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// handleMetrics returns metrics in Prometheus text exposition format.
+// Job gauges are omitted if they are not known.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	job := s.opts.Scheduler.JobInfo(s.opts.Env)
+
+	w.Header().Set("Content-Type", metricsContentType)
+	mw := metricWriter{w: bufio.NewWriter(w)}
+	defer mw.w.Flush()
+
+	s.metrics.write(mw)
+
+	mw.family("nemo_uptime_seconds", "gauge", "Time since the server started.")
+	mw.sample("nemo_uptime_seconds", time.Since(s.started).Seconds())
+
+	jobID := ""
+	if job.ID != nil {
+		jobID = strconv.Itoa(*job.ID)
+	}
+	mw.family("nemo_job_info", "gauge", "Job metadata, value is always 1.")
+	mw.sample("nemo_job_info", 1,
+		label{"scheduler", s.opts.Scheduler.Name()}, label{"job_id", jobID}, label{"name", job.Name})
+
+	if status := s.walltime.Status(); status.Limit != nil {
+		mw.family("nemo_job_walltime_limit_seconds", "gauge", "Walltime limit of the job.")
+		mw.sample("nemo_job_walltime_limit_seconds", float64(*status.Limit))
+		mw.family("nemo_job_walltime_remaining_seconds", "gauge", "Remaining walltime of the job.")
+		mw.sample("nemo_job_walltime_remaining_seconds", float64(*status.Remaining))
+	}
+	if job.NodeCount != nil {
+		mw.family("nemo_job_nodes", "gauge", "Number of nodes allocated to the job.")
+		mw.sample("nemo_job_nodes", float64(*job.NodeCount))
+	}
+	if job.SlotCount != nil {
+		mw.family("nemo_job_slots", "gauge", "Number of slots allocated to the job.")
+		mw.sample("nemo_job_slots", float64(*job.SlotCount))
+	}
+}
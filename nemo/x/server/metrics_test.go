@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// promSample is a sample parsed from text exposition format.
+type promSample struct {
+	name   string
+	labels string
+	value  float64
+}
+
+var (
+	promName   = `[a-zA-Z_:][a-zA-Z0-9_:]*`
+	promLabel  = `[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\[\\"n])*"`
+	promLabels = `\{(?:` + promLabel + `(?:,` + promLabel + `)*)?\}`
+	promHelp   = regexp.MustCompile(`^# HELP (` + promName + `) .*$`)
+	promType   = regexp.MustCompile(`^# TYPE (` + promName + `) (counter|gauge|histogram|summary|untyped)$`)
+	promLine   = regexp.MustCompile(`^(` + promName + `)(` + promLabels + `)? (\S+)$`)
+)
+
+// parseMetrics parses and validates text exposition format. It checks
+// that every sample belongs to a family declared with TYPE before it,
+// that samples of a family are contiguous and that histograms
+// are well formed.
+func parseMetrics(r io.Reader) (map[string][]promSample, error) {
+	var errs []string
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	families := map[string]string{}
+	samples := map[string][]promSample{}
+	current := ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if m := promHelp.FindStringSubmatch(text); m != nil {
+			continue
+		}
+		if m := promType.FindStringSubmatch(text); m != nil {
+			if _, ok := families[m[1]]; ok {
+				errorf("line %d: duplicate TYPE for %s", line, m[1])
+			}
+			families[m[1]] = m[2]
+			current = m[1]
+			continue
+		}
+		m := promLine.FindStringSubmatch(text)
+		if m == nil {
+			errorf("line %d: invalid line %q", line, text)
+			continue
+		}
+		family := m[1]
+		if families[current] == "histogram" {
+			family = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(family, "_bucket"), "_sum"), "_count")
+		}
+		if family != current {
+			errorf("line %d: sample %s outside of its family %s", line, m[1], current)
+		}
+		value, err := strconv.ParseFloat(strings.Replace(m[3], "Inf", "inf", 1), 64)
+		if err != nil {
+			errorf("line %d: invalid value %q", line, m[3])
+		}
+		samples[m[1]] = append(samples[m[1]], promSample{name: m[1], labels: m[2], value: value})
+	}
+
+	for name, typ := range families {
+		if typ != "histogram" {
+			continue
+		}
+		buckets := samples[name+"_bucket"]
+		counts := samples[name+"_count"]
+		if len(counts) == 0 {
+			continue
+		}
+		perSeries := len(buckets) / len(counts)
+		for i, count := range counts {
+			series := buckets[i*perSeries : (i+1)*perSeries]
+			for j := 1; j < len(series); j++ {
+				if series[j].value < series[j-1].value {
+					errorf("%s: buckets are not cumulative: %v", name, series)
+				}
+			}
+			last := series[len(series)-1]
+			if !strings.Contains(last.labels, `le="+Inf"`) || last.value != count.value {
+				errorf("%s: +Inf bucket %v does not match count %v", name, last, count)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid metrics:\n%s", strings.Join(errs, "\n"))
+	}
+	return samples, nil
+}
+
+// sampleValue returns value of sample with given labels, or NaN.
+func sampleValue(samples map[string][]promSample, name, labels string) float64 {
+	for _, s := range samples[name] {
+		if s.labels == labels {
+			return s.value
+		}
+	}
+	return math.NaN()
+}
+
+func TestHandleMetrics(t *testing.T) {
+	s := NewServer(Options{
+		Scheduler: pbsScheduler{},
+		Env: MapEnv(map[string]string{
+			"PBS_JOBID":     "42.server",
+			"PBS_JOBNAME":   "sim \"v2\"",
+			"PBS_NUM_NODES": "2",
+			"PBS_WALLTIME":  "3600",
+		}),
+		Token: testToken,
+	}, func() {})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for _, path := range []string{"/info", "/info", "/walltime", "/no-such-path"} {
+		resp, err := http.Get(ts.URL + path)
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+		}
+	}
+	resp, err := http.Post(ts.URL+"/shutdown", "", nil)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+	}
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, metricsContentType, resp.Header.Get("Content-Type"))
+
+	samples, err := parseMetrics(resp.Body)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 2.0, sampleValue(samples, "nemo_http_requests_total", `{path="/info",code="200"}`))
+	assert.Equal(t, 1.0, sampleValue(samples, "nemo_http_requests_total", `{path="/walltime",code="200"}`))
+	assert.Equal(t, 1.0, sampleValue(samples, "nemo_http_requests_total", `{path="/",code="200"}`),
+		"unknown paths must be counted under /")
+	assert.Equal(t, 1.0, sampleValue(samples, "nemo_http_requests_total", `{path="/shutdown",code="401"}`))
+	assert.Equal(t, 2.0, sampleValue(samples, "nemo_http_request_duration_seconds_count", `{path="/info"}`))
+	assert.Equal(t, 2.0, sampleValue(samples, "nemo_http_request_duration_seconds_bucket", `{path="/info",le="+Inf"}`))
+	assert.Equal(t, 1.0, sampleValue(samples, "nemo_job_info", `{scheduler="pbs",job_id="42",name="sim \"v2\""}`))
+	assert.Equal(t, 3600.0, sampleValue(samples, "nemo_job_walltime_limit_seconds", ""))
+	assert.InDelta(t, 3600.0, sampleValue(samples, "nemo_job_walltime_remaining_seconds", ""), 60)
+	assert.Equal(t, 2.0, sampleValue(samples, "nemo_job_nodes", ""))
+	assert.GreaterOrEqual(t, sampleValue(samples, "nemo_uptime_seconds", ""), 0.0)
+	assert.Empty(t, samples["nemo_job_slots"], "unknown slot count must be omitted")
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := NewMetrics()
+	for _, d := range []time.Duration{time.Millisecond, 5 * time.Millisecond, 300 * time.Millisecond, time.Minute} {
+		m.Observe("/info", http.StatusOK, d)
+	}
+	var b strings.Builder
+	mw := metricWriter{w: bufio.NewWriter(&b)}
+	m.write(mw)
+	mw.w.Flush()
+
+	samples, err := parseMetrics(strings.NewReader(b.String()))
+	if !assert.Nil(t, err) {
+		return
+	}
+	tests := []struct {
+		le    string
+		count float64
+	}{
+		{le: "0.005", count: 2},
+		{le: "0.25", count: 2},
+		{le: "0.5", count: 3},
+		{le: "10", count: 3},
+		{le: "+Inf", count: 4},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.count,
+			sampleValue(samples, "nemo_http_request_duration_seconds_bucket", fmt.Sprintf(`{path="/info",le="%s"}`, tc.le)),
+			"le=%s", tc.le)
+	}
+	assert.InDelta(t, 60.306, sampleValue(samples, "nemo_http_request_duration_seconds_sum", `{path="/info"}`), 1e-9)
+}
+
+func TestParseMetricsRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "no-type", input: "foo 1\n"},
+		{name: "bad-label", input: "# TYPE foo gauge\nfoo{bar=baz} 1\n"},
+		{name: "bad-value", input: "# TYPE foo gauge\nfoo one\n"},
+		{name: "histogram-not-cumulative", input: "# TYPE h histogram\n" +
+			"h_bucket{le=\"1\"} 2\nh_bucket{le=\"+Inf\"} 1\nh_sum 1\nh_count 1\n"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseMetrics(strings.NewReader(tc.input))
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCheckjobCache is time job details are cached for.
+const defaultCheckjobCache = 30 * time.Second
+
+// ErrNoJob is returned when job details are requested outside of a job.
+var ErrNoJob = errors.New("not running inside a job")
+
+// JobDetails are details of the job as reported by Moab checkjob.
+// Times and durations are null if Moab does not report them.
+type JobDetails struct {
+	ID      string `json:"id" yaml:"id" hcl:"id"`
+	Name    string `json:"name" yaml:"name" hcl:"name"`
+	User    string `json:"user" yaml:"user" hcl:"user"`
+	Group   string `json:"group" yaml:"group" hcl:"group"`
+	Account string `json:"account" yaml:"account" hcl:"account"`
+	Class   string `json:"class" yaml:"class" hcl:"class"`
+	// State like Running, Idle or Completed
+	State string `json:"state" yaml:"state" hcl:"state"`
+	// State the job is expected to be in, like Deferred
+	ExpectedState string `json:"expectedState" yaml:"expectedState" hcl:"expectedState"`
+	// Queue status like active, eligible or blocked
+	QueueStatus string `json:"queueStatus" yaml:"queueStatus" hcl:"queueStatus"`
+	// Holds on the job, like User or Batch
+	Holds        []string   `json:"holds" yaml:"holds" hcl:"holds"`
+	Reservations []string   `json:"reservations" yaml:"reservations" hcl:"reservations"`
+	SubmitTime   *time.Time `json:"submitTime" yaml:"submitTime" hcl:"submitTime"`
+	StartTime    *time.Time `json:"startTime" yaml:"startTime" hcl:"startTime"`
+	// Time the job has been queued for, in seconds
+	QueueDuration *int `json:"queueDuration" yaml:"queueDuration" hcl:"queueDuration"`
+	// Requested and used walltime in seconds
+	Walltime        *int `json:"walltime" yaml:"walltime" hcl:"walltime"`
+	WalltimeElapsed *int `json:"walltimeElapsed" yaml:"walltimeElapsed" hcl:"walltimeElapsed"`
+	// Nodes allocated to the job along with tasks on each of them
+	Nodes    []HostSlots       `json:"nodes" yaml:"nodes" hcl:"nodes"`
+	Requests []ResourceRequest `json:"requests" yaml:"requests" hcl:"requests"`
+	Messages []string          `json:"messages,omitempty" yaml:"messages,omitempty" hcl:"messages"`
+}
+
+// ResourceRequest is a resource requirement of the job.
+type ResourceRequest struct {
+	Index        int    `json:"index" yaml:"index" hcl:"index"`
+	TaskCount    *int   `json:"taskCount" yaml:"taskCount" hcl:"taskCount"`
+	ProcsPerTask *int   `json:"procsPerTask" yaml:"procsPerTask" hcl:"procsPerTask"`
+	TasksPerNode *int   `json:"tasksPerNode" yaml:"tasksPerNode" hcl:"tasksPerNode"`
+	NodeCount    *int   `json:"nodeCount" yaml:"nodeCount" hcl:"nodeCount"`
+	Partition    string `json:"partition" yaml:"partition" hcl:"partition"`
+	// Memory per task in MB
+	Memory   *int     `json:"memory" yaml:"memory" hcl:"memory"`
+	Features []string `json:"features" yaml:"features" hcl:"features"`
+	// Nodes allocated to this request along with tasks on each of them
+	Nodes []HostSlots `json:"nodes" yaml:"nodes" hcl:"nodes"`
+}
+
+// checkjobXML is output of checkjob --xml.
+type checkjobXML struct {
+	Jobs []struct {
+		JobID          string `xml:"JobID,attr"`
+		JobName        string `xml:"JobName,attr"`
+		User           string `xml:"User,attr"`
+		Group          string `xml:"Group,attr"`
+		Account        string `xml:"Account,attr"`
+		Class          string `xml:"Class,attr"`
+		State          string `xml:"State,attr"`
+		EState         string `xml:"EState,attr"`
+		QueueStatus    string `xml:"QueueStatus,attr"`
+		Hold           string `xml:"Hold,attr"`
+		ReqReservation string `xml:"ReqReservation,attr"`
+		Reservation    string `xml:"Reservation,attr"`
+		SubmissionTime string `xml:"SubmissionTime,attr"`
+		StartTime      string `xml:"StartTime,attr"`
+		ReqAWDuration  string `xml:"ReqAWDuration,attr"`
+		AWDuration     string `xml:"AWDuration,attr"`
+		AllocNodeList  string `xml:"AllocNodeList,attr"`
+		Requests       []struct {
+			TaskCount      string `xml:"TaskCount,attr"`
+			TCReqMin       string `xml:"TCReqMin,attr"`
+			ReqProcPerTask string `xml:"ReqProcPerTask,attr"`
+			TPN            string `xml:"TPN,attr"`
+			NCReqMin       string `xml:"NCReqMin,attr"`
+			ReqPartition   string `xml:"ReqPartition,attr"`
+			ReqMem         string `xml:"ReqMem,attr"`
+			ReqNodeFeature string `xml:"ReqNodeFeature,attr"`
+			AllocNodeList  string `xml:"AllocNodeList,attr"`
+		} `xml:"req"`
+		Messages []struct {
+			Message string `xml:"DATA,attr"`
+			Text    string `xml:",chardata"`
+		} `xml:"Messages>message"`
+	} `xml:"job"`
+}
+
+// parseCheckjob parses output of checkjob --xml into job details.
+// now is used to compute queue duration of jobs yet to start.
+func parseCheckjob(data []byte, now time.Time) (JobDetails, error) {
+	var out checkjobXML
+	if err := xml.Unmarshal(data, &out); err != nil {
+		return JobDetails{}, fmt.Errorf("invalid checkjob output: %w", err)
+	}
+	if len(out.Jobs) == 0 {
+		return JobDetails{}, errors.New("invalid checkjob output: no job found")
+	}
+	job := out.Jobs[0]
+
+	d := JobDetails{
+		ID:              job.JobID,
+		Name:            job.JobName,
+		User:            job.User,
+		Group:           job.Group,
+		Account:         job.Account,
+		Class:           job.Class,
+		State:           job.State,
+		ExpectedState:   job.EState,
+		QueueStatus:     job.QueueStatus,
+		Holds:           splitList(job.Hold, ","),
+		Reservations:    splitList(job.ReqReservation+","+job.Reservation, ","),
+		SubmitTime:      parseEpoch(job.SubmissionTime),
+		StartTime:       parseEpoch(job.StartTime),
+		Walltime:        parseOptionalInt(job.ReqAWDuration),
+		WalltimeElapsed: parseOptionalInt(job.AWDuration),
+		Nodes:           parseAllocNodeList(job.AllocNodeList),
+		Requests:        []ResourceRequest{},
+	}
+	if d.SubmitTime != nil {
+		end := now
+		if d.StartTime != nil {
+			end = *d.StartTime
+		}
+		if queued := int(end.Sub(*d.SubmitTime) / time.Second); queued >= 0 {
+			d.QueueDuration = &queued
+		}
+	}
+
+	for i, req := range job.Requests {
+		taskCount := parseOptionalInt(req.TaskCount)
+		if taskCount == nil {
+			taskCount = parseOptionalInt(req.TCReqMin)
+		}
+		r := ResourceRequest{
+			Index:        i,
+			TaskCount:    taskCount,
+			ProcsPerTask: parseOptionalInt(req.ReqProcPerTask),
+			TasksPerNode: parseOptionalInt(req.TPN),
+			NodeCount:    parseOptionalInt(req.NCReqMin),
+			Partition:    req.ReqPartition,
+			Memory:       parseOptionalInt(req.ReqMem),
+			Features:     splitList(req.ReqNodeFeature, "[]:,"),
+			Nodes:        parseAllocNodeList(req.AllocNodeList),
+		}
+		d.Requests = append(d.Requests, r)
+		// Older versions only report allocated nodes per request.
+		if job.AllocNodeList == "" {
+			for _, node := range r.Nodes {
+				d.Nodes = addSlots(d.Nodes, node.Name, node.Slots)
+			}
+		}
+	}
+	if d.Nodes == nil {
+		d.Nodes = []HostSlots{}
+	}
+
+	for _, m := range job.Messages {
+		if text := strings.TrimSpace(m.Message + m.Text); text != "" {
+			d.Messages = append(d.Messages, text)
+		}
+	}
+	return d, nil
+}
+
+// parseAllocNodeList parses list of allocated nodes of the form
+// "n1:4,n2:4" where number after colon is tasks on the node.
+// Tasks are unknown if they are not listed.
+func parseAllocNodeList(value string) []HostSlots {
+	var hosts []HostSlots
+	for _, item := range splitList(value, ",") {
+		name, tasks, _ := cut(item, ":")
+		hosts = addSlots(hosts, name, parseOptionalInt(tasks))
+	}
+	return hosts
+}
+
+// splitList splits value on any of separators, dropping empty items.
+func splitList(value, separators string) []string {
+	items := []string{}
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(separators, r)
+	}) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseOptionalInt parses an integer, returning nil if value is
+// empty or not an integer.
+func parseOptionalInt(value string) *int {
+	v, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// parseEpoch parses seconds since unix epoch. Moab reports
+// zero for times which are not yet known.
+func parseEpoch(value string) *time.Time {
+	v := parseOptionalInt(value)
+	if v == nil || *v <= 0 {
+		return nil
+	}
+	t := time.Unix(int64(*v), 0).UTC()
+	return &t
+}
+
+// Checkjob runs Moab checkjob and caches job details it reports.
+type Checkjob struct {
+	// Path of checkjob executable
+	Path string
+	// Time job details are cached for
+	TTL time.Duration
+	// Time allowed for checkjob to complete
+	Timeout time.Duration
+
+	now func() time.Time
+
+	mu      sync.Mutex
+	jobID   string
+	details JobDetails
+	fetched time.Time
+}
+
+// NewCheckjob returns Checkjob running executable at path,
+// caching its results for ttl.
+func NewCheckjob(path string, ttl time.Duration) *Checkjob {
+	if path == "" {
+		path = "checkjob"
+	}
+	return &Checkjob{Path: path, TTL: ttl, Timeout: defaultToolTimeout, now: time.Now}
+}
+
+// Details returns details of job jobID along with the time they were
+// fetched. Cached details are returned unless they are older than TTL
+// or refresh is set, in which case Moab is asked to bypass its cache
+// as well. Only one checkjob runs at a time.
+func (c *Checkjob) Details(ctx context.Context, jobID string, refresh bool) (JobDetails, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if !refresh && c.jobID == jobID && !c.fetched.IsZero() && now.Sub(c.fetched) < c.TTL {
+		return c.details, c.fetched, nil
+	}
+
+	args := []string{"--xml"}
+	if refresh {
+		args = append(args, "--blocking")
+	}
+	out, err := runTool(ctx, c.Timeout, c.Path, append(args, jobID)...)
+	if err != nil {
+		return JobDetails{}, time.Time{}, err
+	}
+
+	details, err := parseCheckjob(out, now)
+	if err != nil {
+		return JobDetails{}, time.Time{}, err
+	}
+	c.jobID, c.details, c.fetched = jobID, details, now
+	return details, now, nil
+}
+
+// handleJobDetails returns job details reported by Moab checkjob.
+// Query parameter refresh=true bypasses the cache.
+func (s *Server) handleJobDetails(w http.ResponseWriter, r *http.Request) {
+	refresh, _ := strconv.ParseBool(r.URL.Query().Get("refresh"))
+	job := s.opts.Scheduler.JobInfo(s.opts.Env)
+	if job.SchedulerID == "" {
+		http.Error(w, ErrNoJob.Error(), http.StatusNotFound)
+		return
+	}
+
+	details, fetched, err := s.checkjob.Details(r.Context(), job.SchedulerID, refresh)
+	if err != nil {
+		log.Printf("[ERROR] Failed to get job details: %s", err)
+		http.Error(w, err.Error(), toolStatus(err))
+		return
+	}
+	w.Header().Set("Last-Modified", fetched.UTC().Format(http.TimeFormat))
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(fetched)/time.Second)))
+	writeResponse(w, r, http.StatusOK, details)
+}
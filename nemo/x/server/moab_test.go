@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubCheckjob is the stub checkjob executable printing fixtures in testdata/moab.
+var stubCheckjob = filepath.Join("testdata", "moab", "checkjob")
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestParseCheckjob(t *testing.T) {
+	now := time.Unix(1700001000, 0)
+	tests := []struct {
+		name    string
+		fixture string
+		details JobDetails
+		err     bool
+	}{
+		{
+			name:    "running",
+			fixture: "1234.xml",
+			details: JobDetails{
+				ID: "1234", Name: "sim", User: "alice", Group: "hpc", Account: "physics", Class: "batch",
+				State: "Running", ExpectedState: "Running", QueueStatus: "active",
+				Holds: []string{}, Reservations: []string{"1234"},
+				SubmitTime:    timePtr(time.Unix(1700000000, 0).UTC()),
+				StartTime:     timePtr(time.Unix(1700000600, 0).UTC()),
+				QueueDuration: intPtr(600), Walltime: intPtr(3600), WalltimeElapsed: intPtr(1800),
+				Nodes: []HostSlots{{Name: "n1", Slots: intPtr(4)}, {Name: "n2", Slots: intPtr(4)}},
+				Requests: []ResourceRequest{
+					{
+						TaskCount: intPtr(8), ProcsPerTask: intPtr(1), TasksPerNode: intPtr(4), NodeCount: intPtr(2),
+						Partition: "cluster", Memory: intPtr(2048), Features: []string{"ib", "haswell"},
+						Nodes: []HostSlots{{Name: "n1", Slots: intPtr(4)}, {Name: "n2", Slots: intPtr(4)}},
+					},
+				},
+				Messages: []string{"job started on 2 nodes"},
+			},
+		},
+		{
+			name:    "held",
+			fixture: "1235.xml",
+			details: JobDetails{
+				ID: "1235", Name: "post", User: "alice", Group: "hpc", Account: "physics", Class: "batch",
+				State: "Idle", ExpectedState: "Deferred", QueueStatus: "blocked",
+				Holds: []string{"User", "Batch"}, Reservations: []string{"maint"},
+				SubmitTime:    timePtr(time.Unix(1700000000, 0).UTC()),
+				QueueDuration: intPtr(1000), Walltime: intPtr(600),
+				Nodes: []HostSlots{},
+				Requests: []ResourceRequest{
+					{
+						TaskCount: intPtr(2), ProcsPerTask: intPtr(2), NodeCount: intPtr(1),
+						Partition: "ALL", Features: []string{},
+					},
+					{Index: 1, TaskCount: intPtr(1), Memory: intPtr(512), Features: []string{}},
+				},
+			},
+		},
+		{
+			name:    "nodes-per-request",
+			fixture: "1236.xml",
+			details: JobDetails{
+				ID: "1236", Name: "old", User: "bob", State: "Running",
+				Holds: []string{}, Reservations: []string{},
+				SubmitTime:    timePtr(time.Unix(1700000000, 0).UTC()),
+				StartTime:     timePtr(time.Unix(1700000600, 0).UTC()),
+				QueueDuration: intPtr(600),
+				Nodes:         []HostSlots{{Name: "n3"}, {Name: "n4"}},
+				Requests: []ResourceRequest{
+					{TaskCount: intPtr(3), Features: []string{}, Nodes: []HostSlots{{Name: "n3"}, {Name: "n4"}}},
+				},
+			},
+		},
+		{name: "no-job", fixture: "1237.xml", err: true},
+		{name: "malformed", fixture: "1238.xml", err: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "moab", tc.fixture))
+			if !assert.Nil(t, err) {
+				return
+			}
+			details, err := parseCheckjob(data, now)
+			if tc.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.details, details)
+		})
+	}
+}
+
+func TestCheckjobCache(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	t.Setenv("CHECKJOB_CALLS", calls)
+	now := time.Unix(1700001000, 0)
+	c := NewCheckjob(stubCheckjob, time.Minute)
+	c.now = func() time.Time { return now }
+
+	countCalls := func() []string {
+		data, _ := os.ReadFile(calls)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	details, fetched, err := c.Details(context.Background(), "1234", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", details.ID)
+	assert.Equal(t, now, fetched)
+
+	now = now.Add(30 * time.Second)
+	_, fetched, err = c.Details(context.Background(), "1234", false)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(-30*time.Second), fetched, "details must be cached")
+	assert.Equal(t, []string{"--xml 1234"}, countCalls())
+
+	_, _, err = c.Details(context.Background(), "1234", true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"--xml 1234", "--xml --blocking 1234"}, countCalls())
+
+	now = now.Add(2 * time.Minute)
+	_, fetched, err = c.Details(context.Background(), "1234", false)
+	assert.Nil(t, err)
+	assert.Equal(t, now, fetched, "expired details must be refetched")
+	assert.Len(t, countCalls(), 3)
+
+	// Errors are not cached.
+	_, _, err = c.Details(context.Background(), "9", false)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "cannot locate job '9'")
+	}
+	_, _, err = c.Details(context.Background(), "9", false)
+	assert.NotNil(t, err)
+	assert.Len(t, countCalls(), 5)
+}
+
+func TestHandleJobDetails(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		checkjob string
+		code     int
+	}{
+		{name: "ok", env: map[string]string{"PBS_JOBID": "1234.server"}, checkjob: stubCheckjob, code: http.StatusOK},
+		{name: "no-job", env: map[string]string{}, checkjob: stubCheckjob, code: http.StatusNotFound},
+		{name: "unknown-job", env: map[string]string{"PBS_JOBID": "9.server"}, checkjob: stubCheckjob, code: http.StatusBadGateway},
+		{name: "array-element", env: map[string]string{"PBS_JOBID": "9[1].server"}, checkjob: stubCheckjob, code: http.StatusBadGateway},
+		{name: "bad-output", env: map[string]string{"PBS_JOBID": "1238.server"}, checkjob: stubCheckjob, code: http.StatusBadGateway},
+		{
+			name: "missing-binary", env: map[string]string{"PBS_JOBID": "1234.server"},
+			checkjob: "checkjob-does-not-exist", code: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer(Options{
+				Scheduler:     pbsScheduler{},
+				Env:           MapEnv(tc.env),
+				Root:          nodeFS,
+				Token:         testToken,
+				Checkjob:      tc.checkjob,
+				CheckjobCache: time.Minute,
+			}, func() {})
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+
+			if tc.code != http.StatusOK {
+				req, _ := http.NewRequest(http.MethodGet, ts.URL+"/job/details", nil)
+				req.Header.Set("Authorization", "Bearer "+testToken)
+				resp, err := http.DefaultClient.Do(req)
+				if assert.Nil(t, err) {
+					resp.Body.Close()
+					assert.Equal(t, tc.code, resp.StatusCode)
+				}
+				return
+			}
+
+			var details JobDetails
+			assert.Equal(t, tc.code, getInto(t, ts, "/job/details?refresh=true", &details))
+			assert.Equal(t, "1234", details.ID)
+			assert.Equal(t, "Running", details.State)
+			assert.Equal(t, []HostSlots{{Name: "n1", Slots: intPtr(4)}, {Name: "n2", Slots: intPtr(4)}}, details.Nodes)
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ErrPeerCredUnsupported is returned when peer credentials
+// are not available on the platform.
+var ErrPeerCredUnsupported = errors.New("peer credentials are not supported on this platform")
+
+// PeerCred is the credential of the process connected
+// over a Unix domain socket.
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
+}
+
+// connInfo is information about the connection a request came in on.
+type connInfo struct {
+	// unix is true if connection is over a Unix domain socket.
+	unix bool
+	// cred is credential of the peer, valid only if err is nil.
+	cred PeerCred
+	err  error
+}
+
+type connInfoKey struct{}
+
+// connContext returns ctx with connInfo of c attached.
+// It is meant to be used as http.Server.ConnContext.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	info := &connInfo{unix: true}
+	info.cred, info.err = getPeerCred(uc)
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// connInfoFrom returns connInfo attached to ctx by connContext.
+// It returns nil for connections other than Unix domain sockets.
+func connInfoFrom(ctx context.Context) *connInfo {
+	info, _ := ctx.Value(connInfoKey{}).(*connInfo)
+	return info
+}
+
+// listenUnix listens on a Unix domain socket at path, accessible only by
+// current user. Stale socket left behind by a previous instance is removed,
+// but it is an error if another instance is still listening on it.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// getPeerCred is not supported on this platform. All requests over
+// Unix domain socket are rejected.
+func getPeerCred(c *net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, ErrPeerCredUnsupported
+}
@@ -0,0 +1,136 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newSocketServer serves s on a Unix domain socket and returns
+// a client which connects to it.
+func newSocketServer(t *testing.T, s *Server) *http.Client {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nemo.sock")
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	hs := &http.Server{Handler: s, ConnContext: connContext}
+	go hs.Serve(l)
+	t.Cleanup(func() { hs.Close() })
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func TestGetPeerCred(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nemo.sock")
+	l, err := listenUnix(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	}
+
+	go func() {
+		c, err := net.Dial("unix", path)
+		if err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+	c, err := l.Accept()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	cred, err := getPeerCred(c.(*net.UnixConn))
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getuid(), cred.UID)
+	assert.Equal(t, os.Getgid(), cred.GID)
+	assert.Equal(t, os.Getpid(), cred.PID)
+}
+
+func TestSocketPeerAuthorization(t *testing.T) {
+	tests := []struct {
+		name     string
+		owner    int
+		method   string
+		path     string
+		status   int
+		shutdown bool
+	}{
+		{name: "owner-index", owner: os.Getuid(), method: http.MethodGet, path: "/", status: http.StatusOK},
+		{name: "owner-shutdown-without-token", owner: os.Getuid(), method: http.MethodPost, path: "/shutdown", status: http.StatusNoContent, shutdown: true},
+		{name: "other-index", owner: os.Getuid() + 1, method: http.MethodGet, path: "/", status: http.StatusForbidden},
+		{name: "other-info", owner: os.Getuid() + 1, method: http.MethodGet, path: "/info", status: http.StatusForbidden},
+		{name: "other-shutdown", owner: os.Getuid() + 1, method: http.MethodPost, path: "/shutdown", status: http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			shutdown := false
+			s := NewServer(Options{
+				Scheduler: pbsScheduler{},
+				Env:       MapEnv(map[string]string{"PBS_JOBID": "1"}),
+				Token:     testToken,
+				AuthRead:  true,
+			}, func() { shutdown = true })
+			s.auth.owner = tc.owner
+			client := newSocketServer(t, s)
+
+			r, _ := http.NewRequest(tc.method, "http://unix"+tc.path, nil)
+			resp, err := client.Do(r)
+			if !assert.Nil(t, err) {
+				return
+			}
+			resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+			assert.Equal(t, tc.shutdown, shutdown)
+		})
+	}
+}
+
+func TestListenUnixStale(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nemo.sock")
+
+	l, err := listenUnix(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = listenUnix(path)
+	assert.NotNil(t, err, "socket in use must not be replaced")
+
+	// Leave a stale socket file behind.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listenUnix(path)
+	if assert.Nil(t, err, "stale socket must be replaced") {
+		l.Close()
+	}
+
+	regular := filepath.Join(dir, "regular")
+	assert.Nil(t, os.WriteFile(regular, nil, 0o600))
+	_, err = listenUnix(regular)
+	assert.NotNil(t, err, "regular file must not be replaced")
+}
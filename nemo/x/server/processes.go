@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// clockTicks is USER_HZ, unit of CPU times in /proc/<pid>/stat.
+	// It is 100 on all architectures Linux supports.
+	clockTicks = 100
+
+	// Ways in which a process was found to belong to the job.
+	memberSession = "session"
+	memberPGroup  = "pgroup"
+	memberCgroup  = "cgroup"
+	memberEnviron = "environ"
+)
+
+// jobIDVars are variables holding job ID. Processes which have any
+// of them set to the same value as the server belong to the job.
+var jobIDVars = []string{"PBS_JOBID", "SLURM_JOB_ID", "SLURM_JOBID", "LSB_JOBID", "JOB_ID"}
+
+// processStates are descriptions of process states in /proc/<pid>/stat.
+var processStates = map[string]string{
+	"R": "running",
+	"S": "sleeping",
+	"D": "disk-sleep",
+	"Z": "zombie",
+	"T": "stopped",
+	"t": "tracing-stop",
+	"X": "dead",
+	"I": "idle",
+}
+
+// Process is a process belonging to the job.
+type Process struct {
+	PID  int `json:"pid" yaml:"pid" hcl:"pid"`
+	PPID int `json:"ppid" yaml:"ppid" hcl:"ppid"`
+	PGID int `json:"pgid" yaml:"pgid" hcl:"pgid"`
+	SID  int `json:"sid" yaml:"sid" hcl:"sid"`
+	// State like running, sleeping or zombie
+	State string `json:"state" yaml:"state" hcl:"state"`
+	// Executable name, truncated to 15 characters by the kernel
+	Command string `json:"command" yaml:"command" hcl:"command"`
+	// Command line arguments, empty for zombies and kernel threads
+	Cmdline []string `json:"cmdline" yaml:"cmdline" hcl:"cmdline"`
+	// Resident set size in bytes
+	RSS int64 `json:"rss" yaml:"rss" hcl:"rss"`
+	// User and system CPU time in seconds
+	CPUTime float64 `json:"cpuTime" yaml:"cpuTime" hcl:"cpuTime"`
+	Threads int     `json:"threads" yaml:"threads" hcl:"threads"`
+	// How the process was found to belong to the job, one or more
+	// of session, pgroup, cgroup and environ
+	Membership []string `json:"membership" yaml:"membership" hcl:"membership"`
+}
+
+// JobProcesses is the list of processes belonging to the job.
+type JobProcesses struct {
+	Count     int       `json:"count" yaml:"count" hcl:"count"`
+	Processes []Process `json:"processes" yaml:"processes" hcl:"processes"`
+}
+
+// procStat is parsed /proc/<pid>/stat.
+type procStat struct {
+	comm    string
+	state   string
+	ppid    int
+	pgrp    int
+	session int
+	utime   uint64
+	stime   uint64
+	threads int
+}
+
+// ProcessReader finds processes belonging to the job from /proc.
+type ProcessReader struct {
+	// Root filesystem, paths like proc/1/stat are read from it.
+	fs fs.FS
+	// PID of the server
+	self int
+	env  Env
+}
+
+// NewProcessReader returns ProcessReader which reads from root
+// filesystem fsys. self is PID of the server and env is
+// environment of the job.
+func NewProcessReader(fsys fs.FS, self int, env Env) *ProcessReader {
+	return &ProcessReader{fs: fsys, self: self, env: env}
+}
+
+// List returns processes belonging to the job, sorted by PID.
+// A process belongs to the job if it is in the session or process
+// group of the server's parent (usually the job script), if it is
+// in the job's cgroup, or if it has the same job ID variables as
+// the server in its environment.
+func (r *ProcessReader) List() ([]Process, error) {
+	self, err := r.stat(r.self)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stat of server: %w", err)
+	}
+	// Session of init is not the job's session, which happens
+	// when the server is daemonized.
+	var parent *procStat
+	if self.ppid > 1 {
+		if st, err := r.stat(self.ppid); err == nil && st.session > 1 {
+			parent = &st
+		}
+	}
+	jobCgroup := r.jobCgroup()
+	jobIDs := make(map[string]string)
+	for _, key := range jobIDVars {
+		if v := r.env.String(key); v != "" {
+			jobIDs[key] = v
+		}
+	}
+
+	entries, err := fs.ReadDir(r.fs, "proc")
+	if err != nil {
+		return nil, err
+	}
+	processes := []Process{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		// Processes may exit while they are being read.
+		st, err := r.stat(pid)
+		if err != nil {
+			continue
+		}
+
+		var membership []string
+		if parent != nil && st.session == parent.session {
+			membership = append(membership, memberSession)
+		}
+		if parent != nil && st.pgrp == parent.pgrp {
+			membership = append(membership, memberPGroup)
+		}
+		if jobCgroup != "" {
+			if p, ok := r.cgroupPath(pid); ok && (p == jobCgroup || strings.HasPrefix(p, jobCgroup+"/")) {
+				membership = append(membership, memberCgroup)
+			}
+		}
+		if len(jobIDs) > 0 && r.environMatches(pid, jobIDs) {
+			membership = append(membership, memberEnviron)
+		}
+		if len(membership) == 0 {
+			continue
+		}
+
+		state := st.state
+		if desc, ok := processStates[state]; ok {
+			state = desc
+		}
+		processes = append(processes, Process{
+			PID:        pid,
+			PPID:       st.ppid,
+			PGID:       st.pgrp,
+			SID:        st.session,
+			State:      state,
+			Command:    st.comm,
+			Cmdline:    r.cmdline(pid),
+			RSS:        r.rss(pid),
+			CPUTime:    float64(st.utime+st.stime) / clockTicks,
+			Threads:    st.threads,
+			Membership: membership,
+		})
+	}
+	sort.Slice(processes, func(i, j int) bool { return processes[i].PID < processes[j].PID })
+	return processes, nil
+}
+
+// stat reads /proc/<pid>/stat.
+func (r *ProcessReader) stat(pid int) (procStat, error) {
+	data, err := fs.ReadFile(r.fs, path.Join("proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	return parseProcStat(data)
+}
+
+// parseProcStat parses /proc/<pid>/stat. Command may contain spaces
+// and parentheses, so fields are split after its closing parenthesis.
+func parseProcStat(data []byte) (procStat, error) {
+	var st procStat
+	s := strings.TrimSpace(string(data))
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return st, fmt.Errorf("invalid stat: %q", s)
+	}
+	st.comm = s[open+1 : end]
+	// Fields after command, starting from state, which is field 3.
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 18 {
+		return st, fmt.Errorf("invalid stat: %q", s)
+	}
+	st.state = fields[0]
+
+	ints := []struct {
+		field int
+		dest  *int
+	}{
+		{4, &st.ppid}, {5, &st.pgrp}, {6, &st.session}, {20, &st.threads},
+	}
+	for _, f := range ints {
+		v, err := strconv.Atoi(fields[f.field-3])
+		if err != nil {
+			return st, fmt.Errorf("invalid field %d in stat: %w", f.field, err)
+		}
+		*f.dest = v
+	}
+	var err error
+	if st.utime, err = strconv.ParseUint(fields[14-3], 10, 64); err != nil {
+		return st, fmt.Errorf("invalid utime in stat: %w", err)
+	}
+	if st.stime, err = strconv.ParseUint(fields[15-3], 10, 64); err != nil {
+		return st, fmt.Errorf("invalid stime in stat: %w", err)
+	}
+	return st, nil
+}
+
+// cmdline returns command line arguments of pid.
+func (r *ProcessReader) cmdline(pid int) []string {
+	data, err := fs.ReadFile(r.fs, path.Join("proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil || len(data) == 0 {
+		return []string{}
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+}
+
+// rss returns resident set size of pid in bytes, from VmRSS
+// in /proc/<pid>/status. It is 0 for kernel threads and zombies.
+func (r *ProcessReader) rss(pid int) int64 {
+	data, err := fs.ReadFile(r.fs, path.Join("proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := cut(scanner.Text(), ":")
+		if !ok || key != "VmRSS" {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return 0
+		}
+		kb, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}
+
+// cgroupPath returns cgroup v2 path of pid.
+func (r *ProcessReader) cgroupPath(pid int) (string, bool) {
+	data, err := fs.ReadFile(r.fs, path.Join("proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", false
+	}
+	return parseCgroupPath(data)
+}
+
+// jobCgroup returns cgroup of the job, which is the ancestor of server's
+// cgroup named after the job ID, like job_42 for Slurm or 42.server for
+// PBS. It is empty if server is not in a cgroup named after the job,
+// as the cgroup would then hold processes outside of the job.
+func (r *ProcessReader) jobCgroup() string {
+	cgPath, ok := r.cgroupPath(r.self)
+	if !ok {
+		return ""
+	}
+	var ids []string
+	for _, key := range jobIDVars {
+		if v := r.env.String(key); v != "" {
+			ids = append(ids, v)
+		}
+	}
+	components := strings.Split(cgPath, "/")
+	for i, c := range components {
+		for _, id := range ids {
+			if c == id || c == "job_"+id || strings.HasPrefix(c, id+".") {
+				return strings.Join(components[:i+1], "/")
+			}
+		}
+	}
+	return ""
+}
+
+// environMatches returns true if environment of pid has any of the
+// variables in ids with the same value. Environment of processes
+// owned by other users is not readable, and they never match.
+func (r *ProcessReader) environMatches(pid int, ids map[string]string) bool {
+	data, err := fs.ReadFile(r.fs, path.Join("proc", strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return false
+	}
+	for _, kv := range strings.Split(string(data), "\x00") {
+		key, value, ok := cut(kv, "=")
+		if ok && ids[key] != "" && ids[key] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// writeProcessTree writes processes as a tree, like pstree. Processes
+// whose parent is not in the list are roots.
+func writeProcessTree(w io.Writer, processes []Process) {
+	byPID := make(map[int]bool, len(processes))
+	for _, p := range processes {
+		byPID[p.PID] = true
+	}
+	children := make(map[int][]Process)
+	var roots []Process
+	for _, p := range processes {
+		if byPID[p.PPID] && p.PPID != p.PID {
+			children[p.PPID] = append(children[p.PPID], p)
+		} else {
+			roots = append(roots, p)
+		}
+	}
+
+	var walk func(p Process, prefix, branch, indent string)
+	walk = func(p Process, prefix, branch, indent string) {
+		command := strings.Join(p.Cmdline, " ")
+		if command == "" {
+			command = "[" + p.Command + "]"
+		}
+		fmt.Fprintf(w, "%s%s%d %s (%s, rss=%s, cpu=%.2fs, via=%s)\n",
+			prefix, branch, p.PID, command, p.State, formatBytes(p.RSS), p.CPUTime, strings.Join(p.Membership, ","))
+		kids := children[p.PID]
+		for i, child := range kids {
+			if i == len(kids)-1 {
+				walk(child, prefix+indent, "└─ ", "   ")
+			} else {
+				walk(child, prefix+indent, "├─ ", "│  ")
+			}
+		}
+	}
+	for _, root := range roots {
+		walk(root, "", "", "")
+	}
+}
+
+// formatBytes formats n bytes in binary units, like 1.5MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// handleProcesses lists processes belonging to the job. With view=tree
+// query parameter, processes are returned as a plain text tree.
+func (s *Server) handleProcesses(w http.ResponseWriter, r *http.Request) {
+	view := r.URL.Query().Get("view")
+	if view != "" && view != "tree" && view != "list" {
+		http.Error(w, "view must be one of tree, list", http.StatusBadRequest)
+		return
+	}
+
+	processes, err := s.processes.List()
+	if err != nil {
+		log.Printf("[ERROR] Failed to list processes: %s", err)
+		http.Error(w, "failed to list processes", http.StatusInternalServerError)
+		return
+	}
+
+	if view == "tree" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeProcessTree(w, processes)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, JobProcesses{Count: len(processes), Processes: processes})
+}
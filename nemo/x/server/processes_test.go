@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFixtureProcessReader returns ProcessReader for testdata/node,
+// where server is PID 101 started by job script PID 100.
+func newFixtureProcessReader(env map[string]string) *ProcessReader {
+	return NewProcessReader(os.DirFS("testdata/node"), 101, MapEnv(env))
+}
+
+func TestProcessReaderMembership(t *testing.T) {
+	all := []string{memberSession, memberPGroup, memberCgroup, memberEnviron}
+	tests := []struct {
+		name       string
+		env        map[string]string
+		membership map[int][]string
+	}{
+		{
+			name: "slurm",
+			env:  map[string]string{"SLURM_JOB_ID": "42"},
+			membership: map[int][]string{
+				90:  {memberCgroup},
+				100: all,
+				101: all,
+				102: all,
+				103: all,
+				104: {memberEnviron},
+				105: {memberCgroup},
+				108: {memberSession, memberPGroup, memberCgroup},
+			},
+		},
+		{
+			name: "no-job-id",
+			env:  map[string]string{},
+			membership: map[int][]string{
+				100: {memberSession, memberPGroup},
+				101: {memberSession, memberPGroup},
+				102: {memberSession, memberPGroup},
+				103: {memberSession, memberPGroup},
+				108: {memberSession, memberPGroup},
+			},
+		},
+		{
+			name: "other-job",
+			env:  map[string]string{"SLURM_JOB_ID": "41"},
+			membership: map[int][]string{
+				100: {memberSession, memberPGroup},
+				101: {memberSession, memberPGroup},
+				102: {memberSession, memberPGroup},
+				103: {memberSession, memberPGroup},
+				106: {memberEnviron},
+				108: {memberSession, memberPGroup},
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			processes, err := newFixtureProcessReader(tc.env).List()
+			if !assert.Nil(t, err) {
+				return
+			}
+			membership := make(map[int][]string)
+			for _, p := range processes {
+				membership[p.PID] = p.Membership
+			}
+			assert.Equal(t, tc.membership, membership)
+		})
+	}
+}
+
+func TestProcessReaderFields(t *testing.T) {
+	processes, err := newFixtureProcessReader(map[string]string{"SLURM_JOB_ID": "42"}).List()
+	if !assert.Nil(t, err) {
+		return
+	}
+	byPID := make(map[int]Process)
+	for _, p := range processes {
+		byPID[p.PID] = p
+	}
+
+	assert.Equal(t, Process{
+		PID:        103,
+		PPID:       102,
+		PGID:       100,
+		SID:        100,
+		State:      "running",
+		Command:    "python",
+		Cmdline:    []string{"python", "train.py", "--rank", "0"},
+		RSS:        2097152 * 1024,
+		CPUTime:    910,
+		Threads:    12,
+		Membership: []string{memberSession, memberPGroup, memberCgroup, memberEnviron},
+	}, byPID[103])
+
+	assert.Equal(t, "worker (x) y", byPID[105].Command, "command with parentheses")
+	assert.Equal(t, "disk-sleep", byPID[105].State)
+
+	zombie := byPID[108]
+	assert.Equal(t, "zombie", zombie.State)
+	assert.Equal(t, []string{}, zombie.Cmdline)
+	assert.Equal(t, int64(0), zombie.RSS)
+}
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   bool
+	}{
+		{name: "valid", input: "1 (a) S 0 1 1 0 -1 0 0 0 0 0 10 20 0 0 20 0 1 0 1 0 0"},
+		{name: "no-command", input: "1 a S 0 1 1", err: true},
+		{name: "truncated", input: "1 (a) S 0 1 1 0", err: true},
+		{name: "invalid-ppid", input: "1 (a) S x 1 1 0 -1 0 0 0 0 0 10 20 0 0 20 0 1 0 1 0 0", err: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			st, err := parseProcStat([]byte(tc.input))
+			if tc.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, procStat{comm: "a", state: "S", pgrp: 1, session: 1, utime: 10, stime: 20, threads: 1}, st)
+		})
+	}
+}
+
+func TestWriteProcessTree(t *testing.T) {
+	processes, err := newFixtureProcessReader(map[string]string{"SLURM_JOB_ID": "42"}).List()
+	if !assert.Nil(t, err) {
+		return
+	}
+	var b strings.Builder
+	writeProcessTree(&b, processes)
+	expected := `90 slurmstepd: [42.0] (sleeping, rss=7.8MiB, cpu=0.15s, via=cgroup)
+└─ 100 /bin/bash /var/spool/slurmd/job00042/slurm_script (sleeping, rss=3.4MiB, cpu=0.30s, via=session,pgroup,cgroup,environ)
+   ├─ 101 nemo -port 8000 (sleeping, rss=20.0MiB, cpu=2.00s, via=session,pgroup,cgroup,environ)
+   └─ 102 mpirun -np 2 python train.py (sleeping, rss=10.0MiB, cpu=4.00s, via=session,pgroup,cgroup,environ)
+      └─ 103 python train.py --rank 0 (running, rss=2.0GiB, cpu=910.00s, via=session,pgroup,cgroup,environ)
+         └─ 108 [defunct] (zombie, rss=0B, cpu=0.02s, via=session,pgroup,cgroup)
+104 python train.py --rank 1 (running, rss=1.0GiB, cpu=455.00s, via=environ)
+105 worker (disk-sleep, rss=512.0KiB, cpu=2.00s, via=cgroup)
+`
+	assert.Equal(t, expected, b.String())
+}
+
+func TestHandleProcesses(t *testing.T) {
+	s := NewServer(Options{
+		Scheduler: slurmScheduler{},
+		Env:       MapEnv(map[string]string{"SLURM_JOB_ID": "42"}),
+		Root:      os.DirFS("testdata/node"),
+	}, func() {})
+	s.processes.self = 101
+
+	tests := []struct {
+		name        string
+		query       string
+		status      int
+		contentType string
+	}{
+		{name: "json", status: http.StatusOK, contentType: "application/json"},
+		{name: "list", query: "?view=list", status: http.StatusOK, contentType: "application/json"},
+		{name: "tree", query: "?view=tree", status: http.StatusOK, contentType: "text/plain; charset=utf-8"},
+		{name: "invalid", query: "?view=graph", status: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/processes"+tc.query, nil))
+			assert.Equal(t, tc.status, w.Code)
+			if tc.status != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tc.contentType, w.Header().Get("Content-Type"))
+			if tc.name == "tree" {
+				assert.True(t, strings.HasPrefix(w.Body.String(), "90 slurmstepd"))
+				return
+			}
+			var list JobProcesses
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &list))
+			assert.Equal(t, 8, list.Count)
+			assert.Len(t, list.Processes, 8)
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultResourceWindow is the default window over which
+	// CPU utilization is sampled.
+	defaultResourceWindow = time.Second
+	// maxResourceWindow is the maximum window clients may request.
+	maxResourceWindow = 10 * time.Second
+)
+
+// NodeResources is resource usage of the node, and of the job
+// if it runs in a cgroup v2 hierarchy.
+type NodeResources struct {
+	Load   LoadAverage `json:"load" yaml:"load" hcl:"load"`
+	Memory MemoryUsage `json:"memory" yaml:"memory" hcl:"memory"`
+	CPU    CPUUsage    `json:"cpu" yaml:"cpu" hcl:"cpu"`
+	// Cgroup of the job, nil if not in a cgroup v2 hierarchy
+	Cgroup *CgroupUsage `json:"cgroup,omitempty" yaml:"cgroup,omitempty" hcl:"cgroup"`
+}
+
+// LoadAverage is system load average from /proc/loadavg.
+type LoadAverage struct {
+	Load1  float64 `json:"load1" yaml:"load1" hcl:"load1"`
+	Load5  float64 `json:"load5" yaml:"load5" hcl:"load5"`
+	Load15 float64 `json:"load15" yaml:"load15" hcl:"load15"`
+	// Currently runnable scheduling entities
+	Running int `json:"running" yaml:"running" hcl:"running"`
+	// Scheduling entities which currently exist
+	Total int `json:"total" yaml:"total" hcl:"total"`
+}
+
+// MemoryUsage is memory usage of the node in bytes, from /proc/meminfo.
+type MemoryUsage struct {
+	Total     int64 `json:"total" yaml:"total" hcl:"total"`
+	Free      int64 `json:"free" yaml:"free" hcl:"free"`
+	Available int64 `json:"available" yaml:"available" hcl:"available"`
+	// Memory not available for new allocations
+	Used      int64 `json:"used" yaml:"used" hcl:"used"`
+	SwapTotal int64 `json:"swapTotal" yaml:"swapTotal" hcl:"swapTotal"`
+	SwapFree  int64 `json:"swapFree" yaml:"swapFree" hcl:"swapFree"`
+}
+
+// CPUUsage is CPU utilization of the node over a sampling window.
+// Utilization is fraction of time CPUs were busy, from 0 to 1.
+type CPUUsage struct {
+	// Number of online CPUs
+	Count int `json:"count" yaml:"count" hcl:"count"`
+	// Sampling window in seconds
+	Window      float64          `json:"window" yaml:"window" hcl:"window"`
+	Utilization float64          `json:"utilization" yaml:"utilization" hcl:"utilization"`
+	PerCPU      []CPUUtilization `json:"perCpu" yaml:"perCpu" hcl:"perCpu"`
+}
+
+// CPUUtilization is utilization of a single CPU.
+type CPUUtilization struct {
+	CPU         int     `json:"cpu" yaml:"cpu" hcl:"cpu"`
+	Utilization float64 `json:"utilization" yaml:"utilization" hcl:"utilization"`
+}
+
+// CgroupUsage is resource usage and limits of the job's cgroup.
+// Values which are unknown or unlimited are null.
+type CgroupUsage struct {
+	// Path of the cgroup, relative to cgroup2 mount
+	Path string `json:"path" yaml:"path" hcl:"path"`
+	// CPUs the cgroup may run on, in cpuset list form like 0-3,8
+	CPUs     string `json:"cpus" yaml:"cpus" hcl:"cpus"`
+	CPUCount *int   `json:"cpuCount" yaml:"cpuCount" hcl:"cpuCount"`
+	// Memory limit in bytes, the lowest limit of the cgroup and its ancestors
+	MemoryMax     *int64 `json:"memoryMax" yaml:"memoryMax" hcl:"memoryMax"`
+	MemoryCurrent *int64 `json:"memoryCurrent" yaml:"memoryCurrent" hcl:"memoryCurrent"`
+	PidsCurrent   *int64 `json:"pidsCurrent" yaml:"pidsCurrent" hcl:"pidsCurrent"`
+}
+
+// cpuTimes is time spent by a CPU, in USER_HZ.
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+// ResourceReader reads node resources from /proc and /sys/fs/cgroup.
+type ResourceReader struct {
+	// Root filesystem, paths like proc/meminfo are read from it.
+	fs fs.FS
+	// Default sampling window of CPU utilization
+	window time.Duration
+	// sleep waits for d or until ctx is done.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewResourceReader returns ResourceReader which reads from root
+// filesystem fsys. If window is zero, defaultResourceWindow is used.
+func NewResourceReader(fsys fs.FS, window time.Duration) *ResourceReader {
+	if window <= 0 {
+		window = defaultResourceWindow
+	}
+	return &ResourceReader{fs: fsys, window: window, sleep: sleepContext}
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Read reads node resources. CPU utilization is sampled over window,
+// default window of the reader is used if it is zero.
+func (r *ResourceReader) Read(ctx context.Context, window time.Duration) (NodeResources, error) {
+	if window <= 0 {
+		window = r.window
+	}
+	var res NodeResources
+
+	data, err := fs.ReadFile(r.fs, "proc/loadavg")
+	if err != nil {
+		return res, err
+	}
+	if res.Load, err = parseLoadAvg(data); err != nil {
+		return res, err
+	}
+
+	data, err = fs.ReadFile(r.fs, "proc/meminfo")
+	if err != nil {
+		return res, err
+	}
+	if res.Memory, err = parseMeminfo(data); err != nil {
+		return res, err
+	}
+
+	before, err := r.cpuTimes()
+	if err != nil {
+		return res, err
+	}
+	if err := r.sleep(ctx, window); err != nil {
+		return res, err
+	}
+	after, err := r.cpuTimes()
+	if err != nil {
+		return res, err
+	}
+	res.CPU = cpuUsage(before, after)
+	res.CPU.Window = window.Seconds()
+
+	res.Cgroup = r.cgroup()
+	return res, nil
+}
+
+// cpuTimes reads times of all CPUs from /proc/stat.
+func (r *ResourceReader) cpuTimes() (map[int]cpuTimes, error) {
+	data, err := fs.ReadFile(r.fs, "proc/stat")
+	if err != nil {
+		return nil, err
+	}
+	return parseStat(data)
+}
+
+// cgroup returns usage of cgroup of the current process,
+// or nil if it is not in a cgroup v2 hierarchy.
+func (r *ResourceReader) cgroup() *CgroupUsage {
+	data, err := fs.ReadFile(r.fs, "proc/self/cgroup")
+	if err != nil {
+		return nil
+	}
+	cgPath, ok := parseCgroupPath(data)
+	if !ok {
+		return nil
+	}
+	dir := path.Join("sys/fs/cgroup", cgPath)
+	if _, err := fs.Stat(r.fs, path.Join(dir, "cgroup.controllers")); err != nil {
+		return nil
+	}
+
+	cg := &CgroupUsage{
+		Path:          cgPath,
+		MemoryCurrent: r.cgroupInt(dir, "memory.current"),
+		PidsCurrent:   r.cgroupInt(dir, "pids.current"),
+	}
+	if data, err := fs.ReadFile(r.fs, path.Join(dir, "cpuset.cpus.effective")); err == nil {
+		cg.CPUs = strings.TrimSpace(string(data))
+		if count, err := countCPUList(cg.CPUs); err == nil {
+			cg.CPUCount = intPtr(count)
+		}
+	}
+	// Limit may be set on any of the ancestors, like the job cgroup
+	// when running in a step or task cgroup.
+	for d := dir; d != "sys/fs/cgroup" && d != "."; d = path.Dir(d) {
+		if limit := r.cgroupInt(d, "memory.max"); limit != nil && (cg.MemoryMax == nil || *limit < *cg.MemoryMax) {
+			cg.MemoryMax = limit
+		}
+	}
+	return cg
+}
+
+// cgroupInt reads an integer from cgroup file. It returns nil if file
+// is missing, is "max" or is invalid.
+func (r *ResourceReader) cgroupInt(dir, name string) *int64 {
+	data, err := fs.ReadFile(r.fs, path.Join(dir, name))
+	if err != nil {
+		return nil
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// parseLoadAvg parses /proc/loadavg, like "0.50 0.40 0.30 2/345 6789".
+func parseLoadAvg(data []byte) (LoadAverage, error) {
+	var load LoadAverage
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 {
+		return load, fmt.Errorf("invalid loadavg: %q", data)
+	}
+	var err error
+	for i, p := range []*float64{&load.Load1, &load.Load5, &load.Load15} {
+		if *p, err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return load, fmt.Errorf("invalid loadavg: %w", err)
+		}
+	}
+	running, total, ok := cut(fields[3], "/")
+	if !ok {
+		return load, fmt.Errorf("invalid loadavg: %q", data)
+	}
+	if load.Running, err = strconv.Atoi(running); err != nil {
+		return load, fmt.Errorf("invalid loadavg: %w", err)
+	}
+	if load.Total, err = strconv.Atoi(total); err != nil {
+		return load, fmt.Errorf("invalid loadavg: %w", err)
+	}
+	return load, nil
+}
+
+// parseMeminfo parses /proc/meminfo. Values are converted to bytes.
+func parseMeminfo(data []byte) (MemoryUsage, error) {
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return MemoryUsage{}, fmt.Errorf("invalid meminfo value of %s: %w", key, err)
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			v *= 1024
+		}
+		values[key] = v
+	}
+
+	if _, ok := values["MemTotal"]; !ok {
+		return MemoryUsage{}, errors.New("invalid meminfo: MemTotal is missing")
+	}
+	mem := MemoryUsage{
+		Total:     values["MemTotal"],
+		Free:      values["MemFree"],
+		SwapTotal: values["SwapTotal"],
+		SwapFree:  values["SwapFree"],
+	}
+	if available, ok := values["MemAvailable"]; ok {
+		mem.Available = available
+	} else {
+		// Kernels older than 3.14 do not report MemAvailable.
+		mem.Available = mem.Free + values["Buffers"] + values["Cached"]
+	}
+	mem.Used = mem.Total - mem.Available
+	return mem, nil
+}
+
+// parseStat parses cpu lines of /proc/stat. Aggregate of all
+// CPUs is returned with key -1.
+func parseStat(data []byte) (map[int]cpuTimes, error) {
+	times := make(map[int]cpuTimes)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		cpu := -1
+		if fields[0] != "cpu" {
+			n, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid cpu in stat: %q", fields[0])
+			}
+			cpu = n
+		}
+		// user nice system idle iowait irq softirq steal, guest time
+		// is already included in user and nice.
+		var t cpuTimes
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time of %s in stat: %w", fields[0], err)
+			}
+			t.total += v
+			if i != 3 && i != 4 {
+				t.busy += v
+			}
+		}
+		times[cpu] = t
+	}
+	if _, ok := times[-1]; !ok {
+		return nil, errors.New("invalid stat: cpu line is missing")
+	}
+	return times, nil
+}
+
+// utilization returns fraction of time CPU was busy between samples.
+func utilization(before, after cpuTimes) float64 {
+	if after.total <= before.total || after.busy < before.busy {
+		return 0
+	}
+	return float64(after.busy-before.busy) / float64(after.total-before.total)
+}
+
+// cpuUsage returns CPU usage between two samples of /proc/stat.
+// CPUs which went offline in between are ignored.
+func cpuUsage(before, after map[int]cpuTimes) CPUUsage {
+	usage := CPUUsage{
+		Utilization: utilization(before[-1], after[-1]),
+		PerCPU:      []CPUUtilization{},
+	}
+	for cpu := 0; len(usage.PerCPU) < len(after)-1; cpu++ {
+		a, ok := after[cpu]
+		if !ok {
+			continue
+		}
+		b, ok := before[cpu]
+		if !ok {
+			b = a
+		}
+		usage.PerCPU = append(usage.PerCPU, CPUUtilization{CPU: cpu, Utilization: utilization(b, a)})
+	}
+	usage.Count = len(usage.PerCPU)
+	return usage
+}
+
+// parseCgroupPath returns cgroup v2 path from /proc/<pid>/cgroup.
+func parseCgroupPath(data []byte) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if p := strings.TrimPrefix(scanner.Text(), "0::"); p != scanner.Text() {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// countCPUList returns number of CPUs in a cpuset list like 0-3,8,10-11.
+func countCPUList(list string) (int, error) {
+	count := 0
+	if list == "" {
+		return 0, nil
+	}
+	for _, item := range strings.Split(list, ",") {
+		lo, hi, isRange := cut(item, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cpu list: %q", list)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return 0, fmt.Errorf("invalid cpu list: %q", list)
+			}
+		}
+		count += last - first + 1
+	}
+	return count, nil
+}
+
+// handleNodeResources returns resource usage of the node.
+// CPU utilization is sampled over window query parameter,
+// like 500ms, if set.
+func (s *Server) handleNodeResources(w http.ResponseWriter, r *http.Request) {
+	var window time.Duration
+	if value := r.URL.Query().Get("window"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 || d > maxResourceWindow {
+			http.Error(w, fmt.Sprintf("window must be a positive duration up to %s", maxResourceWindow), http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+
+	res, err := s.resources.Read(r.Context(), window)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		log.Printf("[ERROR] Failed to read node resources: %s", err)
+		http.Error(w, "failed to read node resources", http.StatusInternalServerError)
+		return
+	}
+	writeResponse(w, r, http.StatusOK, res)
+}
+
+// cut slices s around the first instance of sep, like strings.Cut
+// which is not available in Go 1.17.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// statAfter is /proc/stat of testdata/node after the sampling window.
+const statAfter = `cpu  1350 0 500 8400 550 0 0 0 0 0
+cpu0 300 0 175 2075 150 0 0 0 0 0
+cpu1 250 0 125 2200 125 0 0 0 0 0
+cpu2 400 0 175 2000 125 0 0 0 0 0
+cpu3 275 0 150 2125 150 0 0 0 0 0
+`
+
+// overlayFS serves files from files, and everything else from base.
+type overlayFS struct {
+	base  fs.FS
+	files fstest.MapFS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if _, ok := o.files[name]; ok {
+		return o.files.Open(name)
+	}
+	return o.base.Open(name)
+}
+
+// newFixtureReader returns ResourceReader reading from testdata/node,
+// with files overridden by overrides. /proc/stat is replaced with
+// statAfter during sleep.
+func newFixtureReader(overrides fstest.MapFS) *ResourceReader {
+	if overrides == nil {
+		overrides = fstest.MapFS{}
+	}
+	r := NewResourceReader(overlayFS{base: os.DirFS("testdata/node"), files: overrides}, 0)
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		overrides["proc/stat"] = &fstest.MapFile{Data: []byte(statAfter)}
+		return nil
+	}
+	return r
+}
+
+func TestResourceReader(t *testing.T) {
+	res, err := newFixtureReader(nil).Read(context.Background(), 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, LoadAverage{Load1: 1.25, Load5: 0.75, Load15: 0.5, Running: 3, Total: 412}, res.Load)
+	assert.Equal(t, MemoryUsage{
+		Total:     16384000 * 1024,
+		Free:      4096000 * 1024,
+		Available: 12288000 * 1024,
+		Used:      4096000 * 1024,
+		SwapTotal: 2048000 * 1024,
+		SwapFree:  1024000 * 1024,
+	}, res.Memory)
+	assert.Equal(t, CPUUsage{
+		Count:       4,
+		Window:      1,
+		Utilization: 0.4375,
+		PerCPU: []CPUUtilization{
+			{CPU: 0, Utilization: 0.5},
+			{CPU: 1, Utilization: 0},
+			{CPU: 2, Utilization: 1},
+			{CPU: 3, Utilization: 0.25},
+		},
+	}, res.CPU)
+	assert.Equal(t, &CgroupUsage{
+		Path:          "/system.slice/slurmstepd.scope/job_42/step_0",
+		CPUs:          "0-1,4",
+		CPUCount:      intPtr(3),
+		MemoryMax:     int64Ptr(8589934592),
+		MemoryCurrent: int64Ptr(1073741824),
+		PidsCurrent:   int64Ptr(17),
+	}, res.Cgroup)
+}
+
+func TestResourceReaderNoCgroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		cgroup string
+	}{
+		{name: "v1", cgroup: "12:pids:/user.slice\n11:memory:/user.slice\n"},
+		{name: "missing-hierarchy", cgroup: "0::/no/such/cgroup\n"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := newFixtureReader(fstest.MapFS{
+				"proc/self/cgroup": &fstest.MapFile{Data: []byte(tc.cgroup)},
+			}).Read(context.Background(), 0)
+			assert.Nil(t, err)
+			assert.Nil(t, res.Cgroup)
+		})
+	}
+}
+
+func TestResourceReaderUnlimited(t *testing.T) {
+	dir := "sys/fs/cgroup/system.slice/slurmstepd.scope/job_42"
+	res, err := newFixtureReader(fstest.MapFS{
+		dir + "/memory.max":                   &fstest.MapFile{Data: []byte("max\n")},
+		dir + "/step_0/cpuset.cpus.effective": &fstest.MapFile{Data: []byte("0-\n")},
+	}).Read(context.Background(), 0)
+	if assert.Nil(t, err) && assert.NotNil(t, res.Cgroup) {
+		assert.Nil(t, res.Cgroup.MemoryMax)
+		assert.Nil(t, res.Cgroup.CPUCount)
+	}
+}
+
+func TestResourceReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{name: "loadavg", files: fstest.MapFS{"proc/loadavg": &fstest.MapFile{Data: []byte("1.0 2.0\n")}}},
+		{name: "meminfo", files: fstest.MapFS{"proc/meminfo": &fstest.MapFile{Data: []byte("MemFree: 10 kB\n")}}},
+		{name: "stat", files: fstest.MapFS{"proc/stat": &fstest.MapFile{Data: []byte("intr 1 2 3\n")}}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newFixtureReader(tc.files).Read(context.Background(), 0)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestParseMeminfoWithoutAvailable(t *testing.T) {
+	mem, err := parseMeminfo([]byte("MemTotal: 1000 kB\nMemFree: 100 kB\nBuffers: 200 kB\nCached: 300 kB\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(600*1024), mem.Available)
+	assert.Equal(t, int64(400*1024), mem.Used)
+}
+
+func TestCountCPUList(t *testing.T) {
+	tests := []struct {
+		list  string
+		count int
+		err   bool
+	}{
+		{list: "", count: 0},
+		{list: "0", count: 1},
+		{list: "0-3", count: 4},
+		{list: "0-3,8,10-11", count: 7},
+		{list: "3-1", err: true},
+		{list: "a", err: true},
+		{list: "0-", err: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.list, func(t *testing.T) {
+			count, err := countCPUList(tc.list)
+			if tc.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.count, count)
+		})
+	}
+}
+
+func TestHandleNodeResources(t *testing.T) {
+	s := NewServer(Options{
+		Scheduler: pbsScheduler{},
+		Env:       MapEnv(nil),
+		Root:      os.DirFS("testdata/node"),
+	}, func() {})
+	var window time.Duration
+	s.resources.sleep = func(ctx context.Context, d time.Duration) error {
+		window = d
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		window time.Duration
+	}{
+		{name: "default", status: http.StatusOK, window: time.Second},
+		{name: "window", query: "?window=250ms", status: http.StatusOK, window: 250 * time.Millisecond},
+		{name: "too-long", query: "?window=1m", status: http.StatusBadRequest},
+		{name: "invalid", query: "?window=soon", status: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			window = 0
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/node/resources"+tc.query, nil))
+			assert.Equal(t, tc.status, w.Code)
+			if tc.status != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tc.window, window)
+
+			var res NodeResources
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, 4, res.CPU.Count)
+			assert.Equal(t, tc.window.Seconds(), res.CPU.Window)
+			if assert.NotNil(t, res.Cgroup) {
+				assert.Equal(t, int64Ptr(17), res.Cgroup.PidsCurrent)
+			}
+		})
+	}
+}
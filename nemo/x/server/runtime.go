@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// runtimeDir returns directory for runtime files like tokens,
+// creating it if necessary. It is $XDG_RUNTIME_DIR/nemo, falling back
+// to nemo-<uid> under temporary directory, as XDG_RUNTIME_DIR is usually
+// not set on compute nodes. Directory must be owned by current user and
+// must not be accessible by others.
+func runtimeDir(env Env) (string, error) {
+	dir := ""
+	if base := env.String("XDG_RUNTIME_DIR"); base != "" {
+		dir = filepath.Join(base, "nemo")
+	} else {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("nemo-%d", os.Getuid()))
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create runtime dir: %w", err)
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat runtime dir: %w", err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("runtime dir %s is not a directory", dir)
+	}
+	if err := checkOwner(fi); err != nil {
+		return "", fmt.Errorf("runtime dir %s: %w", dir, err)
+	}
+	if fi.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("runtime dir %s is accessible by other users (mode %s)", dir, fi.Mode().Perm())
+	}
+	return dir, nil
+}
+
+// writeFileAtomic writes data to path with given permissions, so that
+// readers never see a partially written file. Parent directory is
+// created if it does not exist.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// checkOwner is a no-op on windows, where user profile
+// directories are already private.
+func checkOwner(fi os.FileInfo) error {
+	return nil
+}
+
+// processAlive returns true if process with pid exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
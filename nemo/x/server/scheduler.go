@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Scheduler is a batch system backend. It knows how to detect
+// whether current process is running inside one of its jobs and
+// how to translate its environment into JobInfo.
+type Scheduler interface {
+	// Name of the scheduler as used by -scheduler flag.
+	Name() string
+	// Detect returns true if env looks like a job environment
+	// set up by this scheduler.
+	Detect(env Env) bool
+	// JobInfo returns info on current job from env.
+	JobInfo(env Env) JobInfo
+	// NodeIndex returns index of the current node within the job,
+	// or nil if it is not known. hostname is name of current node,
+	// used by schedulers which do not export node index.
+	NodeIndex(env Env, hostname string) *int
+}
+
+// Validator is implemented by schedulers which can cross check
+// job info against other variables they export. It returns list
+// of human readable warnings for each inconsistency found.
+type Validator interface {
+	Validate(env Env, job JobInfo) []string
+}
+
+// StartTimer is implemented by schedulers which export
+// the time at which the job started.
+type StartTimer interface {
+	StartTime(env Env) (time.Time, bool)
+}
+
+// schedulers is a list of all supported schedulers in the order
+// they are tried when auto detecting. Slurm and LSF are tried
+// before PBS as they can be configured to export PBS_* variables
+// for compatibility.
+var schedulers = []Scheduler{
+	slurmScheduler{},
+	lsfScheduler{},
+	sgeScheduler{},
+	pbsScheduler{},
+}
+
+// schedulerNames returns names of all supported schedulers.
+func schedulerNames() []string {
+	names := make([]string, 0, len(schedulers))
+	for _, s := range schedulers {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// detectScheduler returns first scheduler which detects env.
+// Returns nil if none of them do.
+func detectScheduler(env Env) Scheduler {
+	for _, s := range schedulers {
+		if s.Detect(env) {
+			return s
+		}
+	}
+	return nil
+}
+
+// getScheduler returns scheduler with given name. If name is auto,
+// scheduler is detected from env, falling back to PBS if detection fails.
+func getScheduler(name string, env Env) (Scheduler, error) {
+	if name == "" || name == "auto" {
+		if s := detectScheduler(env); s != nil {
+			return s, nil
+		}
+		return pbsScheduler{}, nil
+	}
+	for _, s := range schedulers {
+		if s.Name() == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown scheduler %q, must be one of auto,%s",
+		name, strings.Join(schedulerNames(), ","))
+}
+
+// indexOf returns index of host in nodes, ignoring duplicates
+// and domain names. Returns nil if host is not found.
+func indexOf(nodes []string, host string) *int {
+	short := strings.SplitN(host, ".", 2)[0]
+	seen := make(map[string]bool)
+	index := 0
+	for _, node := range nodes {
+		node = strings.SplitN(node, ".", 2)[0]
+		if seen[node] {
+			continue
+		}
+		if node == short {
+			return &index
+		}
+		seen[node] = true
+		index++
+	}
+	return nil
+}
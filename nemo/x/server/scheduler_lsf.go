@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lsfScheduler is IBM Spectrum LSF.
+type lsfScheduler struct{}
+
+func (lsfScheduler) Name() string {
+	return "lsf"
+}
+
+func (lsfScheduler) Detect(env Env) bool {
+	return env.Has("LSB_JOBID")
+}
+
+func (l lsfScheduler) JobInfo(env Env) JobInfo {
+	hosts := l.hosts(env)
+	job := JobInfo{
+		Name:          env.String("LSB_JOBNAME"),
+		Authorization: env.String("LSFUSER", "USER"),
+		Entitlement:   env.String("LSB_PROJECT_NAME"),
+		ID:            env.Int("LSB_JOBID"),
+		SchedulerID:   l.schedulerID(env),
+		TaskCount:     env.Int("LSB_DJOB_NUMPROC", "LSB_MAX_NUM_PROCESSORS"),
+		Queue:         env.String("LSB_QUEUE"),
+	}
+	if len(hosts) > 0 {
+		job.NodeCount = intPtr(len(hosts))
+		job.PPN = hosts[0].Slots
+	}
+	job.setHosts(hosts)
+	return job
+}
+
+func (l lsfScheduler) NodeIndex(env Env, hostname string) *int {
+	return indexOf(hostNames(l.hosts(env)), hostname)
+}
+
+// schedulerID returns ID of the job as used by LSF, like 1234, or
+// 1234[5] for elements of job arrays, which share LSB_JOBID.
+// LSB_JOBINDEX is 0 for jobs which are not array elements.
+func (lsfScheduler) schedulerID(env Env) string {
+	id := env.String("LSB_JOBID")
+	if index := env.String("LSB_JOBINDEX"); id != "" && index != "" && index != "0" {
+		id += "[" + index + "]"
+	}
+	return id
+}
+
+// hosts returns list of hosts along with slots allocated on them.
+// LSB_MCPU_HOSTS is of the form "hostA 4 hostB 4". If it is not
+// available, LSB_HOSTS which lists each host once per slot is used.
+func (lsfScheduler) hosts(env Env) []HostSlots {
+	fields := strings.Fields(env.String("LSB_MCPU_HOSTS"))
+	if len(fields) == 0 {
+		return countSlots(strings.Fields(env.String("LSB_HOSTS")))
+	}
+	if len(fields)%2 != 0 {
+		env.Invalid("LSB_MCPU_HOSTS", errors.New("must be a list of host and slots pairs"))
+		return countSlots(strings.Fields(env.String("LSB_HOSTS")))
+	}
+
+	var hosts []HostSlots
+	for i := 0; i < len(fields); i += 2 {
+		slots, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			env.Invalid("LSB_MCPU_HOSTS", fmt.Errorf("slots %q of %s is not an integer", fields[i+1], fields[i]))
+			return countSlots(strings.Fields(env.String("LSB_HOSTS")))
+		}
+		hosts = addSlots(hosts, fields[i], &slots)
+	}
+	return hosts
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pbsScheduler is PBS/Torque with optional Moab.
+type pbsScheduler struct{}
+
+func (pbsScheduler) Name() string {
+	return "pbs"
+}
+
+func (pbsScheduler) Detect(env Env) bool {
+	return env.Has("PBS_JOBID") || env.Has("PBS_ENVIRONMENT")
+}
+
+func (p pbsScheduler) JobInfo(env Env) JobInfo {
+	job := JobInfo{
+		Name:          env.String("PBS_JOBNAME"),
+		Authorization: env.String("PBS_O_LOGNAME"),
+		Entitlement:   env.String("MOAB_ACCOUNT", "PBS_ACCOUNT"),
+		ID:            p.jobID(env),
+		SchedulerID:   p.schedulerID(env),
+		NodeCount:     env.Int("PBS_NUM_NODES"),
+		PPN:           env.Int("PBS_NUM_PPN"),
+		TaskCount:     env.Int("PBS_NP", "PBS_NUM_PPN"),
+		Walltime:      p.walltime(env),
+		Queue:         env.String("PBS_QUEUE"),
+		Array:         p.array(env),
+	}
+	job.setHosts(countSlots(p.nodes(env)))
+	return job
+}
+
+func (pbsScheduler) NodeIndex(env Env, hostname string) *int {
+	return env.Int("PBS_NODENUM")
+}
+
+// jobID returns numeric job id. MOAB_JOBID is preferred,
+// otherwise numeric part of PBS_JOBID (12345.server) is used.
+func (pbsScheduler) jobID(env Env) *int {
+	if env.Has("MOAB_JOBID") {
+		return env.Int("MOAB_JOBID")
+	}
+	jobID, ok := env.Lookup("PBS_JOBID")
+	if !ok {
+		return nil
+	}
+	id := strings.SplitN(jobID, ".", 2)[0]
+	val, err := strconv.Atoi(id)
+	if err != nil {
+		// Elements of job arrays do not have a numeric ID of their own.
+		if arrayParentID(jobID) != nil {
+			return nil
+		}
+		env.Invalid("PBS_JOBID", fmt.Errorf("%q does not start with a numeric job ID", jobID))
+		return nil
+	}
+	return &val
+}
+
+// schedulerID returns ID of the job as used by PBS and Moab, like 1234
+// or 1234[5] for elements of job arrays. MOAB_JOBID is preferred,
+// otherwise PBS_JOBID without the server name is used.
+func (pbsScheduler) schedulerID(env Env) string {
+	if id := env.String("MOAB_JOBID"); id != "" {
+		return id
+	}
+	return strings.SplitN(env.String("PBS_JOBID"), ".", 2)[0]
+}
+
+// walltime returns PBS_WALLTIME in seconds. It is usually in seconds,
+// but Moab may export it in HH:MM:SS form.
+func (pbsScheduler) walltime(env Env) *int {
+	value, ok := env.Lookup("PBS_WALLTIME")
+	if !ok {
+		return nil
+	}
+	walltime, err := parseWalltime(value)
+	if err != nil {
+		env.Invalid("PBS_WALLTIME", err)
+		return nil
+	}
+	return intPtr(int(walltime / time.Second))
+}
+
+// array returns job array the job is an element of. Torque exports
+// index as PBS_ARRAYID and PBS Pro as PBS_ARRAY_INDEX. Array job ID is
+// taken from PBS_ARRAY_ID (1234[].server) of PBS Pro, falling back to
+// PBS_JOBID (1234[5].server). Size is only known with Moab.
+func (pbsScheduler) array(env Env) *JobArray {
+	index := env.Int("PBS_ARRAYID", "PBS_ARRAY_INDEX")
+	if index == nil {
+		return nil
+	}
+	_, jobID, _ := env.First("PBS_ARRAY_ID", "PBS_JOBID")
+	return newJobArray(arrayParentID(jobID), index, env.Int("MOAB_JOBARRAYRANGE"), nil, nil, nil)
+}
+
+// Validate checks hosts and slots listed in PBS_NODEFILE
+// against PBS_NUM_NODES and PBS_NUM_PPN.
+func (pbsScheduler) Validate(env Env, job JobInfo) []string {
+	if len(job.Hosts) == 0 {
+		return []string{"PBS_NODEFILE is missing, unreadable or empty"}
+	}
+
+	// Slots on hosts and SlotCount are always known, as
+	// PBS_NODEFILE lists each host once per slot.
+	var warnings []string
+	numNodes := env.Int("PBS_NUM_NODES")
+	numPPN := env.Int("PBS_NUM_PPN")
+	if numNodes != nil && *numNodes != len(job.Hosts) {
+		warnings = append(warnings, fmt.Sprintf(
+			"PBS_NUM_NODES is %d, but PBS_NODEFILE lists %d unique hosts", *numNodes, len(job.Hosts)))
+	}
+	if numPPN != nil {
+		for _, host := range job.Hosts {
+			if *host.Slots != *numPPN {
+				warnings = append(warnings, fmt.Sprintf(
+					"PBS_NUM_PPN is %d, but PBS_NODEFILE lists %d slots on %s", *numPPN, *host.Slots, host.Name))
+			}
+		}
+	}
+	if numNodes != nil && numPPN != nil && *numNodes**numPPN != *job.SlotCount {
+		warnings = append(warnings, fmt.Sprintf(
+			"PBS_NUM_NODES x PBS_NUM_PPN is %d, but PBS_NODEFILE lists %d slots", *numNodes**numPPN, *job.SlotCount))
+	}
+	return warnings
+}
+
+// nodes returns contents of PBS_NODEFILE. Each host is
+// listed once per slot allocated on it.
+func (pbsScheduler) nodes(env Env) []string {
+	nodefilePath, nodefileEnvPresent := env.Lookup("PBS_NODEFILE")
+	if !nodefileEnvPresent {
+		log.Printf("[ERROR] Nodefile not preset. Not running inside a job?")
+		return nil
+	}
+
+	nodes, err := env.ReadLines(nodefilePath)
+	if err != nil {
+		log.Printf("[ERROR] Failed to open nodefile? check if job has not exceeded walltime")
+		env.Invalid("PBS_NODEFILE", err)
+		return nil
+	}
+	if len(nodes) == 0 {
+		env.Invalid("PBS_NODEFILE", fmt.Errorf("%s lists no hosts", nodefilePath))
+	}
+	return nodes
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// sgeScheduler is Sun/Son of/Univa Grid Engine.
+type sgeScheduler struct{}
+
+func (sgeScheduler) Name() string {
+	return "sge"
+}
+
+func (sgeScheduler) Detect(env Env) bool {
+	return env.Has("SGE_ROOT") && env.Has("JOB_ID")
+}
+
+func (s sgeScheduler) JobInfo(env Env) JobInfo {
+	hosts := s.hosts(env)
+	job := JobInfo{
+		Name:          env.String("JOB_NAME"),
+		Authorization: env.String("SGE_O_LOGNAME", "USER"),
+		Entitlement:   env.String("SGE_ACCOUNT"),
+		ID:            env.Int("JOB_ID"),
+		SchedulerID:   s.schedulerID(env),
+		NodeCount:     env.Int("NHOSTS"),
+		TaskCount:     env.Int("NSLOTS"),
+		Queue:         env.String("QUEUE"),
+	}
+	if len(hosts) > 0 {
+		job.PPN = hosts[0].Slots
+	}
+	job.setHosts(hosts)
+	return job
+}
+
+func (s sgeScheduler) NodeIndex(env Env, hostname string) *int {
+	return indexOf(hostNames(s.hosts(env)), hostname)
+}
+
+// schedulerID returns ID of the job as used by SGE, like 1234, or
+// 1234.5 for tasks of array jobs, which share JOB_ID. SGE_TASK_ID
+// is "undefined" for jobs which are not array jobs.
+func (sgeScheduler) schedulerID(env Env) string {
+	id := env.String("JOB_ID")
+	if task := env.String("SGE_TASK_ID"); id != "" {
+		if _, err := strconv.Atoi(task); err == nil {
+			id += "." + task
+		}
+	}
+	return id
+}
+
+// hosts returns list of hosts along with slots allocated on them.
+// Each line in PE_HOSTFILE is of the form "host slots queue processor-range".
+// A host may appear more than once if slots span multiple queues.
+// Jobs which are not parallel do not have a PE_HOSTFILE, they run
+// on a single slot on current host.
+func (sgeScheduler) hosts(env Env) []HostSlots {
+	hostfile, ok := env.Lookup("PE_HOSTFILE")
+	if !ok {
+		if host := env.String("HOSTNAME"); host != "" {
+			return []HostSlots{{Name: host, Slots: intPtr(1)}}
+		}
+		return nil
+	}
+
+	lines, err := env.ReadLines(hostfile)
+	if err != nil {
+		log.Printf("[ERROR] Failed to read PE_HOSTFILE: %s", err)
+		env.Invalid("PE_HOSTFILE", err)
+		return nil
+	}
+
+	var hosts []HostSlots
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		slots, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		hosts = addSlots(hosts, fields[0], &slots)
+	}
+	if len(hosts) == 0 {
+		env.Invalid("PE_HOSTFILE", fmt.Errorf("%s lists no hosts", hostfile))
+	}
+	return hosts
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tprasadtp/dotfiles/nemo/x/server/hostlist"
+)
+
+// slurmScheduler is Slurm workload manager.
+type slurmScheduler struct{}
+
+func (slurmScheduler) Name() string {
+	return "slurm"
+}
+
+func (slurmScheduler) Detect(env Env) bool {
+	return env.Has("SLURM_JOB_ID") || env.Has("SLURM_JOBID")
+}
+
+func (s slurmScheduler) JobInfo(env Env) JobInfo {
+	job := JobInfo{
+		Name:          env.String("SLURM_JOB_NAME"),
+		Authorization: env.String("SLURM_JOB_USER", "USER"),
+		Entitlement:   env.String("SLURM_JOB_ACCOUNT"),
+		ID:            env.Int("SLURM_JOB_ID", "SLURM_JOBID"),
+		SchedulerID:   env.String("SLURM_JOB_ID", "SLURM_JOBID"),
+		NodeCount:     env.Int("SLURM_JOB_NUM_NODES", "SLURM_NNODES"),
+		PPN:           env.Int("SLURM_NTASKS_PER_NODE", "SLURM_CPUS_ON_NODE"),
+		TaskCount:     env.Int("SLURM_NTASKS", "SLURM_NPROCS"),
+		Walltime:      s.walltime(env),
+		Queue:         env.String("SLURM_JOB_PARTITION"),
+		Array:         s.array(env),
+	}
+	job.setHosts(s.hosts(env))
+	return job
+}
+
+func (slurmScheduler) NodeIndex(env Env, hostname string) *int {
+	return env.Int("SLURM_NODEID")
+}
+
+// array returns job array the job is an element of.
+func (slurmScheduler) array(env Env) *JobArray {
+	index := env.Int("SLURM_ARRAY_TASK_ID")
+	if index == nil {
+		return nil
+	}
+	return newJobArray(
+		env.Int("SLURM_ARRAY_JOB_ID"),
+		index,
+		env.Int("SLURM_ARRAY_TASK_COUNT"),
+		env.Int("SLURM_ARRAY_TASK_MIN"),
+		env.Int("SLURM_ARRAY_TASK_MAX"),
+		env.Int("SLURM_ARRAY_TASK_STEP"),
+	)
+}
+
+// nodes returns list of nodes from SLURM_JOB_NODELIST,
+// which is a hostlist expression like node[001-004].
+func (slurmScheduler) nodes(env Env) []string {
+	key, value, ok := env.First("SLURM_JOB_NODELIST", "SLURM_NODELIST")
+	if !ok {
+		return nil
+	}
+	nodes, err := hostlist.Expand(value)
+	if err != nil {
+		log.Printf("[ERROR] Failed to expand %s: %s", key, err)
+		env.Invalid(key, err)
+		return nil
+	}
+	return nodes
+}
+
+// hosts returns nodes along with CPUs allocated on each of them.
+// SLURM_JOB_CPUS_PER_NODE is of the form 72(x2),36, listing CPUs
+// on each node in the same order as nodes in SLURM_JOB_NODELIST.
+// If it is missing or does not match the node list, slots are unknown.
+func (s slurmScheduler) hosts(env Env) []HostSlots {
+	nodes := s.nodes(env)
+	var cpus []int
+	if value, ok := env.Lookup("SLURM_JOB_CPUS_PER_NODE"); ok {
+		cpus = parseCPUsPerNode(value)
+		switch {
+		case cpus == nil:
+			env.Invalid("SLURM_JOB_CPUS_PER_NODE", fmt.Errorf("%q must be of the form 72(x2),36", value))
+		case len(cpus) != len(nodes):
+			env.Invalid("SLURM_JOB_CPUS_PER_NODE", fmt.Errorf(
+				"lists CPUs of %d nodes, but node list has %d nodes", len(cpus), len(nodes)))
+			cpus = nil
+		}
+	}
+
+	var hosts []HostSlots
+	for i, node := range nodes {
+		var slots *int
+		if cpus != nil {
+			slots = &cpus[i]
+		}
+		hosts = addSlots(hosts, node, slots)
+	}
+	return hosts
+}
+
+// parseCPUsPerNode expands value of SLURM_JOB_CPUS_PER_NODE
+// like 72(x2),36 into [72 72 36]. Returns nil if value is invalid.
+func parseCPUsPerNode(value string) []int {
+	if value == "" {
+		return nil
+	}
+	var cpus []int
+	for _, item := range strings.Split(value, ",") {
+		count, repeat := item, "1"
+		if i := strings.Index(item, "(x"); i >= 0 && strings.HasSuffix(item, ")") {
+			count, repeat = item[:i], item[i+2:len(item)-1]
+		}
+		c, err := strconv.Atoi(count)
+		if err != nil || c < 0 {
+			return nil
+		}
+		r, err := strconv.Atoi(repeat)
+		if err != nil || r < 1 || r > hostlist.MaxHosts {
+			return nil
+		}
+		for i := 0; i < r; i++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus
+}
+
+// StartTime returns job start time from SLURM_JOB_START_TIME.
+func (slurmScheduler) StartTime(env Env) (time.Time, bool) {
+	start := env.Int("SLURM_JOB_START_TIME")
+	if start == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*start), 0), true
+}
+
+// walltime returns time limit of the job in seconds. Slurm does not
+// export time limit directly, but newer versions export job start
+// and end times as unix timestamps.
+func (slurmScheduler) walltime(env Env) *int {
+	start := env.Int("SLURM_JOB_START_TIME")
+	end := env.Int("SLURM_JOB_END_TIME")
+	if start == nil || end == nil {
+		return nil
+	}
+	if *end < *start {
+		env.Invalid("SLURM_JOB_END_TIME", fmt.Errorf("%d is before SLURM_JOB_START_TIME", *end))
+		return nil
+	}
+	return intPtr(*end - *start)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTempFile writes lines to a file in a temporary directory
+// and returns its path.
+func writeTempFile(t *testing.T, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %s", path, err)
+	}
+	return path
+}
+
+func TestDetectScheduler(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		expect string
+	}{
+		{name: "empty", env: map[string]string{}, expect: ""},
+		{name: "pbs", env: map[string]string{"PBS_JOBID": "1.moab"}, expect: "pbs"},
+		{name: "pbs-environment", env: map[string]string{"PBS_ENVIRONMENT": "PBS_BATCH"}, expect: "pbs"},
+		{name: "slurm", env: map[string]string{"SLURM_JOB_ID": "1"}, expect: "slurm"},
+		{name: "slurm-legacy", env: map[string]string{"SLURM_JOBID": "1"}, expect: "slurm"},
+		{name: "slurm-with-pbs-compat", env: map[string]string{"SLURM_JOB_ID": "1", "PBS_JOBID": "1"}, expect: "slurm"},
+		{name: "lsf", env: map[string]string{"LSB_JOBID": "1"}, expect: "lsf"},
+		{name: "sge", env: map[string]string{"SGE_ROOT": "/opt/sge", "JOB_ID": "1"}, expect: "sge"},
+		{name: "sge-without-root", env: map[string]string{"JOB_ID": "1"}, expect: ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := detectScheduler(MapEnv(tc.env))
+			if tc.expect == "" {
+				assert.Nil(t, s)
+			} else {
+				assert.Equal(t, tc.expect, s.Name())
+			}
+		})
+	}
+}
+
+func TestGetScheduler(t *testing.T) {
+	env := MapEnv(map[string]string{"SLURM_JOB_ID": "1"})
+
+	s, err := getScheduler("auto", env)
+	assert.Nil(t, err)
+	assert.Equal(t, "slurm", s.Name())
+
+	s, err = getScheduler("auto", MapEnv(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "pbs", s.Name(), "auto must fall back to pbs")
+
+	for _, name := range schedulerNames() {
+		s, err = getScheduler(name, env)
+		assert.Nil(t, err)
+		assert.Equal(t, name, s.Name(), "flag must override detection")
+	}
+
+	_, err = getScheduler("condor", env)
+	assert.NotNil(t, err)
+}
+
+func TestPBSScheduler(t *testing.T) {
+	nodefile := writeTempFile(t, "nodefile", "n001", "n001", "n002", "n002")
+	env := MapEnv(map[string]string{
+		"PBS_JOBID":     "12345.moab.nemo",
+		"PBS_JOBNAME":   "sweep",
+		"PBS_O_LOGNAME": "fr_ab123",
+		"MOAB_ACCOUNT":  "bw12345",
+		"MOAB_JOBID":    "12345",
+		"PBS_NUM_NODES": "2",
+		"PBS_NUM_PPN":   "2",
+		"PBS_NP":        "4",
+		"PBS_WALLTIME":  "3600",
+		"PBS_QUEUE":     "short",
+		"PBS_NODEFILE":  nodefile,
+		"PBS_NODENUM":   "1",
+	})
+	s := pbsScheduler{}
+	assert.Equal(t, JobInfo{
+		Name:          "sweep",
+		Authorization: "fr_ab123",
+		Entitlement:   "bw12345",
+		ID:            intPtr(12345),
+		SchedulerID:   "12345",
+		NodeCount:     intPtr(2),
+		Nodes:         []string{"n001", "n002"},
+		NodeList:      "n[001-002]",
+		Hosts:         []HostSlots{{Name: "n001", Slots: intPtr(2)}, {Name: "n002", Slots: intPtr(2)}},
+		SlotCount:     intPtr(4),
+		PPN:           intPtr(2),
+		TaskCount:     intPtr(4),
+		Walltime:      intPtr(3600),
+		Queue:         "short",
+	}, s.JobInfo(env))
+	assert.Equal(t, intPtr(1), s.NodeIndex(env, "n002"))
+}
+
+func TestPBSSchedulerValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodefile []string
+		env      map[string]string
+		warnings []string
+	}{
+		{
+			name:     "consistent",
+			nodefile: []string{"n1", "n1", "n2", "n2"},
+			env:      map[string]string{"PBS_NUM_NODES": "2", "PBS_NUM_PPN": "2"},
+		},
+		{
+			name:     "vars-missing",
+			nodefile: []string{"n1", "n1", "n2"},
+			env:      map[string]string{},
+		},
+		{
+			name:     "node-count-mismatch",
+			nodefile: []string{"n1", "n1"},
+			env:      map[string]string{"PBS_NUM_NODES": "2"},
+			warnings: []string{"PBS_NUM_NODES is 2, but PBS_NODEFILE lists 1 unique hosts"},
+		},
+		{
+			name:     "ppn-mismatch",
+			nodefile: []string{"n1", "n1", "n2"},
+			env:      map[string]string{"PBS_NUM_PPN": "2"},
+			warnings: []string{"PBS_NUM_PPN is 2, but PBS_NODEFILE lists 1 slots on n2"},
+		},
+		{
+			name:     "all-mismatch",
+			nodefile: []string{"n1", "n1", "n1"},
+			env:      map[string]string{"PBS_NUM_NODES": "2", "PBS_NUM_PPN": "2"},
+			warnings: []string{
+				"PBS_NUM_NODES is 2, but PBS_NODEFILE lists 1 unique hosts",
+				"PBS_NUM_PPN is 2, but PBS_NODEFILE lists 3 slots on n1",
+				"PBS_NUM_NODES x PBS_NUM_PPN is 4, but PBS_NODEFILE lists 3 slots",
+			},
+		},
+		{
+			name:     "empty-nodefile",
+			nodefile: []string{},
+			env:      map[string]string{"PBS_NUM_NODES": "2"},
+			warnings: []string{"PBS_NODEFILE is missing, unreadable or empty"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.env["PBS_NODEFILE"] = writeTempFile(t, "nodefile", tc.nodefile...)
+			env := MapEnv(tc.env)
+			s := pbsScheduler{}
+			assert.Equal(t, tc.warnings, s.Validate(env, s.JobInfo(env)))
+		})
+	}
+}
+
+func TestGetJobInfoWarnings(t *testing.T) {
+	env := MapEnv(map[string]string{
+		"PBS_JOBID":     "1.moab",
+		"PBS_NUM_NODES": "1",
+		"PBS_NUM_PPN":   "4",
+		"PBS_NODEFILE":  writeTempFile(t, "nodefile", "n1", "n1"),
+	})
+	info := getJobInfo(pbsScheduler{}, env)
+	assert.Equal(t, []string{
+		"PBS_NUM_PPN is 4, but PBS_NODEFILE lists 2 slots on n1",
+		"PBS_NUM_NODES x PBS_NUM_PPN is 4, but PBS_NODEFILE lists 2 slots",
+	}, info.Warnings)
+	assert.Equal(t, intPtr(2), info.Job.SlotCount)
+
+	// Schedulers which do not implement Validator never report warnings.
+	info = getJobInfo(slurmScheduler{}, MapEnv(map[string]string{"SLURM_JOB_ID": "1"}))
+	assert.Nil(t, info.Warnings)
+}
+
+func TestPBSSchedulerJobID(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		expect *int
+	}{
+		{name: "moab", env: map[string]string{"MOAB_JOBID": "42", "PBS_JOBID": "43.server"}, expect: intPtr(42)},
+		{name: "pbs", env: map[string]string{"PBS_JOBID": "43.server"}, expect: intPtr(43)},
+		{name: "pbs-array", env: map[string]string{"PBS_JOBID": "43[1].server"}},
+		{name: "missing", env: map[string]string{}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, pbsScheduler{}.jobID(MapEnv(tc.env)))
+		})
+	}
+}
+
+func TestSchedulerID(t *testing.T) {
+	tests := []struct {
+		name   string
+		sched  Scheduler
+		env    map[string]string
+		expect string
+	}{
+		{name: "pbs", sched: pbsScheduler{}, env: map[string]string{"PBS_JOBID": "43.server"}, expect: "43"},
+		{name: "pbs-array", sched: pbsScheduler{}, env: map[string]string{"PBS_JOBID": "43[1].server"}, expect: "43[1]"},
+		{name: "moab", sched: pbsScheduler{}, env: map[string]string{"MOAB_JOBID": "42", "PBS_JOBID": "43.server"}, expect: "42"},
+		{name: "pbs-missing", sched: pbsScheduler{}, env: map[string]string{}},
+		{name: "slurm-array", sched: slurmScheduler{}, env: map[string]string{"SLURM_JOB_ID": "101", "SLURM_ARRAY_JOB_ID": "100", "SLURM_ARRAY_TASK_ID": "1"}, expect: "101"},
+		{name: "lsf", sched: lsfScheduler{}, env: map[string]string{"LSB_JOBID": "77", "LSB_JOBINDEX": "0"}, expect: "77"},
+		{name: "lsf-array", sched: lsfScheduler{}, env: map[string]string{"LSB_JOBID": "77", "LSB_JOBINDEX": "5"}, expect: "77[5]"},
+		{name: "lsf-missing", sched: lsfScheduler{}, env: map[string]string{"LSB_JOBINDEX": "5"}},
+		{name: "sge", sched: sgeScheduler{}, env: map[string]string{"JOB_ID": "55", "SGE_TASK_ID": "undefined"}, expect: "55"},
+		{name: "sge-array", sched: sgeScheduler{}, env: map[string]string{"JOB_ID": "55", "SGE_TASK_ID": "5"}, expect: "55.5"},
+		{name: "sge-missing", sched: sgeScheduler{}, env: map[string]string{"SGE_TASK_ID": "5"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, tc.sched.JobInfo(MapEnv(tc.env)).SchedulerID)
+		})
+	}
+}
+
+func TestPBSSchedulerMissingNodefile(t *testing.T) {
+	s := pbsScheduler{}
+	assert.Nil(t, s.JobInfo(MapEnv(nil)).Nodes)
+	assert.Nil(t, s.JobInfo(MapEnv(map[string]string{
+		"PBS_NODEFILE": filepath.Join(t.TempDir(), "missing"),
+	})).Nodes)
+}
+
+func TestSlurmScheduler(t *testing.T) {
+	env := MapEnv(map[string]string{
+		"SLURM_JOB_ID":            "998",
+		"SLURM_JOB_NAME":          "train",
+		"SLURM_JOB_USER":          "ab123",
+		"SLURM_JOB_ACCOUNT":       "ml",
+		"SLURM_JOB_NUM_NODES":     "2",
+		"SLURM_JOB_NODELIST":      "gpu[1-2]",
+		"SLURM_NTASKS_PER_NODE":   "4",
+		"SLURM_NTASKS":            "8",
+		"SLURM_JOB_CPUS_PER_NODE": "8(x2)",
+		"SLURM_JOB_START_TIME":    "1000",
+		"SLURM_JOB_END_TIME":      "4600",
+		"SLURM_JOB_PARTITION":     "gpu",
+		"SLURM_NODEID":            "0",
+	})
+	s := slurmScheduler{}
+	assert.Equal(t, JobInfo{
+		Name:          "train",
+		Authorization: "ab123",
+		Entitlement:   "ml",
+		ID:            intPtr(998),
+		SchedulerID:   "998",
+		NodeCount:     intPtr(2),
+		Nodes:         []string{"gpu1", "gpu2"},
+		NodeList:      "gpu[1-2]",
+		Hosts:         []HostSlots{{Name: "gpu1", Slots: intPtr(8)}, {Name: "gpu2", Slots: intPtr(8)}},
+		SlotCount:     intPtr(16),
+		PPN:           intPtr(4),
+		TaskCount:     intPtr(8),
+		Walltime:      intPtr(3600),
+		Queue:         "gpu",
+	}, s.JobInfo(env))
+	assert.Equal(t, intPtr(0), s.NodeIndex(env, "gpu1"))
+}
+
+func TestSlurmSchedulerNodelist(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodelist string
+		expect   []string
+	}{
+		{name: "empty", nodelist: "", expect: nil},
+		{name: "single", nodelist: "cpu1", expect: []string{"cpu1"}},
+		{name: "compressed", nodelist: "node[001-002,007],gpu[1-2]", expect: []string{"node001", "node002", "node007", "gpu1", "gpu2"}},
+		{name: "malformed", nodelist: "node[001-002", expect: nil},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			env := MapEnv(map[string]string{"SLURM_JOB_ID": "1", "SLURM_JOB_NODELIST": tc.nodelist})
+			assert.Equal(t, tc.expect, slurmScheduler{}.JobInfo(env).Nodes)
+		})
+	}
+}
+
+func TestSlurmSchedulerCPUsPerNode(t *testing.T) {
+	tests := []struct {
+		name      string
+		nodelist  string
+		cpus      string
+		hosts     []HostSlots
+		slotCount *int
+	}{
+		{
+			name:      "repeated",
+			nodelist:  "n[1-3]",
+			cpus:      "72(x2),36",
+			hosts:     []HostSlots{{Name: "n1", Slots: intPtr(72)}, {Name: "n2", Slots: intPtr(72)}, {Name: "n3", Slots: intPtr(36)}},
+			slotCount: intPtr(180),
+		},
+		{
+			name:     "missing",
+			nodelist: "n[1-2]",
+			hosts:    []HostSlots{{Name: "n1"}, {Name: "n2"}},
+		},
+		{
+			name:     "length-mismatch",
+			nodelist: "n[1-2]",
+			cpus:     "4",
+			hosts:    []HostSlots{{Name: "n1"}, {Name: "n2"}},
+		},
+		{
+			name:     "malformed",
+			nodelist: "n[1-2]",
+			cpus:     "4(x",
+			hosts:    []HostSlots{{Name: "n1"}, {Name: "n2"}},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			env := MapEnv(map[string]string{
+				"SLURM_JOB_ID":            "1",
+				"SLURM_JOB_NODELIST":      tc.nodelist,
+				"SLURM_JOB_CPUS_PER_NODE": tc.cpus,
+			})
+			job := slurmScheduler{}.JobInfo(env)
+			assert.Equal(t, tc.hosts, job.Hosts)
+			assert.Equal(t, tc.slotCount, job.SlotCount)
+		})
+	}
+}
+
+func TestSlurmSchedulerLegacyVars(t *testing.T) {
+	env := MapEnv(map[string]string{
+		"SLURM_JOBID":        "998",
+		"USER":               "ab123",
+		"SLURM_NNODES":       "1",
+		"SLURM_NODELIST":     "cpu1",
+		"SLURM_CPUS_ON_NODE": "16",
+		"SLURM_NPROCS":       "16",
+	})
+	info := slurmScheduler{}.JobInfo(env)
+	assert.Equal(t, intPtr(998), info.ID)
+	assert.Equal(t, "ab123", info.Authorization)
+	assert.Equal(t, intPtr(1), info.NodeCount)
+	assert.Equal(t, []string{"cpu1"}, info.Nodes)
+	assert.Equal(t, intPtr(16), info.PPN)
+	assert.Equal(t, intPtr(16), info.TaskCount)
+	assert.Nil(t, info.Walltime)
+}
+
+func TestLSFScheduler(t *testing.T) {
+	env := MapEnv(map[string]string{
+		"LSB_JOBID":        "77",
+		"LSB_JOBNAME":      "md",
+		"LSFUSER":          "ab123",
+		"LSB_PROJECT_NAME": "chem",
+		"LSB_MCPU_HOSTS":   "hostA 2 hostB 2",
+		"LSB_DJOB_NUMPROC": "4",
+		"LSB_QUEUE":        "normal",
+	})
+	s := lsfScheduler{}
+	assert.Equal(t, JobInfo{
+		Name:          "md",
+		Authorization: "ab123",
+		Entitlement:   "chem",
+		ID:            intPtr(77),
+		SchedulerID:   "77",
+		NodeCount:     intPtr(2),
+		Nodes:         []string{"hostA", "hostB"},
+		NodeList:      "hostA,hostB",
+		Hosts:         []HostSlots{{Name: "hostA", Slots: intPtr(2)}, {Name: "hostB", Slots: intPtr(2)}},
+		SlotCount:     intPtr(4),
+		PPN:           intPtr(2),
+		TaskCount:     intPtr(4),
+		Queue:         "normal",
+	}, s.JobInfo(env))
+	assert.Equal(t, intPtr(1), s.NodeIndex(env, "hostB.cluster.local"))
+	assert.Nil(t, s.NodeIndex(env, "hostC"))
+}
+
+func TestLSFSchedulerHosts(t *testing.T) {
+	env := MapEnv(map[string]string{
+		"LSB_JOBID":      "77",
+		"LSB_MCPU_HOSTS": "invalid",
+		"LSB_HOSTS":      "hostA hostA hostA hostB hostB hostB",
+	})
+	info := lsfScheduler{}.JobInfo(env)
+	assert.Equal(t, intPtr(2), info.NodeCount)
+	assert.Equal(t, intPtr(3), info.PPN)
+	assert.Equal(t, intPtr(6), info.SlotCount)
+	assert.Equal(t, []string{"hostA", "hostB"}, info.Nodes)
+}
+
+func TestSGEScheduler(t *testing.T) {
+	hostfile := writeTempFile(t, "pe_hostfile",
+		"node1.cluster 4 all.q@node1.cluster UNDEFINED",
+		"node2.cluster 4 all.q@node2.cluster UNDEFINED",
+	)
+	env := MapEnv(map[string]string{
+		"SGE_ROOT":      "/opt/sge",
+		"JOB_ID":        "55",
+		"JOB_NAME":      "blast",
+		"SGE_O_LOGNAME": "ab123",
+		"NHOSTS":        "2",
+		"NSLOTS":        "8",
+		"QUEUE":         "all.q",
+		"PE_HOSTFILE":   hostfile,
+	})
+	s := sgeScheduler{}
+	info := s.JobInfo(env)
+	assert.Equal(t, "blast", info.Name)
+	assert.Equal(t, "ab123", info.Authorization)
+	assert.Equal(t, intPtr(55), info.ID)
+	assert.Equal(t, intPtr(2), info.NodeCount)
+	assert.Equal(t, []string{"node1.cluster", "node2.cluster"}, info.Nodes)
+	assert.Equal(t, intPtr(8), info.SlotCount)
+	assert.Equal(t, intPtr(4), info.PPN)
+	assert.Equal(t, intPtr(8), info.TaskCount)
+	assert.Equal(t, "all.q", info.Queue)
+	assert.Equal(t, intPtr(1), s.NodeIndex(env, "node2"))
+}
+
+func TestSGESchedulerSerial(t *testing.T) {
+	env := MapEnv(map[string]string{
+		"SGE_ROOT": "/opt/sge",
+		"JOB_ID":   "55",
+		"HOSTNAME": "node7",
+		"NSLOTS":   "1",
+	})
+	s := sgeScheduler{}
+	info := s.JobInfo(env)
+	assert.Equal(t, []string{"node7"}, info.Nodes)
+	assert.Equal(t, intPtr(1), info.PPN)
+	assert.Equal(t, intPtr(0), s.NodeIndex(env, "node7"))
+}
+
+func TestEnvInt(t *testing.T) {
+	env := MapEnv(map[string]string{"A": "1", "B": "x", "C": "3"})
+	assert.Equal(t, intPtr(1), env.Int("A"))
+	assert.Nil(t, env.Int("B"))
+	assert.Nil(t, env.Int("B", "C"), "first present variable wins")
+	assert.Equal(t, intPtr(3), env.Int("MISSING", "C"))
+	assert.Nil(t, env.Int("MISSING"))
+}
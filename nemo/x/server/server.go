@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Options for the metadata server.
+type Options struct {
+	// Port to listen on
+	Port int
+	// Scheduler backend
+	Scheduler Scheduler
+	// Environment to read job info from
+	Env Env
+	// Time at which the job started. If zero, it is taken from
+	// the scheduler if available, otherwise server start time is used.
+	JobStart time.Time
+	// Remaining walltime at which warnings are fired
+	WalltimeWarnings []time.Duration
+	// Number of events kept in history for clients to resume from
+	EventHistory int
+	// Bearer token required by mutating endpoints. If empty,
+	// a random token is generated.
+	Token string
+	// Path of the file token is written to
+	TokenFile string
+	// Require token on read only endpoints as well
+	AuthRead bool
+	// Path of Unix domain socket to listen on in addition to TCP port.
+	// Disabled if empty.
+	Socket string
+	// Time allowed for in-flight requests to complete on shutdown
+	DrainTimeout time.Duration
+	// Root filesystem to read /proc, /sys and files named by scheduler
+	// variables, like PBS_NODEFILE, from. If nil, host root filesystem is used.
+	Root fs.FS
+	// Default window over which CPU utilization is sampled
+	ResourceWindow time.Duration
+	// Directory to write discovery file to. Disabled if empty.
+	RuntimeDir string
+	// Variables which must be set for the server to be ready
+	RequiredEnv []string
+	// Peers, as host:port, which must be reachable for the server to be ready
+	Peers []string
+	// Time allowed for each health check
+	CheckTimeout time.Duration
+	// Addresses, as host:port, of servers on other nodes of the job keyed
+	// by node name. Servers not listed are expected to listen on Port.
+	NodeAddrs map[string]string
+	// Time allowed for each node to respond when aggregating cluster view
+	PeerTimeout time.Duration
+	// Address, as host:port, of server on the head node to register with.
+	// If empty, it is expected to listen on Port of the first node of the job.
+	Head string
+	// Token shared by servers on all nodes of the job, used to register
+	// with the head node and to forward requests to it. If empty, servers
+	// on other nodes do not register and requests are not forwarded.
+	ClusterToken string
+	// Time after which nodes which stopped sending heartbeats are lost
+	MemberTTL time.Duration
+	// Time between heartbeats sent to the head node
+	HeartbeatInterval time.Duration
+	// Path of Moab checkjob executable. If empty, it is looked up in PATH.
+	Checkjob string
+	// Time job details reported by checkjob are cached for
+	CheckjobCache time.Duration
+	// Paths of Torque qstat and pbsnodes executables.
+	// If empty, they are looked up in PATH.
+	Qstat    string
+	Pbsnodes string
+	// File key/value store is saved to after every change and loaded
+	// from on start. If empty, it is only held in memory.
+	KVSnapshot string
+	// Signals which may be sent to job processes over /signal,
+	// named with or without SIG prefix. Defaults to USR1 and USR2.
+	AllowedSignals []string
+}
+
+// Server is the job metadata server.
+type Server struct {
+	opts      Options
+	mux       *http.ServeMux
+	walltime  *Walltime
+	events    *EventBus
+	auth      *Auth
+	metrics   *Metrics
+	resources *ResourceReader
+	processes *ProcessReader
+	health    *Health
+	checkjob  *Checkjob
+	members   *Membership
+	kv        *KVStore
+	barriers  *Barriers
+	signals   *SignalRelay
+	started   time.Time
+	// shutdown requests server to shutdown.
+	shutdown func()
+	// draining is closed when server starts to drain.
+	draining  chan struct{}
+	drainOnce sync.Once
+}
+
+// NewServer returns a new metadata server. shutdown is called
+// when a client requests the server to shutdown.
+func NewServer(opts Options, shutdown func()) *Server {
+	s := &Server{
+		opts:     opts,
+		mux:      http.NewServeMux(),
+		events:   NewEventBus(opts.EventHistory),
+		shutdown: shutdown,
+		draining: make(chan struct{}),
+		metrics:  NewMetrics(),
+		health:   NewHealth(opts.CheckTimeout),
+		checkjob: NewCheckjob(opts.Checkjob, opts.CheckjobCache),
+		started:  time.Now(),
+	}
+
+	if s.opts.Token == "" {
+		token, err := newToken()
+		if err != nil {
+			// crypto/rand never fails on supported platforms.
+			panic(err)
+		}
+		s.opts.Token = token
+	}
+	s.auth = NewAuth(s.opts.Token, opts.AuthRead)
+	s.auth.AllowCluster(opts.ClusterToken)
+	s.members = NewMembership(opts.MemberTTL, s.events)
+	kv, err := NewKVStore(opts.KVSnapshot)
+	if err != nil {
+		log.Printf("[ERROR] %s, starting with empty key/value store", err)
+	}
+	s.kv = kv
+	s.barriers = NewBarriers(s.events)
+	if s.opts.HeartbeatInterval <= 0 {
+		s.opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if s.opts.PeerTimeout <= 0 {
+		s.opts.PeerTimeout = defaultPeerTimeout
+	}
+	if s.opts.Qstat == "" {
+		s.opts.Qstat = "qstat"
+	}
+	if s.opts.Pbsnodes == "" {
+		s.opts.Pbsnodes = "pbsnodes"
+	}
+	if s.opts.Root == nil {
+		s.opts.Root = os.DirFS("/")
+	} else {
+		s.opts.Env = s.opts.Env.WithFS(s.opts.Root)
+	}
+	s.resources = NewResourceReader(s.opts.Root, opts.ResourceWindow)
+	s.processes = NewProcessReader(s.opts.Root, os.Getpid(), s.opts.Env)
+	if len(s.opts.AllowedSignals) == 0 {
+		s.opts.AllowedSignals = defaultAllowedSignals
+	}
+	s.signals = NewSignalRelay(s.processes, s.events, s.opts.AllowedSignals)
+
+	start := opts.JobStart
+	if start.IsZero() {
+		if st, ok := opts.Scheduler.(StartTimer); ok {
+			start, _ = st.StartTime(s.opts.Env)
+		}
+	}
+	if start.IsZero() {
+		start = time.Now()
+	}
+	var limit time.Duration
+	if walltime := opts.Scheduler.JobInfo(s.opts.Env).Walltime; walltime != nil {
+		limit = time.Duration(*walltime) * time.Second
+	}
+	s.walltime = NewWalltime(start, limit, opts.WalltimeWarnings)
+	s.registerChecks()
+
+	s.handle("/", accessPublic, s.handleIndex)
+	s.handle("/healthz", accessPublic, s.handleProbe(probeLiveness))
+	s.handle("/readyz", accessPublic, s.handleProbe(probeReadiness))
+	s.handle("/info", accessRead, s.handleInfo)
+	s.handle("/walltime", accessRead, s.handleWalltime)
+	s.handle("/events", accessRead, s.handleEvents)
+	s.handle("/metrics", accessRead, s.handleMetrics)
+	s.handle("/node/resources", accessRead, s.handleNodeResources)
+	s.handle("/processes", accessRead, s.handleProcesses)
+	s.handle("/job/details", accessRead, s.handleJobDetails)
+	s.handle("/job/array", accessRead, s.handleJobArray)
+	s.handle("/queue", accessRead, s.handleQueue)
+	s.handle("/nodes/state", accessRead, s.handleNodesState)
+	s.handle("/cluster", accessRead, s.handleCluster)
+	s.handle("/register", accessCluster, s.handleRegister)
+	s.handle("/members", accessRead, s.handleMembers)
+	s.handle("/kv/", accessCluster, s.handleKV)
+	s.handle("/barrier/", accessCluster, s.handleBarrier)
+	s.handle("/signal", accessCluster, s.handleSignal)
+	s.handle("/cluster/signal", accessCluster, s.handleClusterSignal)
+	s.handle("/diagnostics", accessRead, s.handleDiagnostics)
+	s.handle("/shutdown", accessWrite, s.handleShutdown)
+	return s
+}
+
+// handle registers handler for pattern, requiring given access.
+func (s *Server) handle(pattern string, level access, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, s.auth.Require(level, handler))
+}
+
+// Run runs background tasks of the server until ctx is done.
+// Walltime thresholds are published as events as they are crossed.
+func (s *Server) Run(ctx context.Context) {
+	ch, unsubscribe := s.walltime.Subscribe()
+	defer unsubscribe()
+	go s.walltime.Run(ctx)
+	go s.members.Run(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case threshold := <-ch:
+			s.events.Publish(EventWalltimeThreshold, threshold)
+		}
+	}
+}
+
+// requestShutdown starts draining and requests server to shutdown.
+func (s *Server) requestShutdown(reason string) {
+	s.Drain(reason)
+	s.shutdown()
+}
+
+// Drain publishes shutdown.requested event and ends long running requests
+// like event streams and walltime waits, so that server can shutdown
+// without waiting for them. Only the first call has any effect.
+func (s *Server) Drain(reason string) {
+	s.drainOnce.Do(func() {
+		s.events.Publish(EventShutdownRequested, map[string]string{"reason": reason})
+		close(s.draining)
+	})
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[INFO] %s %s", r.Method, r.RequestURI)
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	_, pattern := s.mux.Handler(r)
+	defer func() {
+		s.metrics.Observe(pattern, rec.status, time.Since(start))
+	}()
+	w = rec
+
+	if err := s.auth.PeerAuthorized(r); err != nil {
+		log.Printf("[WARN] Rejected request over socket: %s", err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, http.StatusOK, getJobInfo(s.opts.Scheduler, s.opts.Env))
+}
+
+// handleWalltime returns walltime status. If wait query parameter
+// is set to a duration, request blocks until the next walltime
+// threshold is crossed or wait duration elapses, whichever is first.
+func (s *Server) handleWalltime(w http.ResponseWriter, r *http.Request) {
+	if value := r.URL.Query().Get("wait"); value != "" {
+		wait, err := time.ParseDuration(value)
+		if err != nil || wait <= 0 {
+			http.Error(w, "wait must be a positive duration like 30m", http.StatusBadRequest)
+			return
+		}
+		ch, unsubscribe := s.walltime.Subscribe()
+		defer unsubscribe()
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-ch:
+		case <-timer.C:
+		case <-s.draining:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	writeResponse(w, r, http.StatusOK, s.walltime.Status())
+}
+
+// handleShutdown requests the server to shutdown. It only accepts
+// POST with the instance token, as GET requests may be sent by
+// browsers and link prefetchers.
+func (s *Server) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	s.requestShutdown("request")
+}
+
+// server runs the metadata server until it is shutdown
+// and returns exit code of the process.
+func server(opts Options) int {
+	log.Printf("[INFO] Using scheduler: %s", opts.Scheduler.Name())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lifecycle := NewLifecycle(opts.DrainTimeout)
+	handler := NewServer(opts, func() { lifecycle.Shutdown("request") })
+	lifecycle.OnSignal = func(sig os.Signal) {
+		handler.events.Publish(EventSignalReceived, map[string]string{"signal": sig.String()})
+	}
+	lifecycle.PreShutdown("drain", func(ctx context.Context, reason string) error {
+		handler.Drain(reason)
+		return nil
+	})
+
+	if opts.TokenFile != "" {
+		if err := writeTokenFile(opts.TokenFile, handler.opts.Token); err != nil {
+			log.Printf("[ERROR] Failed to write token file: %s", err)
+			return exitStartupFailure
+		}
+		defer os.Remove(opts.TokenFile)
+		log.Printf("[INFO] Token written to: %s", opts.TokenFile)
+	}
+
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", opts.Port))
+	if err != nil {
+		log.Printf("[ERROR] Failed to listen on port %d: %s", opts.Port, err)
+		return exitStartupFailure
+	}
+	listeners = append(listeners, l)
+	// Port is picked by the kernel if it is 0.
+	port := l.Addr().(*net.TCPAddr).Port
+	log.Printf("[INFO] Running on port: %d with PID:%d", port, os.Getpid())
+
+	if opts.Socket != "" {
+		l, err := listenUnix(opts.Socket)
+		if err != nil {
+			log.Printf("[ERROR] Failed to listen on socket: %s", err)
+			return exitStartupFailure
+		}
+		listeners = append(listeners, l)
+		log.Printf("[INFO] Listening on socket: %s", opts.Socket)
+	}
+
+	if opts.RuntimeDir != "" {
+		remove, err := publishDiscovery(opts.RuntimeDir, Discovery{
+			Address:   fmt.Sprintf("127.0.0.1:%d", port),
+			Port:      port,
+			Socket:    opts.Socket,
+			PID:       os.Getpid(),
+			JobID:     discoveryJobID(opts.Scheduler.JobInfo(handler.opts.Env), os.Getpid()),
+			TokenFile: opts.TokenFile,
+			StartTime: handler.started,
+		})
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return exitStartupFailure
+		}
+		defer remove()
+	}
+
+	go handler.Run(ctx)
+	go handler.Heartbeat(ctx, port)
+	handler.events.Publish(EventServerStarted, map[string]int{"pid": os.Getpid(), "port": port})
+
+	s := &http.Server{Handler: handler, ConnContext: connContext}
+	code := lifecycle.Run(s, listeners...)
+	log.Printf("[INFO] Finished")
+	return code
+}
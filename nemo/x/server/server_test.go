@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nodeFS is a root filesystem holding nodefiles of test jobs.
+var nodeFS = fstest.MapFS{
+	"var/spool/pbs/aux/1.server": {Data: []byte("n1\nn1\n\nn2\nn2\n")},
+	"var/spool/pbs/aux/2.server": {Data: []byte("")},
+	"var/spool/pbs/aux/dir":      {Mode: os.ModeDir},
+	"var/spool/sge/hostfile":     {Data: []byte("n1 4 all.q UNDEFINED\nn2 2 all.q UNDEFINED\n")},
+}
+
+// newEnvServer returns test server for scheduler, backed by vars and nodeFS.
+func newEnvServer(t *testing.T, sched Scheduler, vars map[string]string) *httptest.Server {
+	t.Helper()
+	_, ts := newOptionsServer(t, Options{Scheduler: sched, Env: MapEnv(vars)})
+	return ts
+}
+
+// newOptionsServer returns server for opts along with test server serving
+// it. Root defaults to nodeFS and Token to testToken.
+func newOptionsServer(t *testing.T, opts Options) (*Server, *httptest.Server) {
+	t.Helper()
+	if opts.Root == nil {
+		opts.Root = nodeFS
+	}
+	if opts.Token == "" {
+		opts.Token = testToken
+	}
+	s := NewServer(opts, func() {})
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// getInto gets path from ts and decodes JSON response into v.
+// It returns HTTP status code.
+func getInto(t *testing.T, ts *httptest.Server, path string, v interface{}) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return 0
+	}
+	defer resp.Body.Close()
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+	return resp.StatusCode
+}
+
+func TestHandleInfo(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		name     string
+		sched    Scheduler
+		env      map[string]string
+		job      JobInfo
+		warnings []string
+	}{
+		{
+			name:  "pbs",
+			sched: pbsScheduler{},
+			env: map[string]string{
+				"PBS_JOBID":     "1.server",
+				"PBS_JOBNAME":   "sim",
+				"PBS_O_LOGNAME": "alice",
+				"PBS_NUM_NODES": "2",
+				"PBS_NUM_PPN":   "2",
+				"PBS_NP":        "4",
+				"PBS_WALLTIME":  "3600",
+				"PBS_QUEUE":     "batch",
+				"PBS_NODEFILE":  "/var/spool/pbs/aux/1.server",
+			},
+			job: JobInfo{
+				Name: "sim", Authorization: "alice", ID: intPtr(1), SchedulerID: "1",
+				NodeCount: intPtr(2), Nodes: []string{"n1", "n2"}, NodeList: "n[1-2]",
+				Hosts:     []HostSlots{{Name: "n1", Slots: intPtr(2)}, {Name: "n2", Slots: intPtr(2)}},
+				SlotCount: intPtr(4), PPN: intPtr(2), TaskCount: intPtr(4), Walltime: intPtr(3600), Queue: "batch",
+			},
+		},
+		{
+			name:     "missing-vars",
+			sched:    pbsScheduler{},
+			env:      map[string]string{},
+			job:      JobInfo{},
+			warnings: []string{"PBS_NODEFILE is missing, unreadable or empty"},
+		},
+		{
+			name:  "malformed-ints",
+			sched: pbsScheduler{},
+			env: map[string]string{
+				"PBS_JOBID":     "x.server",
+				"PBS_NUM_NODES": "two",
+				"PBS_NUM_PPN":   "2.5",
+				"PBS_NP":        "",
+				"PBS_WALLTIME":  "1h",
+				"PBS_NODEFILE":  "/var/spool/pbs/aux/1.server",
+			},
+			job: JobInfo{
+				SchedulerID: "x", Nodes: []string{"n1", "n2"}, NodeList: "n[1-2]",
+				Hosts:     []HostSlots{{Name: "n1", Slots: intPtr(2)}, {Name: "n2", Slots: intPtr(2)}},
+				SlotCount: intPtr(4)},
+		},
+		{
+			name:     "nodefile-missing",
+			sched:    pbsScheduler{},
+			env:      map[string]string{"PBS_JOBID": "1.server", "PBS_NODEFILE": "/var/spool/pbs/aux/3.server"},
+			job:      JobInfo{ID: intPtr(1), SchedulerID: "1"},
+			warnings: []string{"PBS_NODEFILE is missing, unreadable or empty"},
+		},
+		{
+			name:     "nodefile-directory",
+			sched:    pbsScheduler{},
+			env:      map[string]string{"PBS_JOBID": "1.server", "PBS_NODEFILE": "/var/spool/pbs/aux/dir"},
+			job:      JobInfo{ID: intPtr(1), SchedulerID: "1"},
+			warnings: []string{"PBS_NODEFILE is missing, unreadable or empty"},
+		},
+		{
+			name:     "nodefile-empty",
+			sched:    pbsScheduler{},
+			env:      map[string]string{"PBS_JOBID": "2.server", "PBS_NODEFILE": "/var/spool/pbs/aux/2.server"},
+			job:      JobInfo{ID: intPtr(2), SchedulerID: "2"},
+			warnings: []string{"PBS_NODEFILE is missing, unreadable or empty"},
+		},
+		{
+			name:  "sge-hostfile",
+			sched: sgeScheduler{},
+			env:   map[string]string{"JOB_ID": "7", "NHOSTS": "2", "NSLOTS": "6", "PE_HOSTFILE": "/var/spool/sge/hostfile"},
+			job: JobInfo{
+				ID: intPtr(7), SchedulerID: "7", NodeCount: intPtr(2), Nodes: []string{"n1", "n2"}, NodeList: "n[1-2]",
+				Hosts:     []HostSlots{{Name: "n1", Slots: intPtr(4)}, {Name: "n2", Slots: intPtr(2)}},
+				SlotCount: intPtr(6), PPN: intPtr(4), TaskCount: intPtr(6)},
+		},
+		{
+			name:  "slurm-partial",
+			sched: slurmScheduler{},
+			env:   map[string]string{"SLURM_JOB_ID": "9", "SLURM_JOB_NODELIST": "n[1-2]"},
+			job: JobInfo{
+				ID: intPtr(9), SchedulerID: "9", Nodes: []string{"n1", "n2"}, NodeList: "n[1-2]",
+				Hosts: []HostSlots{{Name: "n1"}, {Name: "n2"}},
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newEnvServer(t, tc.sched, tc.env)
+			var info Info
+			assert.Equal(t, http.StatusOK, getInto(t, ts, "/info", &info))
+			assert.Equal(t, tc.job, info.Job)
+			assert.Equal(t, tc.warnings, info.Warnings)
+			assert.Equal(t, hostname, info.Node.Name)
+			assert.Equal(t, os.Getpid(), info.Node.PID)
+		})
+	}
+}
+
+func TestHandleWalltimeEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		limit *int
+	}{
+		{name: "seconds", env: map[string]string{"PBS_WALLTIME": "3600"}, limit: intPtr(3600)},
+		{name: "moab", env: map[string]string{"PBS_WALLTIME": "01:00:00"}, limit: intPtr(3600)},
+		{name: "malformed", env: map[string]string{"PBS_WALLTIME": "soon"}},
+		{name: "missing", env: map[string]string{}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newEnvServer(t, pbsScheduler{}, tc.env)
+			var status WalltimeStatus
+			assert.Equal(t, http.StatusOK, getInto(t, ts, "/walltime", &status))
+			assert.Equal(t, tc.limit, status.Limit)
+			assert.Equal(t, tc.limit == nil, status.Deadline == nil)
+		})
+	}
+}
+
+func TestReadyzNodefile(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodefile string
+		code     int
+	}{
+		{name: "readable", nodefile: "/var/spool/pbs/aux/1.server", code: http.StatusOK},
+		{name: "missing", nodefile: "/var/spool/pbs/aux/3.server", code: http.StatusServiceUnavailable},
+		{name: "empty", nodefile: "/var/spool/pbs/aux/2.server", code: http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newEnvServer(t, pbsScheduler{}, map[string]string{"PBS_NODEFILE": tc.nodefile})
+			var report HealthReport
+			assert.Equal(t, tc.code, getInto(t, ts, "/readyz", &report))
+		})
+	}
+}
+
+func TestEnvReadLines(t *testing.T) {
+	env := MapEnv(nil).WithFS(nodeFS)
+	lines, err := env.ReadLines("/var/spool/pbs/aux/1.server")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"n1", "n1", "n2", "n2"}, lines)
+
+	_, err = env.ReadLines("/var/spool/pbs/aux/3.server")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Contains(t, err.Error(), "/var/spool/pbs/aux/3.server")
+
+	// Without a filesystem, files are read from the host.
+	path := writeTempFile(t, "nodefile", " n1 ", "n2")
+	lines, err = MapEnv(nil).ReadLines(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"n1", "n2"}, lines)
+}
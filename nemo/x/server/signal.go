@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxSignalHistory is number of signal deliveries kept in history.
+const maxSignalHistory = 100
+
+// defaultAllowedSignals are signals which may be sent to job processes,
+// unless configured otherwise. They are used to trigger checkpoints.
+var defaultAllowedSignals = []string{"USR1", "USR2"}
+
+var (
+	// ErrSignalNotAllowed is returned when signal is not in the allowlist.
+	ErrSignalNotAllowed = errors.New("signal is not allowed")
+	// ErrNotHeadSignal is returned when signal to all nodes is requested
+	// from a node other than the head node of the job.
+	ErrNotHeadSignal = errors.New("signals to all nodes are only sent by the first node of the job")
+)
+
+// EventSignalDelivered is published when a signal is sent to job processes.
+const EventSignalDelivered EventType = "signal.delivered"
+
+// SignalTarget is outcome of sending a signal to a process.
+type SignalTarget struct {
+	PID       int    `json:"pid" yaml:"pid" hcl:"pid"`
+	Command   string `json:"command" yaml:"command" hcl:"command"`
+	Delivered bool   `json:"delivered" yaml:"delivered" hcl:"delivered"`
+	// Why signal was not delivered
+	Error string `json:"error,omitempty" yaml:"error,omitempty" hcl:"error,omitempty"`
+}
+
+// SignalDelivery is a record of a signal sent to job processes on a node.
+type SignalDelivery struct {
+	// IDs are sequential, starting from 1 when the server starts
+	ID   uint64    `json:"id" yaml:"id" hcl:"id"`
+	Time time.Time `json:"time" yaml:"time" hcl:"time"`
+	// Signal name, like SIGUSR1
+	Signal string `json:"signal" yaml:"signal" hcl:"signal"`
+	Node   string `json:"node" yaml:"node" hcl:"node"`
+	// Address the request came from
+	Requester string         `json:"requester" yaml:"requester" hcl:"requester"`
+	Targets   []SignalTarget `json:"targets" yaml:"targets" hcl:"targets"`
+	Delivered int            `json:"delivered" yaml:"delivered" hcl:"delivered"`
+	Failed    int            `json:"failed" yaml:"failed" hcl:"failed"`
+}
+
+// SignalHistory is the list of recent signal deliveries, oldest first.
+type SignalHistory struct {
+	Count      int              `json:"count" yaml:"count" hcl:"count"`
+	Deliveries []SignalDelivery `json:"deliveries" yaml:"deliveries" hcl:"deliveries"`
+}
+
+// NodeSignal is outcome of sending a signal to job processes on a node.
+type NodeSignal struct {
+	Name    string `json:"name" yaml:"name" hcl:"name"`
+	Address string `json:"address" yaml:"address" hcl:"address"`
+	// Whether server on the node responded
+	Reachable bool            `json:"reachable" yaml:"reachable" hcl:"reachable"`
+	Error     string          `json:"error,omitempty" yaml:"error,omitempty" hcl:"error,omitempty"`
+	Delivery  *SignalDelivery `json:"delivery" yaml:"delivery" hcl:"delivery"`
+}
+
+// ClusterSignal is outcome of sending a signal to job processes on all nodes.
+type ClusterSignal struct {
+	Signal string `json:"signal" yaml:"signal" hcl:"signal"`
+	// Number of processes signal was delivered to on all nodes
+	Delivered int `json:"delivered" yaml:"delivered" hcl:"delivered"`
+	Failed    int `json:"failed" yaml:"failed" hcl:"failed"`
+	// Nodes whose server did not respond
+	Unreachable []string     `json:"unreachable" yaml:"unreachable" hcl:"unreachable"`
+	Nodes       []NodeSignal `json:"nodes" yaml:"nodes" hcl:"nodes"`
+}
+
+// signalFilter selects job processes a signal is sent to.
+type signalFilter struct {
+	// Only processes with this command name, if not empty
+	command string
+	// Only these processes, if not empty
+	pids map[int]bool
+}
+
+// SignalRelay sends allowlisted signals to job processes
+// and keeps a history of deliveries.
+type SignalRelay struct {
+	processes *ProcessReader
+	events    *EventBus
+	allowed   map[string]syscall.Signal
+	kill      func(pid int, sig syscall.Signal) error
+
+	mu      sync.Mutex
+	lastID  uint64
+	history []SignalDelivery
+}
+
+// NewSignalRelay returns SignalRelay sending signals named by allowed
+// to processes found by processes. Deliveries are published to events.
+func NewSignalRelay(processes *ProcessReader, events *EventBus, allowed []string) *SignalRelay {
+	r := &SignalRelay{
+		processes: processes,
+		events:    events,
+		allowed:   make(map[string]syscall.Signal),
+		kill:      kill,
+	}
+	for _, name := range allowed {
+		if sig, err := parseSignal(name); err == nil {
+			r.allowed[signalName(name)] = sig
+		}
+	}
+	return r
+}
+
+// signalName returns name of signal without SIG prefix, in upper case.
+func signalName(name string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+}
+
+// parseSignal returns signal named name, with or without SIG prefix.
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signalsByName[signalName(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// Allowed returns names of allowed signals, sorted.
+func (r *SignalRelay) Allowed() []string {
+	names := make([]string, 0, len(r.allowed))
+	for name := range r.allowed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// check returns an error if signal name is not allowed.
+func (r *SignalRelay) check(name string) (syscall.Signal, error) {
+	sig, ok := r.allowed[signalName(name)]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q, allowed signals are %s", ErrSignalNotAllowed, name, strings.Join(r.Allowed(), ", "))
+	}
+	return sig, nil
+}
+
+// Deliver sends signal name to job processes selected by filter and
+// records the outcome. Unless selected by PID, the server, processes
+// it was started by, like the job script, and zombies are skipped.
+func (r *SignalRelay) Deliver(name string, filter signalFilter, node, requester string) (SignalDelivery, error) {
+	sig, err := r.check(name)
+	if err != nil {
+		return SignalDelivery{}, err
+	}
+	processes, err := r.processes.List()
+	if err != nil {
+		return SignalDelivery{}, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	byPID := make(map[int]Process, len(processes))
+	for _, p := range processes {
+		byPID[p.PID] = p
+	}
+	ancestors := make(map[int]bool)
+	for pid := r.processes.self; ; {
+		p, ok := byPID[pid]
+		if !ok || ancestors[p.PPID] {
+			break
+		}
+		pid = p.PPID
+		ancestors[pid] = true
+	}
+
+	delivery := SignalDelivery{
+		Time:      time.Now(),
+		Signal:    "SIG" + signalName(name),
+		Node:      node,
+		Requester: requester,
+		Targets:   []SignalTarget{},
+	}
+	for _, p := range processes {
+		if p.PID == r.processes.self || p.State == processStates["Z"] {
+			continue
+		}
+		if filter.command != "" && p.Command != filter.command {
+			continue
+		}
+		if len(filter.pids) > 0 {
+			if !filter.pids[p.PID] {
+				continue
+			}
+		} else if ancestors[p.PID] {
+			continue
+		}
+
+		target := SignalTarget{PID: p.PID, Command: p.Command, Delivered: true}
+		if err := r.kill(p.PID, sig); err != nil {
+			target.Delivered, target.Error = false, err.Error()
+			delivery.Failed++
+		} else {
+			delivery.Delivered++
+		}
+		delivery.Targets = append(delivery.Targets, target)
+	}
+
+	r.mu.Lock()
+	r.lastID++
+	delivery.ID = r.lastID
+	r.history = append(r.history, delivery)
+	if len(r.history) > maxSignalHistory {
+		r.history = r.history[len(r.history)-maxSignalHistory:]
+	}
+	r.mu.Unlock()
+
+	log.Printf("[INFO] Sent %s to %d of %d job processes, requested by %s",
+		delivery.Signal, delivery.Delivered, len(delivery.Targets), requester)
+	r.events.Publish(EventSignalDelivered, delivery)
+	return delivery, nil
+}
+
+// History returns recent deliveries, oldest first.
+func (r *SignalRelay) History() SignalHistory {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deliveries := make([]SignalDelivery, len(r.history))
+	copy(deliveries, r.history)
+	return SignalHistory{Count: len(deliveries), Deliveries: deliveries}
+}
+
+// parseSignalFilter parses command and comma separated pid query
+// parameters. PIDs are only accepted if allowPIDs is true.
+func parseSignalFilter(query url.Values, allowPIDs bool) (signalFilter, error) {
+	filter := signalFilter{command: query.Get("command")}
+	value := query.Get("pid")
+	if value == "" {
+		return filter, nil
+	}
+	if !allowPIDs {
+		return filter, errors.New("pid can not be used when signalling all nodes")
+	}
+	filter.pids = make(map[int]bool)
+	for _, item := range strings.Split(value, ",") {
+		pid, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || pid <= 0 {
+			return filter, fmt.Errorf("invalid pid %q", item)
+		}
+		filter.pids[pid] = true
+	}
+	return filter, nil
+}
+
+// signalStatus returns HTTP status code for error returned by Deliver.
+func signalStatus(err error) int {
+	if errors.Is(err, ErrSignalNotAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// handleSignal sends a signal to job processes on this node.
+//
+//	POST sends signal=USR1 to job processes, optionally only to those
+//	     with command=name or to comma separated pid=1,2.
+//	GET  returns history of signals sent.
+func (s *Server) handleSignal(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeResponse(w, r, http.StatusOK, s.signals.History())
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseSignalFilter(r.URL.Query(), true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info := getJobInfo(s.opts.Scheduler, s.opts.Env)
+	delivery, err := s.signals.Deliver(r.URL.Query().Get("signal"), filter, info.Node.Name, r.RemoteAddr)
+	if err != nil {
+		if status := signalStatus(err); status == http.StatusInternalServerError {
+			log.Printf("[ERROR] Failed to send signal: %s", err)
+		}
+		http.Error(w, err.Error(), signalStatus(err))
+		return
+	}
+	writeResponse(w, r, http.StatusOK, delivery)
+}
+
+// handleClusterSignal sends a signal to job processes on all nodes.
+// It takes the same parameters as /signal, except pid. Servers on other
+// nodes are requested concurrently, each of them given PeerTimeout to
+// respond. Only the head node serves it.
+func (s *Server) handleClusterSignal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	local := getJobInfo(s.opts.Scheduler, s.opts.Env)
+	if !isHead(local) {
+		http.Error(w, ErrNotHeadSignal.Error(), http.StatusNotFound)
+		return
+	}
+	name := r.URL.Query().Get("signal")
+	filter, err := parseSignalFilter(r.URL.Query(), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.signals.check(name); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	query := url.Values{"signal": {name}}
+	if filter.command != "" {
+		query.Set("command", filter.command)
+	}
+	names := local.Job.Nodes
+	if len(names) == 0 {
+		names = []string{local.Node.Name}
+	}
+	self := localIndex(local, names)
+	nodes := make([]NodeSignal, len(names))
+	var wg sync.WaitGroup
+	for i, node := range names {
+		if i == self {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			nodes[i] = s.signalPeer(r.Context(), node, query.Encode())
+		}(i, node)
+	}
+
+	// Signal is sent directly to processes on this node.
+	nodes[self] = NodeSignal{Name: names[self], Reachable: true}
+	if delivery, err := s.signals.Deliver(name, filter, names[self], r.RemoteAddr); err != nil {
+		nodes[self].Error = err.Error()
+	} else {
+		nodes[self].Delivery = &delivery
+	}
+	wg.Wait()
+
+	result := ClusterSignal{Signal: "SIG" + signalName(name), Unreachable: []string{}, Nodes: nodes}
+	for _, node := range nodes {
+		if !node.Reachable {
+			log.Printf("[WARN] Failed to send %s to node %s: %s", result.Signal, node.Name, node.Error)
+			result.Unreachable = append(result.Unreachable, node.Name)
+		}
+		if node.Delivery != nil {
+			result.Delivered += node.Delivery.Delivered
+			result.Failed += node.Delivery.Failed
+		}
+	}
+	writeResponse(w, r, http.StatusOK, result)
+}
+
+// signalPeer requests server on node to send signal given by query.
+func (s *Server) signalPeer(ctx context.Context, node, query string) NodeSignal {
+	ns := NodeSignal{Name: node, Address: s.peerAddress(node)}
+	if ns.Address == "" {
+		ns.Error = "address of the server is unknown, as it did not register and port is picked by the kernel"
+		return ns
+	}
+	if s.peerToken() == "" {
+		ns.Error = "cluster token is not set"
+		return ns
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opts.PeerTimeout)
+	defer cancel()
+	var delivery SignalDelivery
+	if err := NewClient(ns.Address, s.peerToken()).PostJSON(ctx, "/signal?"+query, nil, &delivery); err != nil {
+		ns.Error = err.Error()
+		return ns
+	}
+	ns.Reachable, ns.Delivery = true, &delivery
+	return ns
+}
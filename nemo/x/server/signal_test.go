@@ -0,0 +1,312 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKill records signals sent by relay instead of sending them.
+// Sending to PID 104 fails.
+type fakeKill struct {
+	mu   sync.Mutex
+	sent map[int]syscall.Signal
+}
+
+func (k *fakeKill) kill(pid int, sig syscall.Signal) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if pid == 104 {
+		return syscall.EPERM
+	}
+	k.sent[pid] = sig
+	return nil
+}
+
+// newFixtureSignalRelay returns SignalRelay for processes in testdata/node
+// of a Slurm job, where server is PID 101, recording signals to k.
+func newFixtureSignalRelay(events *EventBus, k *fakeKill, allowed ...string) *SignalRelay {
+	r := NewSignalRelay(newFixtureProcessReader(map[string]string{"SLURM_JOB_ID": "42"}), events, allowed)
+	r.kill = k.kill
+	return r
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect syscall.Signal
+		ok     bool
+	}{
+		{name: "USR1", expect: syscall.SIGUSR1, ok: true},
+		{name: "SIGUSR2", expect: syscall.SIGUSR2, ok: true},
+		{name: " sigterm ", expect: syscall.SIGTERM, ok: true},
+		{name: "SIGBOGUS"},
+		{name: ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			sig, err := parseSignal(tc.name)
+			if tc.ok {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expect, sig)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestSignalRelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		signal  string
+		filter  signalFilter
+		targets []int
+		sent    []int
+		err     error
+	}{
+		{
+			// Server, the job script and step daemon it runs under,
+			// and zombies are skipped.
+			name:    "all",
+			signal:  "USR1",
+			targets: []int{102, 103, 104, 105},
+			sent:    []int{102, 103, 105},
+		},
+		{
+			name:    "command",
+			signal:  "SIGUSR1",
+			filter:  signalFilter{command: "python"},
+			targets: []int{103, 104},
+			sent:    []int{103},
+		},
+		{
+			name:    "pid",
+			signal:  "usr2",
+			filter:  signalFilter{pids: map[int]bool{100: true, 101: true, 103: true, 107: true}},
+			targets: []int{100, 103},
+			sent:    []int{100, 103},
+		},
+		{name: "not-allowed", signal: "TERM", err: ErrSignalNotAllowed},
+		{name: "unknown", signal: "BOGUS", err: ErrSignalNotAllowed},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			events := NewEventBus(10)
+			k := &fakeKill{sent: make(map[int]syscall.Signal)}
+			r := newFixtureSignalRelay(events, k, defaultAllowedSignals...)
+
+			delivery, err := r.Deliver(tc.signal, tc.filter, "n1", "127.0.0.1:4000")
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				assert.Empty(t, k.sent)
+				assert.Equal(t, 0, r.History().Count)
+				return
+			}
+			if !assert.Nil(t, err) {
+				return
+			}
+			var targets, sent []int
+			for _, target := range delivery.Targets {
+				targets = append(targets, target.PID)
+				if target.Delivered {
+					sent = append(sent, target.PID)
+				} else {
+					assert.Equal(t, syscall.EPERM.Error(), target.Error)
+				}
+			}
+			assert.Equal(t, tc.targets, targets)
+			assert.Equal(t, tc.sent, sent)
+			assert.Len(t, k.sent, len(tc.sent))
+			assert.Equal(t, len(tc.sent), delivery.Delivered)
+			assert.Equal(t, len(tc.targets)-len(tc.sent), delivery.Failed)
+			assert.Equal(t, "n1", delivery.Node)
+			assert.Equal(t, uint64(1), delivery.ID)
+			assert.Equal(t, []SignalDelivery{delivery}, r.History().Deliveries)
+			assert.Equal(t, []EventType{EventSignalDelivered}, eventTypes(events))
+		})
+	}
+}
+
+func TestSignalRelayHistory(t *testing.T) {
+	k := &fakeKill{sent: make(map[int]syscall.Signal)}
+	r := newFixtureSignalRelay(NewEventBus(10), k, "USR1")
+	assert.Equal(t, []string{"USR1"}, r.Allowed())
+
+	for i := 0; i < maxSignalHistory+5; i++ {
+		_, err := r.Deliver("USR1", signalFilter{command: "mpirun"}, "n1", "")
+		assert.Nil(t, err)
+	}
+	history := r.History()
+	assert.Equal(t, maxSignalHistory, history.Count)
+	assert.Equal(t, uint64(6), history.Deliveries[0].ID)
+	assert.Equal(t, uint64(maxSignalHistory+5), history.Deliveries[maxSignalHistory-1].ID)
+}
+
+func TestHandleSignal(t *testing.T) {
+	k := &fakeKill{sent: make(map[int]syscall.Signal)}
+	ts := newClusterServer(t, "0", Options{}, k.kill)
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		token  string
+		status int
+	}{
+		{name: "unauthenticated", method: http.MethodPost, query: "?signal=USR1", status: http.StatusUnauthorized},
+		{name: "not-allowed", method: http.MethodPost, query: "?signal=KILL", token: testToken, status: http.StatusForbidden},
+		{name: "invalid-pid", method: http.MethodPost, query: "?signal=USR1&pid=x", token: testToken, status: http.StatusBadRequest},
+		{name: "put", method: http.MethodPut, query: "?signal=USR1", token: testToken, status: http.StatusMethodNotAllowed},
+		{name: "deliver", method: http.MethodPost, query: "?signal=USR1&command=python", token: testToken, status: http.StatusOK},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, ts.URL+"/signal"+tc.query, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if assert.Nil(t, err) {
+				resp.Body.Close()
+				assert.Equal(t, tc.status, resp.StatusCode)
+			}
+		})
+	}
+	assert.Equal(t, map[int]syscall.Signal{103: syscall.SIGUSR1}, k.sent)
+
+	var history SignalHistory
+	assert.Equal(t, http.StatusOK, getInto(t, ts, "/signal", &history))
+	if assert.Equal(t, 1, history.Count) {
+		assert.Equal(t, "SIGUSR1", history.Deliveries[0].Signal)
+		assert.Equal(t, 1, history.Deliveries[0].Delivered)
+	}
+}
+
+func TestHandleClusterSignal(t *testing.T) {
+	peerKill := &fakeKill{sent: make(map[int]syscall.Signal)}
+	peer := newClusterServer(t, "1", Options{}, peerKill.kill)
+
+	// Nothing listens on n3 and n4.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	headKill := &fakeKill{sent: make(map[int]syscall.Signal)}
+	head := newClusterServer(t, "0", Options{NodeAddrs: map[string]string{
+		"n2": strings.TrimPrefix(peer.URL, "http://"),
+		"n3": closed,
+		"n4": closed,
+	}}, headKill.kill)
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		status int
+	}{
+		{name: "get", method: http.MethodGet, query: "?signal=USR1", status: http.StatusMethodNotAllowed},
+		{name: "not-allowed", method: http.MethodPost, query: "?signal=TERM", status: http.StatusForbidden},
+		{name: "pid", method: http.MethodPost, query: "?signal=USR1&pid=103", status: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			code, _ := kvRequest(t, head, tc.method, "/cluster/signal"+tc.query, "")
+			assert.Equal(t, tc.status, code)
+		})
+	}
+
+	code, body := kvRequest(t, head, http.MethodPost, "/cluster/signal?signal=USR1&command=python", "")
+	assert.Equal(t, http.StatusOK, code)
+	var result ClusterSignal
+	assert.Nil(t, json.Unmarshal([]byte(body), &result))
+	assert.Equal(t, "SIGUSR1", result.Signal)
+	assert.Equal(t, 2, result.Delivered)
+	assert.Equal(t, 0, result.Failed)
+	assert.Equal(t, []string{"n3", "n4"}, result.Unreachable)
+	if assert.Len(t, result.Nodes, 4) {
+		assert.Equal(t, "n1", result.Nodes[0].Delivery.Node)
+		assert.True(t, result.Nodes[1].Reachable)
+		assert.Equal(t, []SignalTarget{{PID: 103, Command: "python", Delivered: true}}, result.Nodes[1].Delivery.Targets)
+		assert.Contains(t, result.Nodes[2].Error, "connection refused")
+	}
+	assert.Equal(t, map[int]syscall.Signal{103: syscall.SIGUSR1}, headKill.sent)
+	assert.Equal(t, map[int]syscall.Signal{103: syscall.SIGUSR1}, peerKill.sent)
+
+	// Only the head node fans out.
+	code, _ = kvRequest(t, peer, http.MethodPost, "/cluster/signal?signal=USR1", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestHandleClusterSignalHead(t *testing.T) {
+	hostname, _ := os.Hostname()
+	// Nothing listens on n1.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name  string
+		nodes []string
+		index string
+		code  int
+		// Name of the node signal is sent to directly
+		local string
+	}{
+		{name: "unknown-index-single-node", code: http.StatusOK, local: hostname},
+		{name: "unknown-index-many-nodes", nodes: []string{"n1", "n2"}, code: http.StatusNotFound},
+		// This node is found by name, and the first node is requested.
+		{name: "not-first", nodes: []string{"n1", hostname}, index: "0", code: http.StatusOK, local: hostname},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			k := &fakeKill{sent: make(map[int]syscall.Signal)}
+			ts := newClusterServer(t, tc.index, Options{
+				Root:      clusterFS(tc.nodes...),
+				NodeAddrs: map[string]string{"n1": closed},
+			}, k.kill)
+
+			code, body := kvRequest(t, ts, http.MethodPost, "/cluster/signal?signal=USR1&command=python", "")
+			if !assert.Equal(t, tc.code, code) || code != http.StatusOK {
+				assert.Contains(t, body, ErrNotHeadSignal.Error())
+				assert.Empty(t, k.sent)
+				return
+			}
+			var result ClusterSignal
+			assert.Nil(t, json.Unmarshal([]byte(body), &result))
+			assert.Equal(t, map[int]syscall.Signal{103: syscall.SIGUSR1}, k.sent)
+			for _, node := range result.Nodes {
+				if node.Name == tc.local {
+					assert.True(t, node.Reachable)
+					if assert.NotNil(t, node.Delivery) {
+						assert.Equal(t, tc.local, node.Delivery.Node)
+					}
+				} else {
+					assert.False(t, node.Reachable)
+				}
+			}
+			assert.Len(t, result.Unreachable, len(result.Nodes)-1)
+		})
+	}
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// signalsByName is empty on windows, which has no signals
+// that can be sent to other processes.
+var signalsByName = map[string]syscall.Signal{}
+
+// kill is not supported on windows.
+func kill(pid int, sig syscall.Signal) error {
+	return errors.New("sending signals is not supported on windows")
+}
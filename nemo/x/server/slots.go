@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/tprasadtp/dotfiles/nemo/x/server/hostlist"
+)
+
+// HostSlots is a host allocated to the job, along with number
+// of slots (usually cores) allocated on it.
+type HostSlots struct {
+	Name string `json:"name" yaml:"name" hcl:"name"`
+	// Slots on the host, null if unknown
+	Slots *int `json:"slots" yaml:"slots" hcl:"slots"`
+}
+
+// addSlots adds slots on host to hosts. If host is already
+// present, slots are added to the existing entry, so that the
+// order in which hosts first appeared is preserved. If slots
+// is nil, slots on the host are unknown.
+func addSlots(hosts []HostSlots, name string, slots *int) []HostSlots {
+	for i := range hosts {
+		if hosts[i].Name == name {
+			hosts[i].Slots = addInts(hosts[i].Slots, slots)
+			return hosts
+		}
+	}
+	if slots != nil {
+		slots = intPtr(*slots)
+	}
+	return append(hosts, HostSlots{Name: name, Slots: slots})
+}
+
+// addInts returns sum of a and b, or nil if either of them is unknown.
+func addInts(a, b *int) *int {
+	if a == nil || b == nil {
+		return nil
+	}
+	return intPtr(*a + *b)
+}
+
+// intPtr returns pointer to a copy of v.
+func intPtr(v int) *int {
+	return &v
+}
+
+// int64Ptr returns pointer to a copy of v.
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+// countSlots converts a list where each host is repeated once
+// per slot, like PBS_NODEFILE, into list of hosts with slots.
+func countSlots(list []string) []HostSlots {
+	var hosts []HostSlots
+	for _, name := range list {
+		hosts = addSlots(hosts, name, intPtr(1))
+	}
+	return hosts
+}
+
+// hostNames returns names of hosts.
+func hostNames(hosts []HostSlots) []string {
+	names := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+	return names
+}
+
+// setHosts sets hosts allocated to the job, along with fields
+// derived from them. SlotCount is nil if there are no hosts or
+// slots on any of the hosts are not known.
+func (j *JobInfo) setHosts(hosts []HostSlots) {
+	j.Hosts = hosts
+	j.Nodes = nil
+	j.SlotCount = nil
+	if len(hosts) > 0 {
+		j.SlotCount = intPtr(0)
+	}
+	for _, host := range hosts {
+		j.Nodes = append(j.Nodes, host.Name)
+		j.SlotCount = addInts(j.SlotCount, host.Slots)
+	}
+	j.NodeList = hostlist.Compress(j.Nodes)
+}
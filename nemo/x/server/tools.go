@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// defaultToolTimeout is time allowed for scheduler commands to complete.
+const defaultToolTimeout = 30 * time.Second
+
+// runTool runs scheduler command path with args and returns its output.
+// If the command fails, its standard error is included in the error.
+func runTool(ctx context.Context, timeout time.Duration, path string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s failed: %w: %s", path, err, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %w", path, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// toolStatus returns HTTP status code for err returned while running
+// or parsing output of a scheduler command. Missing commands mean the
+// scheduler is not available on this node.
+func toolStatus(err error) int {
+	if errors.Is(err, exec.ErrNotFound) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// qstatTimeFormat is format of times reported by qstat -f.
+const qstatTimeFormat = "Mon Jan _2 15:04:05 2006"
+
+// QueuedJob is a job in the queue as reported by Torque qstat -f.
+// Values not reported by qstat are null.
+type QueuedJob struct {
+	ID      string `json:"id" yaml:"id" hcl:"id"`
+	Name    string `json:"name" yaml:"name" hcl:"name"`
+	Owner   string `json:"owner" yaml:"owner" hcl:"owner"`
+	Account string `json:"account" yaml:"account" hcl:"account"`
+	// State like Q, R, H or C
+	State  string `json:"state" yaml:"state" hcl:"state"`
+	Queue  string `json:"queue" yaml:"queue" hcl:"queue"`
+	Server string `json:"server" yaml:"server" hcl:"server"`
+	// Requested and used walltime in seconds
+	Walltime     *int       `json:"walltime" yaml:"walltime" hcl:"walltime"`
+	WalltimeUsed *int       `json:"walltimeUsed" yaml:"walltimeUsed" hcl:"walltimeUsed"`
+	SubmitTime   *time.Time `json:"submitTime" yaml:"submitTime" hcl:"submitTime"`
+	QueueTime    *time.Time `json:"queueTime" yaml:"queueTime" hcl:"queueTime"`
+	StartTime    *time.Time `json:"startTime" yaml:"startTime" hcl:"startTime"`
+	ExitStatus   *int       `json:"exitStatus" yaml:"exitStatus" hcl:"exitStatus"`
+	// Hosts the job is running on along with cores used on each of them
+	Hosts []HostSlots `json:"hosts" yaml:"hosts" hcl:"hosts"`
+	// Requested and used resources, like nodes or mem
+	Resources     map[string]string `json:"resources" yaml:"resources" hcl:"resources"`
+	ResourcesUsed map[string]string `json:"resourcesUsed" yaml:"resourcesUsed" hcl:"resourcesUsed"`
+}
+
+// Queue is the list of jobs in the queue.
+type Queue struct {
+	Count int         `json:"count" yaml:"count" hcl:"count"`
+	Jobs  []QueuedJob `json:"jobs" yaml:"jobs" hcl:"jobs"`
+}
+
+// NodeState is state of a node as reported by Torque pbsnodes -x.
+type NodeState struct {
+	Name string `json:"name" yaml:"name" hcl:"name"`
+	// States like free, job-exclusive, offline or down
+	State      []string `json:"state" yaml:"state" hcl:"state"`
+	PowerState string   `json:"powerState" yaml:"powerState" hcl:"powerState"`
+	Type       string   `json:"type" yaml:"type" hcl:"type"`
+	// Number of cores and GPUs, null if unknown
+	NP         *int     `json:"np" yaml:"np" hcl:"np"`
+	GPUs       *int     `json:"gpus" yaml:"gpus" hcl:"gpus"`
+	Properties []string `json:"properties" yaml:"properties" hcl:"properties"`
+	// IDs of jobs running on the node
+	Jobs []string `json:"jobs" yaml:"jobs" hcl:"jobs"`
+	Note string   `json:"note" yaml:"note" hcl:"note"`
+	// Status reported by the node's MOM, like loadave or physmem
+	Status map[string]string `json:"status" yaml:"status" hcl:"status"`
+}
+
+// NodesState is the list of nodes known to the server.
+type NodesState struct {
+	Count int         `json:"count" yaml:"count" hcl:"count"`
+	Nodes []NodeState `json:"nodes" yaml:"nodes" hcl:"nodes"`
+}
+
+// parseQstat parses output of qstat -f. Output of -1 has each attribute
+// on a single line, otherwise long values are continued on following
+// lines indented by a tab.
+func parseQstat(data []byte) ([]QueuedJob, error) {
+	jobs := []QueuedJob{}
+	var attrs map[string]string
+	var id, last string
+
+	flush := func() {
+		if id != "" {
+			jobs = append(jobs, newQueuedJob(id, attrs))
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "Job Id:") {
+			flush()
+			id = strings.TrimSpace(strings.TrimPrefix(line, "Job Id:"))
+			attrs, last = make(map[string]string), ""
+			continue
+		}
+		if id == "" {
+			return nil, fmt.Errorf("invalid qstat output: %q is not part of a job", line)
+		}
+		key, value, ok := cut(strings.TrimSpace(line), " = ")
+		if !ok || strings.HasPrefix(line, "\t") {
+			if last == "" {
+				return nil, fmt.Errorf("invalid qstat output: %q is not an attribute", line)
+			}
+			attrs[last] += strings.TrimSpace(line)
+			continue
+		}
+		attrs[key], last = value, key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("invalid qstat output: %w", err)
+	}
+	flush()
+	return jobs, nil
+}
+
+// newQueuedJob returns job id described by qstat attributes.
+func newQueuedJob(id string, attrs map[string]string) QueuedJob {
+	job := QueuedJob{
+		ID:            id,
+		Name:          attrs["Job_Name"],
+		Owner:         attrs["Job_Owner"],
+		Account:       attrs["Account_Name"],
+		State:         attrs["job_state"],
+		Queue:         attrs["queue"],
+		Server:        attrs["server"],
+		Walltime:      parseOptionalWalltime(attrs["Resource_List.walltime"]),
+		WalltimeUsed:  parseOptionalWalltime(attrs["resources_used.walltime"]),
+		SubmitTime:    parseQstatTime(attrs["ctime"]),
+		QueueTime:     parseQstatTime(attrs["qtime"]),
+		StartTime:     parseQstatTime(attrs["start_time"]),
+		ExitStatus:    parseOptionalInt(attrs["exit_status"]),
+		Hosts:         parseExecHost(attrs["exec_host"]),
+		Resources:     make(map[string]string),
+		ResourcesUsed: make(map[string]string),
+	}
+	for key, value := range attrs {
+		if name := strings.TrimPrefix(key, "Resource_List."); name != key {
+			job.Resources[name] = value
+		} else if name := strings.TrimPrefix(key, "resources_used."); name != key {
+			job.ResourcesUsed[name] = value
+		}
+	}
+	return job
+}
+
+// parseExecHost parses exec_host of the form "n1/0-3+n2/0,2" or
+// "n1/0+n1/1+n2/0", where numbers after slash are cores used.
+func parseExecHost(value string) []HostSlots {
+	hosts := []HostSlots{}
+	for _, item := range splitList(value, "+") {
+		name, cores, _ := cut(item, "/")
+		hosts = addSlots(hosts, name, countRange(cores))
+	}
+	return hosts
+}
+
+// countRange counts numbers in a list of ranges like "0-3,6".
+// It returns nil if list is empty or malformed.
+func countRange(value string) *int {
+	count := 0
+	for _, item := range splitList(value, ",") {
+		first, last, isRange := cut(item, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil
+			}
+		}
+		count += end - start + 1
+	}
+	if count == 0 {
+		return nil
+	}
+	return &count
+}
+
+// parseOptionalWalltime parses walltime into seconds,
+// returning nil if it is empty or malformed.
+func parseOptionalWalltime(value string) *int {
+	walltime, err := parseWalltime(value)
+	if err != nil {
+		return nil
+	}
+	return intPtr(int(walltime / time.Second))
+}
+
+// parseQstatTime parses time reported by qstat in local time zone,
+// returning nil if it is empty or malformed.
+func parseQstatTime(value string) *time.Time {
+	t, err := time.ParseInLocation(qstatTimeFormat, strings.TrimSpace(value), time.Local)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// pbsnodesXML is output of pbsnodes -x.
+type pbsnodesXML struct {
+	Nodes []struct {
+		Name       string `xml:"name"`
+		State      string `xml:"state"`
+		PowerState string `xml:"power_state"`
+		NP         string `xml:"np"`
+		GPUs       string `xml:"gpus"`
+		Properties string `xml:"properties"`
+		Type       string `xml:"ntype"`
+		Jobs       string `xml:"jobs"`
+		Status     string `xml:"status"`
+		Note       string `xml:"note"`
+	} `xml:"Node"`
+}
+
+// parsePbsnodes parses output of pbsnodes -x.
+func parsePbsnodes(data []byte) ([]NodeState, error) {
+	var out pbsnodesXML
+	if err := xml.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("invalid pbsnodes output: %w", err)
+	}
+	nodes := []NodeState{}
+	for _, n := range out.Nodes {
+		nodes = append(nodes, NodeState{
+			Name:       n.Name,
+			State:      splitList(n.State, ","),
+			PowerState: n.PowerState,
+			Type:       n.Type,
+			NP:         parseOptionalInt(n.NP),
+			GPUs:       parseOptionalInt(n.GPUs),
+			Properties: splitList(n.Properties, ","),
+			Jobs:       parseNodeJobs(n.Jobs),
+			Note:       n.Note,
+			Status:     parseNodeStatus(n.Status),
+		})
+	}
+	return nodes, nil
+}
+
+// parseNodeJobs returns IDs of jobs listed by pbsnodes, of the form
+// "0-3/1.server,4/2.server" or "0/1.server, 1/1.server".
+func parseNodeJobs(value string) []string {
+	jobs := []string{}
+	seen := make(map[string]bool)
+	for _, item := range splitList(value, ", ") {
+		_, id, ok := cut(item, "/")
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		jobs = append(jobs, id)
+	}
+	return jobs
+}
+
+// parseNodeStatus parses comma separated key=value pairs reported by
+// MOM. Values may themselves contain commas, either within parentheses,
+// like jobs=1.server(cput=1,mem=2kb), or as items without "=".
+func parseNodeStatus(value string) map[string]string {
+	status := make(map[string]string)
+	var last string
+	for _, item := range strings.Split(value, ",") {
+		key, v, ok := cut(item, "=")
+		open := last != "" && strings.Count(status[last], "(") > strings.Count(status[last], ")")
+		if !ok || open {
+			if last != "" {
+				status[last] += "," + item
+			}
+			continue
+		}
+		status[key], last = v, key
+	}
+	return status
+}
+
+// handleQueue returns jobs in the queue as reported by qstat.
+func (s *Server) handleQueue(w http.ResponseWriter, r *http.Request) {
+	out, err := runTool(r.Context(), defaultToolTimeout, s.opts.Qstat, "-f", "-1")
+	if err == nil {
+		var jobs []QueuedJob
+		if jobs, err = parseQstat(out); err == nil {
+			writeResponse(w, r, http.StatusOK, Queue{Count: len(jobs), Jobs: jobs})
+			return
+		}
+	}
+	log.Printf("[ERROR] Failed to get queue state: %s", err)
+	http.Error(w, err.Error(), toolStatus(err))
+}
+
+// handleNodesState returns state of nodes as reported by pbsnodes.
+func (s *Server) handleNodesState(w http.ResponseWriter, r *http.Request) {
+	out, err := runTool(r.Context(), defaultToolTimeout, s.opts.Pbsnodes, "-x")
+	if err == nil {
+		var nodes []NodeState
+		if nodes, err = parsePbsnodes(out); err == nil {
+			writeResponse(w, r, http.StatusOK, NodesState{Count: len(nodes), Nodes: nodes})
+			return
+		}
+	}
+	log.Printf("[ERROR] Failed to get node state: %s", err)
+	http.Error(w, err.Error(), toolStatus(err))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// torqueStub returns path of stub Torque command in testdata/torque.
+func torqueStub(name string) string {
+	return filepath.Join("testdata", "torque", name)
+}
+
+func TestParseQstat(t *testing.T) {
+	data, err := os.ReadFile(torqueStub("qstat.txt"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	jobs, err := parseQstat(data)
+	assert.Nil(t, err)
+
+	ctime := time.Date(2023, time.November, 14, 22, 13, 20, 0, time.Local)
+	start := time.Date(2023, time.November, 14, 22, 23, 20, 0, time.Local)
+	assert.Equal(t, []QueuedJob{
+		{
+			ID: "1234.server", Name: "sim", Owner: "alice@login1", Account: "physics",
+			State: "R", Queue: "batch", Server: "server",
+			Walltime: intPtr(3600), WalltimeUsed: intPtr(1800),
+			SubmitTime: &ctime, QueueTime: &ctime, StartTime: &start,
+			Hosts:         []HostSlots{{Name: "n1", Slots: intPtr(4)}, {Name: "n2", Slots: intPtr(2)}},
+			Resources:     map[string]string{"nodes": "2:ppn=4", "walltime": "01:00:00"},
+			ResourcesUsed: map[string]string{"cput": "01:00:00", "mem": "1048576kb", "walltime": "00:30:00"},
+		},
+		{
+			ID: "1235.server", Name: "post", Owner: "bob@login1",
+			State: "C", Queue: "batch", Server: "server",
+			Walltime: intPtr(600), SubmitTime: &ctime, ExitStatus: intPtr(271),
+			Hosts:         []HostSlots{{Name: "n3", Slots: intPtr(2)}, {Name: "n4", Slots: intPtr(1)}},
+			Resources:     map[string]string{"walltime": "10:00"},
+			ResourcesUsed: map[string]string{},
+		},
+		{
+			ID: "1236.server", Name: "queued", Owner: "carol@login1",
+			State: "Q", Queue: "long", Server: "server",
+			Walltime:      intPtr(2 * 24 * 3600),
+			SubmitTime:    timePtr(time.Date(2023, time.November, 1, 9, 5, 0, 0, time.Local)),
+			Hosts:         []HostSlots{},
+			Resources:     map[string]string{"walltime": "2:00:00:00"},
+			ResourcesUsed: map[string]string{},
+		},
+	}, jobs)
+}
+
+func TestParseQstatMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		jobs int
+		err  bool
+	}{
+		{name: "empty", data: "", jobs: 0},
+		{name: "attribute-outside-job", data: "    job_state = R\n", err: true},
+		{name: "continuation-without-attribute", data: "Job Id: 1.server\n\tfoo\n", err: true},
+		{name: "wrapped", data: "Job Id: 1.server\n    Job_Name = a\n\tb\n", jobs: 1},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			jobs, err := parseQstat([]byte(tc.data))
+			if tc.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Len(t, jobs, tc.jobs)
+		})
+	}
+}
+
+func TestParseExecHost(t *testing.T) {
+	tests := []struct {
+		value string
+		hosts []HostSlots
+	}{
+		{value: "", hosts: []HostSlots{}},
+		{value: "n1/0-3", hosts: []HostSlots{{Name: "n1", Slots: intPtr(4)}}},
+		{value: "n1/0+n1/1+n2/0", hosts: []HostSlots{{Name: "n1", Slots: intPtr(2)}, {Name: "n2", Slots: intPtr(1)}}},
+		{value: "n1/0-1,4,6-7", hosts: []HostSlots{{Name: "n1", Slots: intPtr(5)}}},
+		{value: "n1/3-1+n2", hosts: []HostSlots{{Name: "n1"}, {Name: "n2"}}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.value, func(t *testing.T) {
+			assert.Equal(t, tc.hosts, parseExecHost(tc.value))
+		})
+	}
+}
+
+func TestParsePbsnodes(t *testing.T) {
+	data, err := os.ReadFile(torqueStub("pbsnodes.xml"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	nodes, err := parsePbsnodes(data)
+	assert.Nil(t, err)
+	if !assert.Len(t, nodes, 3) {
+		return
+	}
+
+	n1 := nodes[0]
+	assert.Equal(t, "n1", n1.Name)
+	assert.Equal(t, []string{"job-exclusive"}, n1.State)
+	assert.Equal(t, "Running", n1.PowerState)
+	assert.Equal(t, intPtr(4), n1.NP)
+	assert.Nil(t, n1.GPUs)
+	assert.Equal(t, []string{"ib", "haswell"}, n1.Properties)
+	assert.Equal(t, []string{"1234.server"}, n1.Jobs)
+	assert.Equal(t, "4.00", n1.Status["loadave"])
+	assert.Equal(t, "", n1.Status["varattr"])
+	assert.Equal(t, "Linux n1 5.4.0 #1 SMP x86_64", n1.Status["uname"])
+	assert.Equal(t, "1234.server(cput=3600,mem=1048576kb)", n1.Status["jobs"])
+
+	assert.Equal(t, NodeState{
+		Name: "n2", State: []string{"free"}, PowerState: "Running", Type: "cluster",
+		NP: intPtr(4), GPUs: intPtr(2), Properties: []string{"ib"},
+		Jobs: []string{"1234.server", "1237.server"}, Status: map[string]string{},
+	}, nodes[1])
+	assert.Equal(t, NodeState{
+		Name: "n5", State: []string{"down", "offline"}, Type: "cluster", NP: intPtr(8),
+		Properties: []string{}, Jobs: []string{}, Note: "disk failure", Status: map[string]string{},
+	}, nodes[2])
+
+	_, err = parsePbsnodes([]byte("pbsnodes: Server has no node list"))
+	assert.NotNil(t, err)
+}
+
+func TestHandleTorque(t *testing.T) {
+	tests := []struct {
+		name     string
+		qstat    string
+		pbsnodes string
+		code     int
+	}{
+		{name: "ok", qstat: torqueStub("qstat"), pbsnodes: torqueStub("pbsnodes"), code: http.StatusOK},
+		{name: "unreachable", qstat: torqueStub("unavailable"), pbsnodes: torqueStub("unavailable"), code: http.StatusBadGateway},
+		{name: "missing", qstat: "qstat-does-not-exist", pbsnodes: "pbsnodes-does-not-exist", code: http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer(Options{
+				Scheduler: pbsScheduler{},
+				Env:       MapEnv(nil),
+				Root:      nodeFS,
+				Token:     testToken,
+				Qstat:     tc.qstat,
+				Pbsnodes:  tc.pbsnodes,
+			}, func() {})
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+
+			if tc.code != http.StatusOK {
+				for _, path := range []string{"/queue", "/nodes/state"} {
+					req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+					req.Header.Set("Authorization", "Bearer "+testToken)
+					resp, err := http.DefaultClient.Do(req)
+					if assert.Nil(t, err) {
+						resp.Body.Close()
+						assert.Equal(t, tc.code, resp.StatusCode, path)
+					}
+				}
+				return
+			}
+
+			var queue Queue
+			assert.Equal(t, http.StatusOK, getInto(t, ts, "/queue", &queue))
+			assert.Equal(t, 3, queue.Count)
+			if assert.Len(t, queue.Jobs, 3) {
+				assert.Equal(t, "1234.server", queue.Jobs[0].ID)
+				assert.Equal(t, intPtr(1800), queue.Jobs[0].WalltimeUsed)
+			}
+
+			var nodes NodesState
+			assert.Equal(t, http.StatusOK, getInto(t, ts, "/nodes/state", &nodes))
+			assert.Equal(t, 3, nodes.Count)
+			if assert.Len(t, nodes.Nodes, 3) {
+				assert.Equal(t, []string{"down", "offline"}, nodes.Nodes[2].State)
+			}
+		})
+	}
+}
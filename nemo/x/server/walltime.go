@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidWalltime is returned when walltime cannot be parsed.
+var ErrInvalidWalltime = errors.New("walltime must be in seconds or [[D-]HH:]MM:SS form")
+
+// maxWalltime is the longest walltime in seconds, which is 10 years.
+// Longer walltimes are treated as invalid rather than overflowing.
+const maxWalltime = 10 * 365 * 24 * 60 * 60
+
+// parseWalltime parses walltime which is either plain seconds (3600)
+// or colon separated, like HH:MM:SS, MM:SS or D:HH:MM:SS. Slurm style
+// D-HH, D-HH:MM and D-HH:MM:SS are also supported. The leading field
+// of colon separated form may exceed its usual range, like 48:00:00.
+// Walltime must not exceed maxWalltime.
+func parseWalltime(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, ErrInvalidWalltime
+	}
+
+	// Multipliers for seconds, minutes, hours and days.
+	units := []int{1, 60, 60 * 60, 24 * 60 * 60}
+	limits := []int{60, 60, 24}
+
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		days, err := strconv.Atoi(s[:i])
+		if err != nil || days < 0 || days > maxWalltime/units[3] {
+			return 0, ErrInvalidWalltime
+		}
+		// Fields after days are hours, minutes and seconds from left.
+		parts := strings.Split(s[i+1:], ":")
+		if len(parts) > 3 {
+			return 0, ErrInvalidWalltime
+		}
+		total := days * units[3]
+		for j, field := range parts {
+			v, err := strconv.Atoi(field)
+			if err != nil || v < 0 || v >= limits[2-j] {
+				return 0, ErrInvalidWalltime
+			}
+			total += v * units[2-j]
+		}
+		if total > maxWalltime {
+			return 0, ErrInvalidWalltime
+		}
+		return time.Duration(total) * time.Second, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) > 4 {
+		return 0, ErrInvalidWalltime
+	}
+	total := 0
+	for i := range parts {
+		v, err := strconv.Atoi(parts[len(parts)-1-i])
+		if err != nil || v < 0 || v > maxWalltime/units[i] {
+			return 0, ErrInvalidWalltime
+		}
+		// All fields except the leading one must be within range.
+		if i < len(parts)-1 && v >= limits[i] {
+			return 0, ErrInvalidWalltime
+		}
+		total += v * units[i]
+	}
+	if total > maxWalltime {
+		return 0, ErrInvalidWalltime
+	}
+	return time.Duration(total) * time.Second, nil
+}
+
+// Threshold is a warning fired when remaining walltime drops below Before.
+type Threshold struct {
+	// Remaining walltime at which warning is fired.
+	Before time.Duration `json:"-" yaml:"-" hcl:"-"`
+	// Before, in seconds.
+	BeforeSeconds int `json:"before" yaml:"before" hcl:"before"`
+	// Time at which the warning is fired.
+	At time.Time `json:"at" yaml:"at" hcl:"at"`
+	// Whether threshold is already crossed.
+	Crossed bool `json:"crossed" yaml:"crossed" hcl:"crossed"`
+}
+
+// WalltimeStatus is the state of job walltime at a point in time.
+// Durations are in seconds. Limit, Remaining and Deadline are
+// null unless walltime of the job is known.
+type WalltimeStatus struct {
+	Start      time.Time   `json:"start" yaml:"start" hcl:"start"`
+	Limit      *int        `json:"limit" yaml:"limit" hcl:"limit"`
+	Elapsed    int         `json:"elapsed" yaml:"elapsed" hcl:"elapsed"`
+	Remaining  *int        `json:"remaining" yaml:"remaining" hcl:"remaining"`
+	Deadline   *time.Time  `json:"deadline" yaml:"deadline" hcl:"deadline"`
+	Expired    bool        `json:"expired" yaml:"expired" hcl:"expired"`
+	Thresholds []Threshold `json:"thresholds" yaml:"thresholds" hcl:"thresholds"`
+}
+
+// Walltime tracks elapsed and remaining walltime of the job and fires
+// warnings when configured thresholds are crossed.
+type Walltime struct {
+	start      time.Time
+	limit      time.Duration
+	thresholds []time.Duration
+	now        func() time.Time
+
+	mu          sync.Mutex
+	fired       map[time.Duration]bool
+	subscribers map[chan Threshold]bool
+}
+
+// NewWalltime returns a walltime tracker for a job which started at start
+// and has a time limit of limit. If limit is zero or negative,
+// walltime is unknown and thresholds never fire.
+func NewWalltime(start time.Time, limit time.Duration, thresholds []time.Duration) *Walltime {
+	sorted := append([]time.Duration{}, thresholds...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] > sorted[j]
+	})
+	if limit < 0 {
+		limit = 0
+	}
+	return &Walltime{
+		start:       start,
+		limit:       limit,
+		thresholds:  sorted,
+		now:         time.Now,
+		fired:       make(map[time.Duration]bool),
+		subscribers: make(map[chan Threshold]bool),
+	}
+}
+
+// Known returns true if walltime limit of the job is known.
+func (w *Walltime) Known() bool {
+	return w.limit > 0
+}
+
+// Deadline returns time at which the job will exceed its walltime.
+func (w *Walltime) Deadline() time.Time {
+	return w.start.Add(w.limit)
+}
+
+// Remaining returns remaining walltime. It is never negative.
+func (w *Walltime) Remaining() time.Duration {
+	remaining := w.Deadline().Sub(w.now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Status returns current walltime status.
+func (w *Walltime) Status() WalltimeStatus {
+	now := w.now()
+	status := WalltimeStatus{
+		Start:      w.start,
+		Elapsed:    int(now.Sub(w.start) / time.Second),
+		Thresholds: []Threshold{},
+	}
+	if !w.Known() {
+		return status
+	}
+	deadline := w.Deadline()
+	status.Limit = intPtr(int(w.limit / time.Second))
+	status.Remaining = intPtr(int(w.Remaining() / time.Second))
+	status.Deadline = &deadline
+	status.Expired = !now.Before(deadline)
+	for _, before := range w.thresholds {
+		status.Thresholds = append(status.Thresholds, w.threshold(before, now))
+	}
+	return status
+}
+
+// threshold returns state of threshold at time now.
+func (w *Walltime) threshold(before time.Duration, now time.Time) Threshold {
+	at := w.Deadline().Add(-before)
+	return Threshold{
+		Before:        before,
+		BeforeSeconds: int(before / time.Second),
+		At:            at,
+		Crossed:       !now.Before(at),
+	}
+}
+
+// Subscribe returns a channel on which thresholds are delivered as
+// they are crossed, along with a function to unsubscribe.
+// Thresholds are dropped if the subscriber is not keeping up.
+func (w *Walltime) Subscribe() (<-chan Threshold, func()) {
+	ch := make(chan Threshold, len(w.thresholds)+1)
+	w.mu.Lock()
+	w.subscribers[ch] = true
+	w.mu.Unlock()
+	return ch, func() {
+		w.mu.Lock()
+		delete(w.subscribers, ch)
+		w.mu.Unlock()
+	}
+}
+
+// check fires all thresholds which are crossed but not yet fired.
+// It returns time until the next threshold, or zero if there are none.
+func (w *Walltime) check() time.Duration {
+	now := w.now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next := time.Duration(0)
+	for _, before := range w.thresholds {
+		if w.fired[before] {
+			continue
+		}
+		t := w.threshold(before, now)
+		if !t.Crossed {
+			if wait := t.At.Sub(now); next == 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		w.fired[before] = true
+		log.Printf("[WARN] Walltime warning: %s remaining (threshold %s)",
+			w.Remaining().Round(time.Second), before)
+		for ch := range w.subscribers {
+			select {
+			case ch <- t:
+			default:
+			}
+		}
+	}
+	return next
+}
+
+// Run fires thresholds as they are crossed, until ctx is done.
+// Thresholds which are already crossed when Run is called fire immediately.
+func (w *Walltime) Run(ctx context.Context) {
+	if !w.Known() || len(w.thresholds) == 0 {
+		return
+	}
+	for {
+		next := w.check()
+		if next == 0 {
+			return
+		}
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// durationsFlag is a flag.Value for comma separated list of durations.
+type durationsFlag []time.Duration
+
+func (d *durationsFlag) String() string {
+	if d == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*d))
+	for _, v := range *d {
+		items = append(items, v.String())
+	}
+	return strings.Join(items, ",")
+}
+
+func (d *durationsFlag) Set(value string) error {
+	var durations []time.Duration
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		v, err := time.ParseDuration(item)
+		if err != nil {
+			return err
+		}
+		if v <= 0 {
+			return fmt.Errorf("duration %s must be positive", item)
+		}
+		durations = append(durations, v)
+	}
+	*d = durations
+	return nil
+}
+
+// timeFlag is a flag.Value for a timestamp in RFC3339 form
+// or in seconds since unix epoch.
+type timeFlag struct {
+	time.Time
+}
+
+func (t *timeFlag) String() string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeFlag) Set(value string) error {
+	if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+		t.Time = time.Unix(v, 0)
+		return nil
+	}
+	v, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("time must be in RFC3339 form or seconds since epoch")
+	}
+	t.Time = v
+	return nil
+}
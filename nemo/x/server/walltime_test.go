@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWalltime(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect time.Duration
+	}{
+		{input: "0", expect: 0},
+		{input: "3600", expect: time.Hour},
+		{input: " 60 ", expect: time.Minute},
+		{input: "01:00:00", expect: time.Hour},
+		{input: "1:30:05", expect: time.Hour + 30*time.Minute + 5*time.Second},
+		{input: "48:00:00", expect: 48 * time.Hour},
+		{input: "30:00", expect: 30 * time.Minute},
+		{input: "90:00", expect: 90 * time.Minute},
+		{input: "1:00:00:00", expect: 24 * time.Hour},
+		{input: "2-00:00:00", expect: 48 * time.Hour},
+		{input: "1-12:00", expect: 36 * time.Hour},
+		{input: "1-12", expect: 36 * time.Hour},
+		{input: "0-00:30:15", expect: 30*time.Minute + 15*time.Second},
+		{input: "87600:00:00", expect: maxWalltime * time.Second},
+	}
+	for _, tc := range tests {
+		actual, err := parseWalltime(tc.input)
+		assert.Nil(t, err, tc.input)
+		assert.Equal(t, tc.expect, actual, tc.input)
+	}
+}
+
+func TestParseWalltimeInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"abc",
+		"-1",
+		"1h",
+		"01:60:00",
+		"01:00:60",
+		"1::00",
+		":00",
+		"1:2:3:4:5",
+		"1-2:00:00:00",
+		"1-24",
+		"1-",
+		"x-01:00:00",
+		"01:-1:00",
+		// Too long, or overflowing int
+		"315360001",
+		"87600:00:01",
+		"3650-00:00:01",
+		"9223372036854775807",
+		"99999999999999999999",
+		"2562047788015215:00:00",
+		"106751991167300-00:00:00",
+	}
+	for _, input := range tests {
+		_, err := parseWalltime(input)
+		assert.ErrorIs(t, err, ErrInvalidWalltime, input)
+	}
+}
+
+func TestPBSSchedulerWalltime(t *testing.T) {
+	tests := map[string]*int{
+		"3600":     intPtr(3600),
+		"02:00:00": intPtr(7200),
+		"garbage":  nil,
+	}
+	for input, expect := range tests {
+		env := MapEnv(map[string]string{"PBS_WALLTIME": input})
+		assert.Equal(t, expect, pbsScheduler{}.walltime(env), input)
+	}
+	assert.Nil(t, pbsScheduler{}.walltime(MapEnv(nil)))
+}
+
+func TestSlurmSchedulerStartTime(t *testing.T) {
+	start, ok := slurmScheduler{}.StartTime(MapEnv(map[string]string{"SLURM_JOB_START_TIME": "1000"}))
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1000, 0), start)
+
+	_, ok = slurmScheduler{}.StartTime(MapEnv(nil))
+	assert.False(t, ok)
+}
+
+// fakeClock returns a function returning *now, for use as Walltime.now.
+func fakeClock(now *time.Time) func() time.Time {
+	return func() time.Time {
+		return *now
+	}
+}
+
+func TestWalltimeStatus(t *testing.T) {
+	start := time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+	now := start.Add(30 * time.Minute)
+	w := NewWalltime(start, time.Hour, []time.Duration{5 * time.Minute, 45 * time.Minute})
+	w.now = fakeClock(&now)
+
+	status := w.Status()
+	deadline := start.Add(time.Hour)
+	assert.Equal(t, start, status.Start)
+	assert.Equal(t, intPtr(3600), status.Limit)
+	assert.Equal(t, 1800, status.Elapsed)
+	assert.Equal(t, intPtr(1800), status.Remaining)
+	assert.Equal(t, &deadline, status.Deadline)
+	assert.False(t, status.Expired)
+	assert.Equal(t, []Threshold{
+		{Before: 45 * time.Minute, BeforeSeconds: 2700, At: start.Add(15 * time.Minute), Crossed: true},
+		{Before: 5 * time.Minute, BeforeSeconds: 300, At: start.Add(55 * time.Minute), Crossed: false},
+	}, status.Thresholds)
+
+	now = start.Add(2 * time.Hour)
+	status = w.Status()
+	assert.True(t, status.Expired)
+	assert.Equal(t, intPtr(0), status.Remaining)
+	assert.Equal(t, 7200, status.Elapsed)
+}
+
+func TestWalltimeUnknown(t *testing.T) {
+	w := NewWalltime(time.Now(), -1, []time.Duration{time.Minute})
+	assert.False(t, w.Known())
+	status := w.Status()
+	assert.Nil(t, status.Limit)
+	assert.Nil(t, status.Remaining)
+	assert.Nil(t, status.Deadline)
+	assert.False(t, status.Expired)
+	assert.Empty(t, status.Thresholds)
+
+	// Run must return immediately.
+	w.Run(context.Background())
+}
+
+func TestWalltimeCheck(t *testing.T) {
+	start := time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC)
+	now := start
+	w := NewWalltime(start, time.Hour, []time.Duration{5 * time.Minute, 15 * time.Minute})
+	w.now = fakeClock(&now)
+	ch, unsubscribe := w.Subscribe()
+	defer unsubscribe()
+
+	assert.Equal(t, 45*time.Minute, w.check())
+	assert.Len(t, ch, 0)
+
+	now = start.Add(50 * time.Minute)
+	assert.Equal(t, 5*time.Minute, w.check())
+	assert.Len(t, ch, 1)
+	assert.Equal(t, 15*time.Minute, (<-ch).Before)
+
+	// Already fired thresholds must not fire again.
+	assert.Equal(t, 5*time.Minute, w.check())
+	assert.Len(t, ch, 0)
+
+	now = start.Add(59 * time.Minute)
+	assert.Equal(t, time.Duration(0), w.check())
+	assert.Equal(t, 5*time.Minute, (<-ch).Before)
+}
+
+func TestWalltimeRun(t *testing.T) {
+	// Thresholds which are already crossed fire immediately,
+	// others fire when they are crossed.
+	w := NewWalltime(time.Now(), time.Hour+100*time.Millisecond, []time.Duration{2 * time.Hour, time.Hour})
+	ch, unsubscribe := w.Subscribe()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	for _, expect := range []time.Duration{2 * time.Hour, time.Hour} {
+		select {
+		case th := <-ch:
+			assert.Equal(t, expect, th.Before)
+			assert.True(t, th.Crossed)
+		case <-ctx.Done():
+			t.Fatalf("threshold %s did not fire", expect)
+		}
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("Run did not return after all thresholds fired")
+	}
+}
+
+func TestHandleWalltime(t *testing.T) {
+	env := MapEnv(map[string]string{"PBS_JOBID": "1", "PBS_WALLTIME": "01:00:00"})
+	start := time.Now().Add(-10 * time.Minute)
+	s := NewServer(Options{Scheduler: pbsScheduler{}, Env: env, JobStart: start}, func() {})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/walltime", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var status WalltimeStatus
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, intPtr(3600), status.Limit)
+	assert.InDelta(t, 600, status.Elapsed, 5)
+	if assert.NotNil(t, status.Remaining) {
+		assert.InDelta(t, 3000, *status.Remaining, 5)
+	}
+	assert.True(t, status.Deadline.Equal(start.Add(time.Hour)))
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/walltime?wait=bogus", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// No thresholds are configured, so wait must time out.
+	w = httptest.NewRecorder()
+	begin := time.Now()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/walltime?wait=50ms", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.GreaterOrEqual(t, int64(time.Since(begin)), int64(50*time.Millisecond))
+}
+
+func TestHandleWalltimeWait(t *testing.T) {
+	env := MapEnv(map[string]string{"PBS_JOBID": "1", "PBS_WALLTIME": "3600"})
+	s := NewServer(Options{
+		Scheduler:        pbsScheduler{},
+		Env:              env,
+		JobStart:         time.Now().Add(-time.Hour).Add(100 * time.Millisecond),
+		WalltimeWarnings: []time.Duration{50 * time.Millisecond},
+	}, func() {})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/walltime?wait=10s", nil))
+		done <- w
+	}()
+
+	// Give request time to subscribe, before thresholds are fired.
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.walltime.Run(ctx)
+
+	select {
+	case w := <-done:
+		assert.Equal(t, http.StatusOK, w.Code)
+		var status WalltimeStatus
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+		assert.True(t, status.Thresholds[0].Crossed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return when threshold was crossed")
+	}
+}
+
+func TestDurationsFlag(t *testing.T) {
+	var d durationsFlag
+	assert.Nil(t, d.Set("15m, 5m,"))
+	assert.Equal(t, durationsFlag{15 * time.Minute, 5 * time.Minute}, d)
+	assert.Equal(t, "15m0s,5m0s", d.String())
+	assert.NotNil(t, d.Set("15"))
+	assert.NotNil(t, d.Set("-5m"))
+}
+
+func TestTimeFlag(t *testing.T) {
+	var v timeFlag
+	assert.Nil(t, v.Set("1000"))
+	assert.Equal(t, time.Unix(1000, 0), v.Time)
+	assert.Nil(t, v.Set("2021-07-01T10:00:00Z"))
+	assert.Equal(t, time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC), v.Time)
+	assert.NotNil(t, v.Set("yesterday"))
+}